@@ -0,0 +1,476 @@
+package redis
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultUser = "default"
+
+// User is an ACL user: the passwords allowed to authenticate as it, and the
+// commands and keys it can access. Users are managed with the ACL command,
+// Config.User or Server.SetUser, using the redis ACL rules syntax.
+type User struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords map[string]struct{} // hex encoded SHA-256 of the passwords
+	commands  []string            // "+get", "-@write", ... applied in order
+	allKeys   bool
+	keys      []string
+	deleted   bool
+}
+
+func newUser(name string) *User {
+	return &User{name: name, passwords: map[string]struct{}{}}
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+var aclCategories = map[string]int{
+	"read":   CmdReadOnly,
+	"write":  CmdWrite,
+	"admin":  CmdAdmin,
+	"pubsub": CmdPubSub,
+
+	"blocking":    CmdBlocking,
+	"transaction": CmdTransaction,
+}
+
+// apply changes the user according to a single ACL rule.
+func (u *User) apply(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = map[string]struct{}{}
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = map[string]struct{}{}
+		return nil
+	case "allkeys":
+		u.allKeys = true
+		u.keys = nil
+		return nil
+	case "resetkeys":
+		u.allKeys = false
+		u.keys = nil
+		return nil
+	case "allcommands":
+		rule = "+@all"
+	case "nocommands":
+		rule = "-@all"
+	case "reset":
+		*u = *newUser(u.name)
+		return nil
+	}
+	if rule == "" {
+		return fmt.Errorf("Syntax error in ACL SETUSER modifier ''")
+	}
+
+	switch rule[0] {
+	case '>':
+		u.passwords[hashPassword(rule[1:])] = struct{}{}
+		u.nopass = false
+	case '<':
+		delete(u.passwords, hashPassword(rule[1:]))
+	case '#', '!':
+		hash := strings.ToLower(rule[1:])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if rule[0] == '#' {
+			u.passwords[hash] = struct{}{}
+			u.nopass = false
+		} else {
+			delete(u.passwords, hash)
+		}
+	case '~':
+		if rule == "~*" {
+			u.allKeys = true
+			u.keys = nil
+		} else if !u.allKeys {
+			u.keys = append(u.keys, rule[1:])
+		}
+	case '+', '-':
+		name := strings.ToLower(rule[1:])
+		if strings.HasPrefix(name, "@") {
+			if _, exists := aclCategories[name[1:]]; !exists && name != "@all" {
+				return fmt.Errorf("Unknown command or category name in ACL")
+			}
+		}
+		if name == "@all" {
+			// Everything before is overridden.
+			u.commands = nil
+		}
+		u.commands = append(u.commands, rule[:1]+name)
+	default:
+		return fmt.Errorf("Syntax error in ACL SETUSER modifier '%s'", rule)
+	}
+	return nil
+}
+
+// canRun reports whether the user may run the command: the last matching
+// rule wins, and nothing is allowed by default.
+func (u *User) canRun(name string, flags int) bool {
+	for i := len(u.commands) - 1; i >= 0; i-- {
+		rule := u.commands[i]
+		allow, target := rule[0] == '+', rule[1:]
+		switch {
+		case target == name, target == "@all":
+			return allow
+		case strings.HasPrefix(target, "@") && flags&aclCategories[target[1:]] != 0:
+			return allow
+		}
+	}
+	return false
+}
+
+func (u *User) canAccess(key string) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, pattern := range u.keys {
+		if matchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for h := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) flags() []interface{} {
+	flags := []interface{}{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.allKeys {
+		flags = append(flags, "allkeys")
+	}
+	if len(u.commands) > 0 && u.commands[len(u.commands)-1] == "+@all" {
+		flags = append(flags, "allcommands")
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *User) commandRules() string {
+	if len(u.commands) == 0 {
+		return "-@all"
+	}
+	return strings.Join(u.commands, " ")
+}
+
+func (u *User) sortedPasswords() []string {
+	passwords := make([]string, 0, len(u.passwords))
+	for h := range u.passwords {
+		passwords = append(passwords, h)
+	}
+	sort.Strings(passwords)
+	return passwords
+}
+
+// String describes the user as ACL LIST does.
+func (u *User) String() string {
+	parts := []string{"user", u.name}
+	for _, flag := range u.flags() {
+		if flag != "allkeys" && flag != "allcommands" {
+			parts = append(parts, flag.(string))
+		}
+	}
+	for _, h := range u.sortedPasswords() {
+		parts = append(parts, "#"+h)
+	}
+	if u.allKeys {
+		parts = append(parts, "~*")
+	}
+	for _, pattern := range u.keys {
+		parts = append(parts, "~"+pattern)
+	}
+	parts = append(parts, u.commandRules())
+	return strings.Join(parts, " ")
+}
+
+// acl holds the users of a server.
+type acl struct {
+	sync.RWMutex
+	users map[string]*User
+}
+
+// newACL returns an ACL with the default user, which can run every command
+// without password like a redis server without requirepass.
+func newACL() *acl {
+	a := &acl{users: map[string]*User{}}
+	a.setUser(defaultUser, "on", "nopass", "allkeys", "allcommands")
+	return a
+}
+
+// setUser creates or changes the user name. The rules are applied all
+// together or not at all.
+func (a *acl) setUser(name string, rules ...string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	u, exists := a.users[name]
+	if !exists {
+		u = newUser(name)
+	}
+	changed := *u
+	changed.passwords = make(map[string]struct{}, len(u.passwords))
+	for h := range u.passwords {
+		changed.passwords[h] = struct{}{}
+	}
+	changed.commands = append([]string(nil), u.commands...)
+	changed.keys = append([]string(nil), u.keys...)
+	for _, rule := range rules {
+		if err := changed.apply(rule); err != nil {
+			return err
+		}
+	}
+	// Update in place: authenticated clients see the changes right away.
+	*u = changed
+	a.users[name] = u
+	return nil
+}
+
+func (a *acl) delUser(name string) bool {
+	a.Lock()
+	defer a.Unlock()
+	u, exists := a.users[name]
+	if !exists {
+		return false
+	}
+	u.deleted = true
+	delete(a.users, name)
+	return true
+}
+
+// authenticate returns the user name if password is valid for it.
+func (a *acl) authenticate(name, password string) (*User, bool) {
+	a.RLock()
+	defer a.RUnlock()
+	u, exists := a.users[name]
+	if !exists || !u.enabled || !u.checkPassword(password) {
+		return nil, false
+	}
+	return u, true
+}
+
+func (srv *Server) getACL() *acl {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.acl == nil {
+		srv.acl = newACL()
+	}
+	return srv.acl
+}
+
+// SetUser creates or modifies an ACL user, like ACL SETUSER. For instance:
+//
+//	srv.SetUser("default", "resetpass", ">secret")
+//	srv.SetUser("reader", "on", ">pass", "~cache:*", "+@read")
+func (srv *Server) SetUser(name string, rules ...string) error {
+	return srv.getACL().setUser(name, rules...)
+}
+
+// DeleteUser removes an ACL user. The default user cannot be removed.
+func (srv *Server) DeleteUser(name string) bool {
+	if name == defaultUser {
+		return false
+	}
+	return srv.getACL().delUser(name)
+}
+
+// checkPermissions verifies that the client of r is authenticated and
+// allowed to run the command on its keys. Requests that did not come from
+// a connection are trusted.
+func (srv *Server) checkPermissions(r *Request) ReplyWriter {
+	if r.Client == nil {
+		return nil
+	}
+	name := strings.ToLower(r.Name)
+	spec := srv.commandSpec(name)
+	if spec.Flags&CmdNoAuth != 0 {
+		return nil
+	}
+	a := srv.getACL()
+	user := r.Client.user
+	if user == nil {
+		// Not authenticated yet: the default user is used if it does
+		// not need a password.
+		u, ok := a.authenticate(defaultUser, "")
+		if !ok {
+			return ErrNoAuth
+		}
+		r.Client.user = u
+		user = u
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+	if user.deleted {
+		return ErrNoAuth
+	}
+	if !user.canRun(name, spec.Flags) {
+		return &ErrorReply{
+			code:    "NOPERM",
+			message: fmt.Sprintf("User %s has no permissions to run the '%s' command", user.name, name),
+		}
+	}
+	for _, key := range spec.keys(r.Args) {
+		if !user.canAccess(key) {
+			return ErrNoPermKey
+		}
+	}
+	return nil
+}
+
+// authCommand implements AUTH [username] password.
+func (srv *Server) authCommand(r *Request) (ReplyWriter, error) {
+	var name, password string
+	switch len(r.Args) {
+	case 1:
+		name, password = defaultUser, string(r.Args[0])
+	case 2:
+		name, password = string(r.Args[0]), string(r.Args[1])
+	default:
+		return ErrSyntax, nil
+	}
+	a := srv.getACL()
+	if len(r.Args) == 1 {
+		a.RLock()
+		u := a.users[defaultUser]
+		nopass := u != nil && u.nopass
+		a.RUnlock()
+		if nopass {
+			return NewError("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"), nil
+		}
+	}
+	user, ok := a.authenticate(name, password)
+	if !ok {
+		return ErrWrongPass, nil
+	}
+	if r.Client == nil {
+		r.Client = newClient(r.Host)
+	}
+	r.Client.user = user
+	return &StatusReply{code: "OK"}, nil
+}
+
+// aclCommand implements the ACL SETUSER, GETUSER, DELUSER, LIST, USERS and
+// WHOAMI subcommands.
+func (srv *Server) aclCommand(r *Request) (ReplyWriter, error) {
+	sub, reply := r.GetString(0)
+	if reply != nil {
+		return reply, nil
+	}
+	a := srv.getACL()
+	switch strings.ToLower(sub) {
+	case "setuser":
+		name, reply := r.GetString(1)
+		if reply != nil {
+			return reply, nil
+		}
+		rules, _ := r.GetStringSlice(2)
+		if err := a.setUser(name, rules...); err != nil {
+			return NewError(fmt.Sprintf("Error in ACL SETUSER modifier: %s", err)), nil
+		}
+		return &StatusReply{code: "OK"}, nil
+	case "getuser":
+		name, reply := r.GetString(1)
+		if reply != nil {
+			return reply, nil
+		}
+		a.RLock()
+		defer a.RUnlock()
+		u, exists := a.users[name]
+		if !exists {
+			return &BulkReply{}, nil
+		}
+		passwords := []interface{}{}
+		for _, h := range u.sortedPasswords() {
+			passwords = append(passwords, h)
+		}
+		keys := []interface{}{}
+		if u.allKeys {
+			keys = append(keys, "*")
+		}
+		for _, pattern := range u.keys {
+			keys = append(keys, pattern)
+		}
+		return &MultiBulkReply{values: []interface{}{
+			"flags", u.flags(),
+			"passwords", passwords,
+			"commands", u.commandRules(),
+			"keys", keys,
+		}}, nil
+	case "deluser":
+		names, reply := r.GetStringSlice(1)
+		if reply != nil {
+			return reply, nil
+		}
+		count := 0
+		for _, name := range names {
+			if name == defaultUser {
+				return NewError("The 'default' user cannot be removed"), nil
+			}
+		}
+		for _, name := range names {
+			if a.delUser(name) {
+				count++
+			}
+		}
+		return &IntegerReply{number: count}, nil
+	case "list", "users":
+		a.RLock()
+		defer a.RUnlock()
+		names := make([]string, 0, len(a.users))
+		for name := range a.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			if strings.ToLower(sub) == "list" {
+				values = append(values, a.users[name].String())
+			} else {
+				values = append(values, name)
+			}
+		}
+		return &MultiBulkReply{values: values}, nil
+	case "whoami":
+		if r.Client == nil || r.Client.user == nil {
+			return &BulkReply{value: []byte(defaultUser)}, nil
+		}
+		return &BulkReply{value: []byte(r.Client.user.name)}, nil
+	}
+	return NewError(fmt.Sprintf("Unknown subcommand or wrong number of arguments for '%s'", sub)), nil
+}
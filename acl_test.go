@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestACLRequirePass(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().RequirePass("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("GET", "key"), "-NOAUTH Authentication required.\r\n"},
+		{c, req("AUTH", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{c, req("AUTH", "default", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{c, req("GET", "key"), "-NOAUTH Authentication required.\r\n"},
+		{c, req("AUTH", "secret"), "+OK\r\n"},
+		{c, req("SET", "key", "value"), "+OK\r\n"},
+		{c, req("GET", "key"), "$5\r\nvalue\r\n"},
+		{c, req("ACL", "WHOAMI"), "$7\r\ndefault\r\n"},
+		{c, req("AUTH", "a", "b", "c"), "-ERROR syntax error\r\n"},
+	})
+}
+
+func TestACLNoPassword(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("PING"), "+PONG\r\n"},
+		{c, req("AUTH", "x"), "-ERROR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?\r\n"},
+		{c, req("ACL", "WHOAMI"), "$7\r\ndefault\r\n"},
+	})
+}
+
+func TestACLPermissions(t *testing.T) {
+	srv := newDefaultServer(t)
+	admin, alice, bob := newClient("admin"), newClient("alice"), newClient("bob")
+	runHandlerTests(t, srv, []handlerTest{
+		{admin, req("ACL", "SETUSER", "alice", "on", ">p1", "~cache:*", "+get", "+set"), "+OK\r\n"},
+		{admin, req("ACL", "SETUSER", "bob", "on", ">p2", "allkeys", "+@read"), "+OK\r\n"},
+		{admin, req("SET", "secret", "42"), "+OK\r\n"},
+
+		{alice, req("AUTH", "alice", "p2"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{alice, req("AUTH", "alice", "p1"), "+OK\r\n"},
+		{alice, req("SET", "cache:1", "x"), "+OK\r\n"},
+		{alice, req("GET", "cache:1"), "$1\r\nx\r\n"},
+		{alice, req("GET", "secret"), "-NOPERM No permissions to access a key\r\n"},
+		{alice, req("DEL", "cache:1"), "-NOPERM User alice has no permissions to run the 'del' command\r\n"},
+		{alice, req("ACL", "WHOAMI"), "-NOPERM User alice has no permissions to run the 'acl' command\r\n"},
+
+		{bob, req("AUTH", "bob", "p2"), "+OK\r\n"},
+		{bob, req("GET", "secret"), "$2\r\n42\r\n"},
+		{bob, req("SET", "secret", "0"), "-NOPERM User bob has no permissions to run the 'set' command\r\n"},
+
+		// Changes apply to authenticated clients right away.
+		{admin, req("ACL", "SETUSER", "bob", "-get"), "+OK\r\n"},
+		{bob, req("GET", "secret"), "-NOPERM User bob has no permissions to run the 'get' command\r\n"},
+		{bob, req("LRANGE", "secret", "0", "1"), "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{admin, req("ACL", "SETUSER", "bob", "+@all", "-@write"), "+OK\r\n"},
+		{bob, req("GET", "secret"), "$2\r\n42\r\n"},
+		{bob, req("DEL", "secret"), "-NOPERM User bob has no permissions to run the 'del' command\r\n"},
+
+		// Disabled users can no longer authenticate.
+		{admin, req("ACL", "SETUSER", "alice", "off"), "+OK\r\n"},
+		{bob, req("AUTH", "alice", "p1"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+
+		// Deleted users are logged out.
+		{admin, req("ACL", "DELUSER", "alice", "nobody"), ":1\r\n"},
+		{alice, req("GET", "cache:1"), "-NOAUTH Authentication required.\r\n"},
+		{admin, req("ACL", "DELUSER", "default"), "-ERROR The 'default' user cannot be removed\r\n"},
+	})
+}
+
+func TestACLUserManagement(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	hash := hashPassword("p1")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("ACL", "SETUSER", "alice", "on", ">p1", "~cache:*", "~tmp:*", "+get"), "+OK\r\n"},
+		{c, req("ACL", "GETUSER", "alice"),
+			"*8\r\n$5\r\nflags\r\n*1\r\n$2\r\non\r\n" +
+				"$9\r\npasswords\r\n*1\r\n$64\r\n" + hash + "\r\n" +
+				"$8\r\ncommands\r\n$4\r\n+get\r\n" +
+				"$4\r\nkeys\r\n*2\r\n$7\r\ncache:*\r\n$5\r\ntmp:*\r\n"},
+		{c, req("ACL", "GETUSER", "nobody"), "$-1\r\n"},
+		{c, req("ACL", "LIST"),
+			"*2\r\n$" + strconv.Itoa(len("user alice on #"+hash+" ~cache:* ~tmp:* +get")) + "\r\nuser alice on #" + hash + " ~cache:* ~tmp:* +get\r\n" +
+				"$31\r\nuser default on nopass ~* +@all\r\n"},
+		{c, req("ACL", "USERS"), "*2\r\n$5\r\nalice\r\n$7\r\ndefault\r\n"},
+		{c, req("ACL", "SETUSER", "alice", "<p1", "#"+hashPassword("p2"), "resetkeys", "nocommands"), "+OK\r\n"},
+		{c, req("ACL", "LIST"),
+			"*2\r\n$" + strconv.Itoa(len("user alice on #"+hashPassword("p2")+" -@all")) + "\r\nuser alice on #" + hashPassword("p2") + " -@all\r\n" +
+				"$31\r\nuser default on nopass ~* +@all\r\n"},
+		{c, req("ACL", "SETUSER", "alice", "+@nothing"), "-ERROR Error in ACL SETUSER modifier: Unknown command or category name in ACL\r\n"},
+		{c, req("ACL", "SETUSER", "alice", "+get", "bogus"), "-ERROR Error in ACL SETUSER modifier: Syntax error in ACL SETUSER modifier 'bogus'\r\n"},
+		// A failed SETUSER changes nothing.
+		{c, req("ACL", "GETUSER", "alice"),
+			"*8\r\n$5\r\nflags\r\n*1\r\n$2\r\non\r\n" +
+				"$9\r\npasswords\r\n*1\r\n$64\r\n" + hashPassword("p2") + "\r\n" +
+				"$8\r\ncommands\r\n$5\r\n-@all\r\n" +
+				"$4\r\nkeys\r\n*0\r\n"},
+		{c, req("ACL", "NOPE"), "-ERROR Unknown subcommand or wrong number of arguments for 'NOPE'\r\n"},
+	})
+}
+
+func TestACLConfig(t *testing.T) {
+	if _, err := NewServer(DefaultConfig().User("app", "bogus")); err == nil {
+		t.Fatal("Expected an error for an invalid rule")
+	}
+
+	srv, err := NewServer(DefaultConfig().User("default", "off").User("app", "on", ">secret", "~app:*", "+@all"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	srv.Register("touch", func(r *Request) (ReplyWriter, error) {
+		return &StatusReply{code: "OK"}, nil
+	})
+	srv.Register("info", func(r *Request) (ReplyWriter, error) {
+		return &StatusReply{code: "OK"}, nil
+	})
+	srv.SetCommandSpec("info", CommandSpec{Flags: CmdReadOnly})
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("PING"), "-NOAUTH Authentication required.\r\n"},
+		{c, req("AUTH", "app", "secret"), "+OK\r\n"},
+		// Without a spec, the first argument is a key.
+		{c, req("TOUCH", "app:1"), "+OK\r\n"},
+		{c, req("TOUCH", "other"), "-NOPERM No permissions to access a key\r\n"},
+		{c, req("INFO", "other"), "+OK\r\n"},
+	})
+
+	if err := srv.SetUser("app", "-touch"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("TOUCH", "app:1"), "-NOPERM User app has no permissions to run the 'touch' command\r\n"},
+	})
+	if !srv.DeleteUser("app") || srv.DeleteUser("default") {
+		t.Fatal("Expected only app to be deleted")
+	}
+	if reply, _ := srv.ApplyString(&Request{Name: "INFO", Client: c}); !strings.HasPrefix(reply, "-NOAUTH") {
+		t.Fatalf("Expected NOAUTH, got %q", reply)
+	}
+}
+
+func TestCommandSpecKeys(t *testing.T) {
+	expected := []struct {
+		spec CommandSpec
+		args [][]byte
+		keys []string
+	}{
+		{CommandSpec{FirstKey: 1, LastKey: 1, Step: 1}, b("a", "b"), []string{"a"}},
+		{CommandSpec{FirstKey: 1, LastKey: -1, Step: 1}, b("a", "b", "c"), []string{"a", "b", "c"}},
+		{CommandSpec{FirstKey: 1, LastKey: -2, Step: 1}, b("a", "b", "0"), []string{"a", "b"}},
+		{CommandSpec{FirstKey: 1, LastKey: -1, Step: 2}, b("a", "1", "b", "2"), []string{"a", "b"}},
+		{CommandSpec{FirstKey: 1, LastKey: 1, Step: 1}, nil, nil},
+		{CommandSpec{Keys: storeNumkeysKeys}, b("dst", "2", "a", "b", "WEIGHTS", "1", "2"), []string{"dst", "a", "b"}},
+		{CommandSpec{}, b("a"), nil},
+	}
+	for _, v := range expected {
+		keys := v.spec.keys(v.args)
+		if strings.Join(keys, ",") != strings.Join(v.keys, ",") {
+			t.Fatalf("Expected keys %q, got %q for %q", v.keys, keys, v.args)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	expected := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"cache:*", "cache:1", true},
+		{"cache:*", "cach", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"*:*:x", "a:b:x", true},
+		{"a**b", "ab", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h\\?", "h?", true},
+		{"[abc", "b", true},
+		{"a\\", "a\\", true},
+	}
+	for _, v := range expected {
+		if matchPattern(v.pattern, v.s) != v.match {
+			t.Fatalf("Expected match(%q, %q) to be %v", v.pattern, v.s, v.match)
+		}
+	}
+}
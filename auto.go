@@ -2,9 +2,15 @@ package redis
 
 import (
 	"bytes"
+	"context"
+	"encoding"
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
 	"reflect"
+	"sort"
+	"strconv"
 	"time"
 )
 
@@ -68,6 +74,7 @@ func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers
 				request.Host,
 				request.Name)
 		}
+		srv.monitorMu.Lock()
 		for _, c := range srv.MonitorChans {
 			select {
 			case c <- monitorString:
@@ -75,6 +82,7 @@ func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers
 			}
 		}
 		Debugf("%s (connected monitors: %d)\n", monitorString, len(srv.MonitorChans))
+		srv.monitorMu.Unlock()
 
 		var result []reflect.Value
 
@@ -97,6 +105,10 @@ func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers
 		var ret interface{}
 		if ierr := result[len(result)-1].Interface(); ierr != nil {
 			// Last return value is an error, wrap it to redis error
+			// unless it already is one.
+			if reply, ok := ierr.(*ErrorReply); ok {
+				return reply, nil
+			}
 			err := ierr.(error)
 			// convert to redis error reply
 			return NewError(err.Error()), nil
@@ -109,12 +121,38 @@ func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers
 	}, nil
 }
 
-func hashValueReply(v HashValue) (*MultiBulkReply, error) {
+func hashValueReply(r *Request, v HashValue) (ReplyWriter, error) {
 	m := make(map[string]interface{})
 	for k, v := range v {
 		m[k] = v
 	}
-	return MultiBulkFromMap(m), nil
+	return mapReply(r, m), nil
+}
+
+// mapReply returns m as a map for RESP3 connections and as a flat list of
+// keys and values otherwise.
+func mapReply(r *Request, m map[string]interface{}) ReplyWriter {
+	if r.resp3() {
+		return NewMapReply(m)
+	}
+	return MultiBulkFromMap(m)
+}
+
+// setReply returns the members of v sorted, as a set for RESP3 connections.
+func setReply(r *Request, v SetValue) ReplyWriter {
+	members := make([]string, 0, len(v))
+	for m := range v {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	values := make([]interface{}, len(members))
+	for i, m := range members {
+		values[i] = []byte(m)
+	}
+	if r.resp3() {
+		return &SetReply{values: values}
+	}
+	return &MultiBulkReply{values: values}
 }
 
 func (srv *Server) createReply(r *Request, val interface{}) (ReplyWriter, error) {
@@ -136,29 +174,54 @@ func (srv *Server) createReply(r *Request, val interface{}) (ReplyWriter, error)
 	case []byte:
 		return &BulkReply{value: v}, nil
 	case HashValue:
-		return hashValueReply(v)
+		return hashValueReply(r, v)
 	case map[string][]byte:
-		return hashValueReply(v)
+		return hashValueReply(r, v)
 	case map[string]interface{}:
-		return MultiBulkFromMap(v), nil
+		return mapReply(r, v), nil
+	case SetValue:
+		return setReply(r, v), nil
 	case int:
 		return &IntegerReply{number: v}, nil
+	case float64:
+		return &DoubleReply{value: v}, nil
+	case bool:
+		return &BooleanReply{value: v}, nil
+	case *big.Int:
+		return &BigNumberReply{value: v}, nil
 	case *StatusReply:
 		return v, nil
 	case *MonitorReply:
 		c := make(chan string)
+		srv.monitorMu.Lock()
 		srv.MonitorChans = append(srv.MonitorChans, c)
 		println("len monitor: ", len(srv.MonitorChans))
+		srv.monitorMu.Unlock()
 		v.c = c
+		v.clientChan = r.ClientChan
+		v.done = srv.getDoneChan()
+		if r.ClientChan != nil {
+			go func() {
+				<-r.ClientChan
+				srv.removeMonitor(c)
+			}()
+		}
 		return v, nil
 	case *ChannelWriter:
+		v.clientChan = r.ClientChan
+		v.done = srv.getDoneChan()
+		v.push = r.resp3()
 		return v, nil
 	case *MultiChannelWriter:
 		println("New client")
 		for _, mcw := range v.Chans {
 			mcw.clientChan = r.ClientChan
+			mcw.done = srv.getDoneChan()
+			mcw.push = r.resp3()
 		}
 		return v, nil
+	case ReplyWriter:
+		return v, nil
 	default:
 		return nil, fmt.Errorf("Unsupported type: %s (%T)", v, v)
 	}
@@ -175,30 +238,68 @@ func createCheckers(autoHandler interface{}, f *reflect.Value) ([]CheckerFn, err
 		start = 1
 	}
 
+	// index is the position in request.Args of the next command argument.
+	// Injected parameters (such as *Client) do not consume one.
+	index := 0
 	for i := start; i < mtype.NumIn(); i += 1 {
 		switch mtype.In(i) {
+		case contextType:
+			if i != start {
+				return nil, fmt.Errorf("Argument %d: context.Context must be the first argument", i)
+			}
+			checkers = append(checkers, contextChecker)
+			continue
+		case reflect.TypeOf(&Client{}):
+			if index != 0 {
+				return nil, fmt.Errorf("Argument %d: *Client must come before the command arguments", i)
+			}
+			checkers = append(checkers, clientChecker)
+			continue
 		case reflect.TypeOf(""):
-			checkers = append(checkers, stringChecker(i-start))
+			checkers = append(checkers, stringChecker(index))
 		case reflect.TypeOf([]string{}):
-			checkers = append(checkers, stringSliceChecker(i-start))
+			checkers = append(checkers, stringSliceChecker(index))
 		case reflect.TypeOf([]byte{}):
-			checkers = append(checkers, byteChecker(i-start))
+			checkers = append(checkers, byteChecker(index))
 		case reflect.TypeOf([][]byte{}):
-			checkers = append(checkers, byteSliceChecker(i-start))
+			checkers = append(checkers, byteSliceChecker(index))
 		case reflect.TypeOf(map[string][]byte{}):
 			if i != mtype.NumIn()-1 {
 				return nil, errors.New("Map should be the last argument")
 			}
-			checkers = append(checkers, mapChecker(i-start))
+			checkers = append(checkers, mapChecker(index))
 		case reflect.TypeOf(1):
-			checkers = append(checkers, intChecker(i-start))
+			checkers = append(checkers, intChecker(index))
 		default:
-			return nil, fmt.Errorf("Argument %d: wrong type %s (%s)", i, mtype.In(i), mtype.Name())
+			checker := valueChecker(mtype.In(i), index)
+			if checker == nil {
+				return nil, fmt.Errorf("Argument %d: wrong type %s (%s)", i, mtype.In(i), mtype.Name())
+			}
+			checkers = append(checkers, checker)
 		}
+		index += 1
 	}
 	return checkers, nil
 }
 
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// contextChecker injects the context of the request, see
+// Server.requestContext.
+func contextChecker(request *Request) (reflect.Value, ReplyWriter) {
+	return reflect.ValueOf(request.Context()), nil
+}
+
+// clientChecker injects the connection state of the request. Requests that
+// were not read from a connection (e.g. built by hand and passed to Apply)
+// get a fresh Client.
+func clientChecker(request *Request) (reflect.Value, ReplyWriter) {
+	if request.Client == nil {
+		request.Client = newClient(request.Host)
+	}
+	return reflect.ValueOf(request.Client), nil
+}
+
 func stringChecker(index int) CheckerFn {
 	return func(request *Request) (reflect.Value, ReplyWriter) {
 		v, err := request.GetString(index)
@@ -256,3 +357,149 @@ func intChecker(index int) CheckerFn {
 		return reflect.ValueOf(m), err
 	}
 }
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// argParser returns the function converting an argument to a value of type
+// t, or nil if t is not supported. Durations are given in seconds, possibly
+// fractional, like the timeouts of BLPOP.
+func argParser(t reflect.Type) func(arg []byte) (reflect.Value, ReplyWriter) {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			v := reflect.New(t)
+			if err := v.Interface().(encoding.TextUnmarshaler).UnmarshalText(arg); err != nil {
+				if reply, ok := err.(*ErrorReply); ok {
+					return v.Elem(), reply
+				}
+				return v.Elem(), NewError(err.Error())
+			}
+			return v.Elem(), nil
+		}
+	}
+	switch t {
+	case reflect.TypeOf(""):
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			return reflect.ValueOf(string(arg)), nil
+		}
+	case reflect.TypeOf([]byte{}):
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			return reflect.ValueOf(arg), nil
+		}
+	case reflect.TypeOf(1):
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			i, err := strconv.Atoi(string(arg))
+			if err != nil {
+				return reflect.ValueOf(0), ErrNotInteger
+			}
+			return reflect.ValueOf(i), nil
+		}
+	case reflect.TypeOf(int64(0)):
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			i, err := strconv.ParseInt(string(arg), 10, 64)
+			if err != nil {
+				return reflect.ValueOf(int64(0)), ErrNotInteger
+			}
+			return reflect.ValueOf(i), nil
+		}
+	case reflect.TypeOf(uint64(0)):
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			u, err := strconv.ParseUint(string(arg), 10, 64)
+			if err != nil {
+				return reflect.ValueOf(uint64(0)), ErrNotInteger
+			}
+			return reflect.ValueOf(u), nil
+		}
+	case reflect.TypeOf(float64(0)):
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			f, err := strconv.ParseFloat(string(arg), 64)
+			if err != nil || math.IsNaN(f) {
+				return reflect.ValueOf(float64(0)), ErrNotFloat
+			}
+			return reflect.ValueOf(f), nil
+		}
+	case reflect.TypeOf(false):
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			b, err := strconv.ParseBool(string(arg))
+			if err != nil {
+				return reflect.ValueOf(false), ErrSyntax
+			}
+			return reflect.ValueOf(b), nil
+		}
+	case reflect.TypeOf(time.Duration(0)):
+		return func(arg []byte) (reflect.Value, ReplyWriter) {
+			d, ok := parseSeconds(string(arg))
+			if !ok {
+				return reflect.ValueOf(time.Duration(0)), ErrNotFloat
+			}
+			return reflect.ValueOf(d), nil
+		}
+	}
+	return nil
+}
+
+// parseSeconds parses a duration given in seconds, possibly fractional. It
+// reports false for NaN, infinities and durations out of the range of
+// time.Duration.
+func parseSeconds(arg string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) {
+		return 0, false
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, out of range itself.
+	ns := seconds * float64(time.Second)
+	if ns >= math.MaxInt64 || ns < math.MinInt64 {
+		return 0, false
+	}
+	return time.Duration(ns), true
+}
+
+// valueChecker returns the checker of an argument of type t, or nil if t is
+// not supported: the types argParser supports, pointers to them for
+// optional arguments, nil when absent, and slices of them for the remaining
+// arguments.
+func valueChecker(t reflect.Type, index int) CheckerFn {
+	if parse := argParser(t); parse != nil {
+		return func(request *Request) (reflect.Value, ReplyWriter) {
+			if reply := request.ExpectArgument(index); reply != nil {
+				return reflect.Zero(t), reply
+			}
+			return parse(request.Args[index])
+		}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		parse := argParser(t.Elem())
+		if parse == nil {
+			return nil
+		}
+		return func(request *Request) (reflect.Value, ReplyWriter) {
+			if !request.HasArgument(index) {
+				return reflect.Zero(t), nil
+			}
+			v, reply := parse(request.Args[index])
+			if reply != nil {
+				return reflect.Zero(t), reply
+			}
+			ptr := reflect.New(t.Elem())
+			ptr.Elem().Set(v)
+			return ptr, nil
+		}
+	case reflect.Slice:
+		parse := argParser(t.Elem())
+		if parse == nil {
+			return nil
+		}
+		return func(request *Request) (reflect.Value, ReplyWriter) {
+			values := reflect.MakeSlice(t, 0, len(request.Args))
+			for i := index; i < len(request.Args); i++ {
+				v, reply := parse(request.Args[i])
+				if reply != nil {
+					return reflect.Zero(t), reply
+				}
+				values = reflect.Append(values, v)
+			}
+			return values, nil
+		}
+	}
+	return nil
+}
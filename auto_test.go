@@ -1,7 +1,12 @@
 package redis
 
 import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Hash struct {
@@ -299,3 +304,241 @@ func TestAutoHandler(t *testing.T) {
 		close(c)
 	}
 }
+
+type ClientHandler struct{}
+
+func (h *ClientHandler) SETNAME(client *Client, name string) error {
+	client.Name = name
+	return nil
+}
+
+func (h *ClientHandler) GETNAME(client *Client) (string, error) {
+	return client.Name, nil
+}
+
+func (h *ClientHandler) INCR(client *Client, key string) (int, error) {
+	n, _ := client.Get(key).(int)
+	client.Set(key, n+1)
+	return n + 1, nil
+}
+
+func TestAutoHandlerClient(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Handler(&ClientHandler{}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c1, c2 := newClient("c1"), newClient("c2")
+	if c1.Id == c2.Id {
+		t.Fatalf("Expected distinct client ids, got %d twice", c1.Id)
+	}
+	expected := []struct {
+		client   *Client
+		request  *Request
+		expected string
+	}{
+		{c1, &Request{Name: "SETNAME", Args: b("alice")}, "+OK\r\n"},
+		{c1, &Request{Name: "GETNAME"}, "$5\r\nalice\r\n"},
+		{c2, &Request{Name: "GETNAME"}, "$-1\r\n"},
+		{c1, &Request{Name: "INCR", Args: b("counter")}, ":1\r\n"},
+		{c1, &Request{Name: "INCR", Args: b("counter")}, ":2\r\n"},
+		{c2, &Request{Name: "INCR", Args: b("counter")}, ":1\r\n"},
+		{c1, &Request{Name: "SETNAME"}, "-ERROR Not enough arguments for the command\r\n"},
+	}
+	for _, v := range expected {
+		v.request.Client = v.client
+		reply, err := srv.ApplyString(v.request)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if reply != v.expected {
+			t.Fatalf("Expected %q, got: %q for request %s", v.expected, reply, v.request.Name)
+		}
+	}
+}
+
+type BadClientHandler struct{}
+
+func (h *BadClientHandler) GET(key string, client *Client) ([]byte, error) {
+	return nil, nil
+}
+
+func TestAutoHandlerClientPosition(t *testing.T) {
+	if _, err := NewServer(DefaultConfig().Handler(&BadClientHandler{})); err == nil {
+		t.Fatal("Expected an error when *Client follows a command argument")
+	}
+}
+
+type ContextHandler struct {
+	started chan struct{}
+}
+
+func (h *ContextHandler) WHOAMI(ctx context.Context, client *Client) (string, error) {
+	if ClientFromContext(ctx) != client {
+		return "", NewError("wrong client")
+	}
+	return client.Name, nil
+}
+
+func (h *ContextHandler) DEADLINE(ctx context.Context, key string) (int, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func (h *ContextHandler) WAIT(ctx context.Context) error {
+	close(h.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestAutoHandlerContext(t *testing.T) {
+	h := &ContextHandler{started: make(chan struct{})}
+	srv, err := NewServer(DefaultConfig().Handler(h).CommandTimeout(time.Minute))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c := newClient("c")
+	c.Name = "alice"
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("WHOAMI"), "$5\r\nalice\r\n"},
+		{c, req("DEADLINE", "key"), ":1\r\n"},
+		{c, req("DEADLINE"), "-ERROR Not enough arguments for the command\r\n"},
+	})
+
+	// Shutting down cancels the running commands.
+	replies := make(chan string)
+	go func() {
+		reply, _ := srv.ApplyString(req("WAIT"))
+		replies <- reply
+	}()
+	<-h.started
+	srv.Close()
+	select {
+	case reply := <-replies:
+		if expected := "-ERROR context canceled\r\n"; reply != expected {
+			t.Fatalf("Expected %q, got %q", expected, reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected WAIT to be cancelled")
+	}
+}
+
+type BadContextHandler struct{}
+
+func (h *BadContextHandler) GET(client *Client, ctx context.Context, key string) ([]byte, error) {
+	return nil, nil
+}
+
+func TestAutoHandlerContextPosition(t *testing.T) {
+	if _, err := NewServer(DefaultConfig().Handler(&BadContextHandler{})); err == nil {
+		t.Fatal("Expected an error when context.Context is not the first argument")
+	}
+}
+
+// level is an argument type parsed with UnmarshalText.
+type level int
+
+func (l *level) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "low":
+		*l = 1
+	case "high":
+		*l = 2
+	default:
+		return fmt.Errorf("unknown level '%s'", text)
+	}
+	return nil
+}
+
+type TypesHandler struct{}
+
+func (h *TypesHandler) INTS(a int64, b uint64) (string, error) {
+	return fmt.Sprint(a, " ", b), nil
+}
+
+func (h *TypesHandler) FLOAT(f float64, b bool) (string, error) {
+	return fmt.Sprint(f, " ", b), nil
+}
+
+func (h *TypesHandler) SLEEP(d time.Duration) (string, error) {
+	return d.String(), nil
+}
+
+func (h *TypesHandler) SUM(first int, rest []int) (int, error) {
+	for _, n := range rest {
+		first += n
+	}
+	return first, nil
+}
+
+func (h *TypesHandler) AVG(values []float64) (float64, error) {
+	sum := 0.
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values)), nil
+}
+
+func (h *TypesHandler) OPTIONAL(key string, count *int, big *big.Int) (string, error) {
+	if count == nil {
+		return key + " all", nil
+	}
+	if big == nil {
+		return fmt.Sprint(key, " ", *count), nil
+	}
+	return fmt.Sprint(key, " ", *count, " ", big), nil
+}
+
+func (h *TypesHandler) LEVEL(l level) (int, error) {
+	return int(l), nil
+}
+
+func TestAutoHandlerTypes(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Handler(&TypesHandler{}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{nil, req("INTS", "-9223372036854775808", "18446744073709551615"), "$41\r\n-9223372036854775808 18446744073709551615\r\n"},
+		{nil, req("INTS", "1.5", "1"), "-ERROR value is not an integer or out of range\r\n"},
+		{nil, req("INTS", "1", "-1"), "-ERROR value is not an integer or out of range\r\n"},
+		{nil, req("INTS", "1"), "-ERROR Not enough arguments for the command\r\n"},
+		{nil, req("FLOAT", "1.5", "true"), "$8\r\n1.5 true\r\n"},
+		{nil, req("FLOAT", "-inf", "0"), "$10\r\n-Inf false\r\n"},
+		{nil, req("FLOAT", "x", "1"), "-ERROR value is not a valid float\r\n"},
+		{nil, req("FLOAT", "nan", "1"), "-ERROR value is not a valid float\r\n"},
+		{nil, req("FLOAT", "1", "maybe"), "-ERROR syntax error\r\n"},
+		{nil, req("SLEEP", "0.25"), "$5\r\n250ms\r\n"},
+		{nil, req("SLEEP", "1s"), "-ERROR value is not a valid float\r\n"},
+		{nil, req("SLEEP", "nan"), "-ERROR value is not a valid float\r\n"},
+		{nil, req("SLEEP", "inf"), "-ERROR value is not a valid float\r\n"},
+		{nil, req("SLEEP", "9223372037"), "-ERROR value is not a valid float\r\n"},
+		{nil, req("SLEEP", "-9223372037"), "-ERROR value is not a valid float\r\n"},
+		{nil, req("SLEEP", "9223372036"), "$14\r\n2562047h47m16s\r\n"},
+		{nil, req("SUM", "1"), ":1\r\n"},
+		{nil, req("SUM", "1", "2", "3"), ":6\r\n"},
+		{nil, req("SUM", "1", "2", "x"), "-ERROR value is not an integer or out of range\r\n"},
+		{nil, req("AVG", "1", "2.5"), "$4\r\n1.75\r\n"},
+		{nil, req("AVG", "1", "two"), "-ERROR value is not a valid float\r\n"},
+		{nil, req("OPTIONAL", "k"), "$5\r\nk all\r\n"},
+		{nil, req("OPTIONAL", "k", "2"), "$3\r\nk 2\r\n"},
+		{nil, req("OPTIONAL", "k", "2", "123456789012345678901234567890"), "$34\r\nk 2 123456789012345678901234567890\r\n"},
+		{nil, req("OPTIONAL", "k", "x"), "-ERROR value is not an integer or out of range\r\n"},
+		{nil, req("OPTIONAL", "k", "2", "x"), "-ERROR math/big: cannot unmarshal \"x\" into a *big.Int\r\n"},
+		{nil, req("LEVEL", "HIGH"), ":2\r\n"},
+		{nil, req("LEVEL", "mid"), "-ERROR unknown level 'mid'\r\n"},
+	})
+}
+
+type BadTypeHandler struct{}
+
+func (h *BadTypeHandler) GET(key string, ch chan int) ([]byte, error) {
+	return nil, nil
+}
+
+func TestAutoHandlerUnsupportedType(t *testing.T) {
+	if _, err := NewServer(DefaultConfig().Handler(&BadTypeHandler{})); err == nil {
+		t.Fatal("Expected an error for an unsupported argument type")
+	}
+}
@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"sync"
+	"time"
+)
+
+// Blocker parks clients until the keys they wait for are ready, like BLPOP
+// waits for a list to receive elements. Handlers implementing blocking
+// commands call Block, and the commands making keys ready call Signal:
+//
+//	func (h *QueueHandler) Bpop(client *redis.Client, key string) (redis.ReplyWriter, error) {
+//		return h.blocker.Block(client, []string{key}, 0, func() (redis.ReplyWriter, error) {
+//			return h.pop(key), nil // nil while the queue is empty
+//		})
+//	}
+//
+//	func (h *QueueHandler) Push(key string, job []byte) error {
+//		h.push(key, job)
+//		h.blocker.Signal(key)
+//		return nil
+//	}
+//
+// Such commands must be flagged CmdBlocking, so that they do not hold up
+// transactions while they wait; Block refuses to wait otherwise:
+//
+//	srv.SetCommandSpec("bpop", redis.CommandSpec{Flags: redis.CmdWrite | redis.CmdBlocking, FirstKey: 1, LastKey: 1, Step: 1})
+//
+// The zero value is ready to use, and a Blocker is safe for concurrent use.
+type Blocker struct {
+	mu      sync.Mutex
+	waiters map[string][]*blockedClient
+}
+
+// blockedClient is a client waiting in Block.
+type blockedClient struct {
+	keys []string
+
+	// wake receives a value when one of keys is signaled.
+	wake chan struct{}
+}
+
+// Block calls ready until it returns a reply or an error, waiting for one
+// of keys to be signaled between calls. It gives up after timeout, unless
+// timeout is 0, or when client disconnects, returning a nil reply. It
+// returns ErrServerClosed if the server shuts down meanwhile.
+//
+// Within a transaction, and for requests applied without a client, Block
+// calls ready once and never waits. It returns ErrNotBlocking instead of
+// waiting if the command is not flagged CmdBlocking.
+func (b *Blocker) Block(client *Client, keys []string, timeout time.Duration, ready func() (ReplyWriter, error)) (ReplyWriter, error) {
+	// Queue before calling ready, so that no signal is missed in between.
+	w := b.queue(keys)
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	for {
+		reply, err := ready()
+		if reply != nil || err != nil {
+			// What is left may be for the next client in line.
+			b.unqueue(w, true)
+			return reply, err
+		}
+		if client == nil || client.inExec {
+			b.unqueue(w, false)
+			return nil, nil
+		}
+		if client.txLocked {
+			b.unqueue(w, false)
+			return nil, ErrNotBlocking
+		}
+		relock := client.releaseTx()
+		select {
+		case <-w.wake:
+			relock()
+			continue
+		case <-timeoutChan:
+		case <-client.closed:
+		case <-client.done:
+			err = ErrServerClosed
+		}
+		relock()
+		b.unqueue(w, false)
+		return nil, err
+	}
+}
+
+// Signal tells the clients blocked on keys that they may be ready. The
+// client waiting the longest on a key is woken first; once served, it
+// wakes the next one, and so on until a client finds nothing to take.
+func (b *Blocker) Signal(keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		if waiters := b.waiters[key]; len(waiters) > 0 {
+			select {
+			case waiters[0].wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// signalAll signals every key clients are blocked on.
+func (b *Blocker) signalAll() {
+	b.mu.Lock()
+	keys := make([]string, 0, len(b.waiters))
+	for key := range b.waiters {
+		keys = append(keys, key)
+	}
+	b.mu.Unlock()
+	b.Signal(keys...)
+}
+
+func (b *Blocker) queue(keys []string) *blockedClient {
+	w := &blockedClient{keys: keys, wake: make(chan struct{}, 1)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.waiters == nil {
+		b.waiters = make(map[string][]*blockedClient)
+	}
+	for _, key := range keys {
+		b.waiters[key] = append(b.waiters[key], w)
+	}
+	return w
+}
+
+// unqueue removes w from the queues of its keys, waking the next clients if
+// w was served or was woken without acting on it.
+func (b *Blocker) unqueue(w *blockedClient, served bool) {
+	b.mu.Lock()
+	for _, key := range w.keys {
+		waiters := b.waiters[key]
+		for i, other := range waiters {
+			if other == w {
+				waiters = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(b.waiters, key)
+		} else {
+			b.waiters[key] = waiters
+		}
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-w.wake:
+		served = true
+	default:
+	}
+	if served {
+		b.Signal(w.keys...)
+	}
+}
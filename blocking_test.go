@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// newQueueServer returns a server with PUSH and BPOP commands, BPOP
+// waiting with a Blocker for its queue to receive jobs.
+func newQueueServer(t *testing.T) *Server {
+	srv, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var (
+		mu      sync.Mutex
+		queues  = map[string][][]byte{}
+		blocker Blocker
+	)
+	srv.Register("push", func(r *Request) (ReplyWriter, error) {
+		key := string(r.Args[0])
+		mu.Lock()
+		queues[key] = append(queues[key], r.Args[1:]...)
+		n := len(queues[key])
+		mu.Unlock()
+		blocker.Signal(key)
+		return &IntegerReply{number: n}, nil
+	})
+	srv.Register("bpop", func(r *Request) (ReplyWriter, error) {
+		timeout, err := parseTimeout(string(r.Args[len(r.Args)-1]))
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, len(r.Args)-1)
+		for i, arg := range r.Args[:len(r.Args)-1] {
+			keys[i] = string(arg)
+		}
+		reply, err := blocker.Block(r.Client, keys, timeout, func() (ReplyWriter, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, key := range keys {
+				if len(queues[key]) > 0 {
+					job := queues[key][0]
+					queues[key] = queues[key][1:]
+					return &BulkReply{value: job}, nil
+				}
+			}
+			return nil, nil
+		})
+		if errReply, ok := err.(*ErrorReply); ok {
+			return errReply, nil
+		}
+		if reply == nil && err == nil {
+			return &NullReply{}, nil
+		}
+		return reply, err
+	})
+	srv.SetCommandSpec("push", CommandSpec{Flags: CmdWrite, FirstKey: 1, LastKey: 1, Step: 1})
+	srv.SetCommandSpec("bpop", CommandSpec{Flags: CmdWrite | CmdBlocking, FirstKey: 1, LastKey: -2, Step: 1})
+	return srv
+}
+
+func expectReply(t *testing.T, replies chan string, expected string) {
+	select {
+	case reply := <-replies:
+		if reply != expected {
+			t.Fatalf("Expected %q, got %q", expected, reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected %q, got nothing", expected)
+	}
+}
+
+func TestBlocker(t *testing.T) {
+	srv := newQueueServer(t)
+	c1, c2, c3, other := newClient("c1"), newClient("c2"), newClient("c3"), newClient("other")
+
+	// Clients are served in the order they blocked, one job each.
+	first := blockingApply(srv, c1, req("BPOP", "jobs", "0"))
+	time.Sleep(10 * time.Millisecond)
+	second := blockingApply(srv, c2, req("BPOP", "other", "jobs", "0"))
+	time.Sleep(10 * time.Millisecond)
+	third := blockingApply(srv, c3, req("BPOP", "jobs", "0"))
+	time.Sleep(10 * time.Millisecond)
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("PUSH", "jobs", "a", "b"), ":2\r\n"},
+	})
+	expectReply(t, first, "$1\r\na\r\n")
+	expectReply(t, second, "$1\r\nb\r\n")
+	select {
+	case reply := <-third:
+		t.Fatalf("Expected BPOP to wait, got %q", reply)
+	case <-time.After(20 * time.Millisecond):
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("PUSH", "jobs", "c"), ":1\r\n"},
+	})
+	expectReply(t, third, "$1\r\nc\r\n")
+
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("BPOP", "jobs", "0.01"), "$-1\r\n"},
+		{other, req("MULTI"), "+OK\r\n"},
+		{other, req("BPOP", "jobs", "0"), "+QUEUED\r\n"},
+		{other, req("EXEC"), "*1\r\n$-1\r\n"},
+	})
+
+	// Commands not flagged CmdBlocking hold up transactions: they must
+	// not wait.
+	srv.SetCommandSpec("bpop", CommandSpec{Flags: CmdWrite, FirstKey: 1, LastKey: -2, Step: 1})
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("PUSH", "jobs", "d"), ":1\r\n"},
+		{other, req("BPOP", "jobs", "0"), "$1\r\nd\r\n"},
+		{other, req("BPOP", "jobs", "0"), "-ERROR command not flagged CmdBlocking can not block\r\n"},
+	})
+}
+
+func TestBlockerCancel(t *testing.T) {
+	srv := newQueueServer(t)
+	gone, waiting, other := newClient("gone"), newClient("waiting"), newClient("other")
+	done := make(chan struct{})
+	waiting.done = done
+
+	disconnected := blockingApply(srv, gone, req("BPOP", "jobs", "0"))
+	time.Sleep(10 * time.Millisecond)
+	served := blockingApply(srv, waiting, req("BPOP", "jobs", "0"))
+	time.Sleep(10 * time.Millisecond)
+	gone.close()
+	expectReply(t, disconnected, "$-1\r\n")
+
+	// The job goes to the next client in line.
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("PUSH", "jobs", "a"), ":1\r\n"},
+	})
+	expectReply(t, served, "$1\r\na\r\n")
+
+	closed := blockingApply(srv, waiting, req("BPOP", "jobs", "0"))
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	expectReply(t, closed, ErrServerClosed.Error())
+}
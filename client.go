@@ -0,0 +1,170 @@
+package redis
+
+import (
+	"crypto/tls"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var lastClientId int64
+
+// Client holds the state belonging to a single connection. ServeClient
+// creates one per accepted connection and attaches it to every Request read
+// from it, so handlers can keep connection-scoped data (selected database,
+// authenticated user, client name, ...) between commands.
+//
+// A handler method receives it by declaring a *Client as its first argument.
+type Client struct {
+	Id   int64
+	Addr string
+	Name string
+	Db   int // index of the database selected with SELECT
+
+	// Protocol is the RESP version used for replies: 2 unless the client
+	// switched to 3 with HELLO.
+	Protocol int
+
+	// TLS holds the state of the connection if it uses TLS, nil otherwise.
+	TLS *tls.ConnectionState
+
+	mu     sync.Mutex
+	values map[string]interface{}
+
+	// user is the ACL user the connection authenticated as, nil until
+	// the first command or AUTH.
+	user *User
+
+	// done is closed when the server shuts down, to interrupt blocked
+	// commands. It is nil for clients not served by a Server.
+	done <-chan struct{}
+
+	// closed is closed once the connection is gone, so that handlers can
+	// release what they hold for the client.
+	closed    chan struct{}
+	closeOnce sync.Once
+	conn      io.Closer // nil for clients not served by a Server
+
+	// multi holds the commands queued since MULTI, nil outside of a
+	// transaction. inExec is set while EXEC runs them: blocking commands
+	// must not wait then.
+	multi  *transaction
+	inExec bool
+
+	// txLocked is set while the command of the client holds the server
+	// txMu, because it is not flagged CmdBlocking: it must not block. tx
+	// is the txMu held by a command flagged CmdBlocking, released while it
+	// waits, see releaseTx.
+	txLocked bool
+	tx       *sync.RWMutex
+
+	// afterExec are run once EXEC ran the commands of the transaction,
+	// to serve the clients blocked on the lists they pushed to.
+	afterExec []func()
+
+	// watched are the keys watched with WATCH, and dirty is set once one
+	// of them was modified. Both are guarded by the server watchMu.
+	watched map[watchKey]struct{}
+	dirty   bool
+
+	// subscriptions is the number of channels and patterns the client
+	// subscribed to, as last confirmed by the handler.
+	subscriptions int
+}
+
+func newClient(addr string) *Client {
+	return &Client{
+		Id:       atomic.AddInt64(&lastClientId, 1),
+		Addr:     addr,
+		Protocol: 2,
+		values:   make(map[string]interface{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// close signals that the connection of the client is gone.
+func (c *Client) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// Get returns the value stored under key for this connection, or nil.
+func (c *Client) Get(key string) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// Set stores a value under key for the lifetime of the connection.
+// A nil value removes the key.
+func (c *Client) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	if value == nil {
+		delete(c.values, key)
+		return
+	}
+	c.values[key] = value
+}
+
+// disconnect closes the connection of the client.
+func (c *Client) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.close()
+}
+
+// countSubscriptions keeps track of the number of subscriptions of the
+// client from the (un)subscribe confirmations in reply.
+func (c *Client) countSubscriptions(reply ReplyWriter) {
+	var chans []*ChannelWriter
+	switch reply := reply.(type) {
+	case *ChannelWriter:
+		chans = []*ChannelWriter{reply}
+	case *MultiChannelWriter:
+		chans = reply.Chans
+	}
+	for _, cw := range chans {
+		if len(cw.FirstReply) != 3 {
+			continue
+		}
+		count, ok := cw.FirstReply[2].(int)
+		if !ok {
+			continue
+		}
+		var kind string
+		switch v := cw.FirstReply[0].(type) {
+		case string:
+			kind = v
+		case []byte:
+			kind = string(v)
+		}
+		switch strings.ToLower(kind) {
+		case "subscribe", "psubscribe", "unsubscribe", "punsubscribe":
+			c.subscriptions = count
+		}
+	}
+}
+
+// Username returns the name of the ACL user the connection is
+// authenticated as.
+func (c *Client) Username() string {
+	if c.user == nil {
+		return ""
+	}
+	return c.user.name
+}
+
+// CertificateCN returns the common name of the certificate presented by the
+// client, if it was verified against the server ClientCAs. It returns an
+// empty string for plain connections and unverified certificates.
+func (c *Client) CertificateCN() string {
+	if c.TLS == nil || len(c.TLS.VerifiedChains) == 0 || len(c.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return c.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,259 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Command flags, describing what a command does. They back the ACL
+// categories (@read, @write, @admin, @pubsub, @blocking, @transaction).
+const (
+	CmdReadOnly    = 1 << iota // only reads the keyspace
+	CmdWrite                   // may modify the keyspace
+	CmdAdmin                   // administrative command
+	CmdPubSub                  // publish/subscribe command
+	CmdNoAuth                  // can be run before authenticating
+	CmdBlocking                // may wait for other clients, so never holds up EXEC
+	CmdTransaction             // controls transactions (MULTI, EXEC, WATCH...)
+)
+
+// CommandSpec describes a command to the server, so that it can tell which
+// arguments are keys (to enforce ACL key patterns) and what the command does.
+//
+// Key positions follow the redis COMMAND convention: 1 is the first
+// argument after the command name, a negative LastKey counts from the end
+// (-1 being the last argument) and FirstKey 0 means no key. When set, Keys
+// overrides the positions for commands whose keys depend on their arguments.
+type CommandSpec struct {
+	Flags    int
+	FirstKey int
+	LastKey  int
+	Step     int
+	Keys     func(args [][]byte) []string
+}
+
+// defaultCommandSpec applies to commands without a spec: their first
+// argument, if any, is considered to be a key they write to.
+var defaultCommandSpec = CommandSpec{Flags: CmdWrite, FirstKey: 1, LastKey: 1, Step: 1}
+
+var commandSpecs = map[string]CommandSpec{
+	"get":     {CmdReadOnly, 1, 1, 1, nil},
+	"set":     {CmdWrite, 1, 1, 1, nil},
+	"del":     {CmdWrite, 1, -1, 1, nil},
+	"hget":    {CmdReadOnly, 1, 1, 1, nil},
+	"hset":    {CmdWrite, 1, 1, 1, nil},
+	"hgetall": {CmdReadOnly, 1, 1, 1, nil},
+	"rpush":   {CmdWrite, 1, 1, 1, nil},
+	"lpush":   {CmdWrite, 1, 1, 1, nil},
+	"lrange":  {CmdReadOnly, 1, 1, 1, nil},
+	"lindex":  {CmdReadOnly, 1, 1, 1, nil},
+	"blpop":   {CmdWrite | CmdBlocking, 1, -2, 1, nil},
+	"brpop":   {CmdWrite | CmdBlocking, 1, -2, 1, nil},
+	"move":    {CmdWrite, 1, 1, 1, nil},
+
+	"setex":     {CmdWrite, 1, 1, 1, nil},
+	"psetex":    {CmdWrite, 1, 1, 1, nil},
+	"expire":    {CmdWrite, 1, 1, 1, nil},
+	"pexpire":   {CmdWrite, 1, 1, 1, nil},
+	"expireat":  {CmdWrite, 1, 1, 1, nil},
+	"pexpireat": {CmdWrite, 1, 1, 1, nil},
+	"persist":   {CmdWrite, 1, 1, 1, nil},
+	"ttl":       {CmdReadOnly, 1, 1, 1, nil},
+	"pttl":      {CmdReadOnly, 1, 1, 1, nil},
+
+	"incr":        {CmdWrite, 1, 1, 1, nil},
+	"decr":        {CmdWrite, 1, 1, 1, nil},
+	"incrby":      {CmdWrite, 1, 1, 1, nil},
+	"decrby":      {CmdWrite, 1, 1, 1, nil},
+	"incrbyfloat": {CmdWrite, 1, 1, 1, nil},
+	"append":      {CmdWrite, 1, 1, 1, nil},
+	"strlen":      {CmdReadOnly, 1, 1, 1, nil},
+	"getrange":    {CmdReadOnly, 1, 1, 1, nil},
+	"setrange":    {CmdWrite, 1, 1, 1, nil},
+	"mget":        {CmdReadOnly, 1, -1, 1, nil},
+	"mset":        {CmdWrite, 1, -1, 2, nil},
+	"msetnx":      {CmdWrite, 1, -1, 2, nil},
+	"setnx":       {CmdWrite, 1, 1, 1, nil},
+	"getset":      {CmdWrite, 1, 1, 1, nil},
+	"getdel":      {CmdWrite, 1, 1, 1, nil},
+	"getex":       {CmdWrite, 1, 1, 1, nil},
+
+	"lpop":       {CmdWrite, 1, 1, 1, nil},
+	"rpop":       {CmdWrite, 1, 1, 1, nil},
+	"llen":       {CmdReadOnly, 1, 1, 1, nil},
+	"lset":       {CmdWrite, 1, 1, 1, nil},
+	"lrem":       {CmdWrite, 1, 1, 1, nil},
+	"ltrim":      {CmdWrite, 1, 1, 1, nil},
+	"linsert":    {CmdWrite, 1, 1, 1, nil},
+	"lpos":       {CmdReadOnly, 1, 1, 1, nil},
+	"rpushx":     {CmdWrite, 1, 1, 1, nil},
+	"lpushx":     {CmdWrite, 1, 1, 1, nil},
+	"rpoplpush":  {CmdWrite, 1, 2, 1, nil},
+	"lmove":      {CmdWrite, 1, 2, 1, nil},
+	"blmove":     {CmdWrite | CmdBlocking, 1, 2, 1, nil},
+	"brpoplpush": {CmdWrite | CmdBlocking, 1, 2, 1, nil},
+
+	"hmset":        {CmdWrite, 1, 1, 1, nil},
+	"hsetnx":       {CmdWrite, 1, 1, 1, nil},
+	"hmget":        {CmdReadOnly, 1, 1, 1, nil},
+	"hdel":         {CmdWrite, 1, 1, 1, nil},
+	"hexists":      {CmdReadOnly, 1, 1, 1, nil},
+	"hlen":         {CmdReadOnly, 1, 1, 1, nil},
+	"hstrlen":      {CmdReadOnly, 1, 1, 1, nil},
+	"hkeys":        {CmdReadOnly, 1, 1, 1, nil},
+	"hvals":        {CmdReadOnly, 1, 1, 1, nil},
+	"hincrby":      {CmdWrite, 1, 1, 1, nil},
+	"hincrbyfloat": {CmdWrite, 1, 1, 1, nil},
+	"hrandfield":   {CmdReadOnly, 1, 1, 1, nil},
+	"hscan":        {CmdReadOnly, 1, 1, 1, nil},
+
+	"sadd":        {CmdWrite, 1, 1, 1, nil},
+	"srem":        {CmdWrite, 1, 1, 1, nil},
+	"sismember":   {CmdReadOnly, 1, 1, 1, nil},
+	"smismember":  {CmdReadOnly, 1, 1, 1, nil},
+	"smembers":    {CmdReadOnly, 1, 1, 1, nil},
+	"scard":       {CmdReadOnly, 1, 1, 1, nil},
+	"spop":        {CmdWrite, 1, 1, 1, nil},
+	"srandmember": {CmdReadOnly, 1, 1, 1, nil},
+	"smove":       {CmdWrite, 1, 2, 1, nil},
+	"sinter":      {CmdReadOnly, 1, -1, 1, nil},
+	"sunion":      {CmdReadOnly, 1, -1, 1, nil},
+	"sdiff":       {CmdReadOnly, 1, -1, 1, nil},
+	"sinterstore": {CmdWrite, 1, -1, 1, nil},
+	"sunionstore": {CmdWrite, 1, -1, 1, nil},
+	"sdiffstore":  {CmdWrite, 1, -1, 1, nil},
+	"sintercard":  {CmdReadOnly, 0, 0, 0, numkeysKeys},
+	"sscan":       {CmdReadOnly, 1, 1, 1, nil},
+
+	"zadd":             {CmdWrite, 1, 1, 1, nil},
+	"zincrby":          {CmdWrite, 1, 1, 1, nil},
+	"zrem":             {CmdWrite, 1, 1, 1, nil},
+	"zscore":           {CmdReadOnly, 1, 1, 1, nil},
+	"zcard":            {CmdReadOnly, 1, 1, 1, nil},
+	"zcount":           {CmdReadOnly, 1, 1, 1, nil},
+	"zrank":            {CmdReadOnly, 1, 1, 1, nil},
+	"zrevrank":         {CmdReadOnly, 1, 1, 1, nil},
+	"zrange":           {CmdReadOnly, 1, 1, 1, nil},
+	"zrangebyscore":    {CmdReadOnly, 1, 1, 1, nil},
+	"zremrangebyscore": {CmdWrite, 1, 1, 1, nil},
+	"zremrangebylex":   {CmdWrite, 1, 1, 1, nil},
+	"zremrangebyrank":  {CmdWrite, 1, 1, 1, nil},
+	"zpopmin":          {CmdWrite, 1, 1, 1, nil},
+	"zpopmax":          {CmdWrite, 1, 1, 1, nil},
+	"bzpopmin":         {CmdWrite | CmdBlocking, 1, -2, 1, nil},
+	"bzpopmax":         {CmdWrite | CmdBlocking, 1, -2, 1, nil},
+	"zunionstore":      {CmdWrite, 0, 0, 0, storeNumkeysKeys},
+	"zscan":            {CmdReadOnly, 1, 1, 1, nil},
+	"zinterstore":      {CmdWrite, 0, 0, 0, storeNumkeysKeys},
+
+	"exists":   {CmdReadOnly, 1, -1, 1, nil},
+	"touch":    {CmdReadOnly, 1, -1, 1, nil},
+	"type":     {CmdReadOnly, 1, 1, 1, nil},
+	"unlink":   {CmdWrite, 1, -1, 1, nil},
+	"rename":   {CmdWrite, 1, 2, 1, nil},
+	"renamenx": {CmdWrite, 1, 2, 1, nil},
+	"copy":     {CmdWrite, 1, 2, 1, nil},
+	"keys":     {CmdReadOnly, 0, 0, 0, nil},
+	"scan":     {CmdReadOnly, 0, 0, 0, nil},
+
+	"ping":      {0, 0, 0, 0, nil},
+	"select":    {0, 0, 0, 0, nil},
+	"dbsize":    {CmdReadOnly, 0, 0, 0, nil},
+	"swapdb":    {CmdWrite, 0, 0, 0, nil},
+	"flushdb":   {CmdWrite, 0, 0, 0, nil},
+	"flushall":  {CmdWrite, 0, 0, 0, nil},
+	"subscribe": {CmdPubSub, 0, 0, 0, nil},
+	"publish":   {CmdPubSub | CmdBlocking, 0, 0, 0, nil}, // waits for SlowConsumerBlock subscribers
+	"monitor":   {CmdAdmin, 0, 0, 0, nil},
+	"auth":      {CmdNoAuth, 0, 0, 0, nil},
+	"acl":       {CmdAdmin, 0, 0, 0, nil},
+	"hello":     {CmdNoAuth, 0, 0, 0, nil},
+
+	"multi":   {CmdTransaction, 0, 0, 0, nil},
+	"exec":    {CmdTransaction, 0, 0, 0, nil},
+	"discard": {CmdTransaction, 0, 0, 0, nil},
+	"watch":   {CmdTransaction, 1, -1, 1, nil},
+	"unwatch": {CmdTransaction, 0, 0, 0, nil},
+
+	"psubscribe":   {CmdPubSub, 0, 0, 0, nil},
+	"unsubscribe":  {CmdPubSub, 0, 0, 0, nil},
+	"punsubscribe": {CmdPubSub, 0, 0, 0, nil},
+	"pubsub":       {CmdPubSub, 0, 0, 0, nil},
+}
+
+// numkeysKeys returns the keys of commands taking a number of keys followed
+// by the keys, such as SINTERCARD.
+func numkeysKeys(args [][]byte) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	n, err := strconv.Atoi(string(args[0]))
+	if err != nil || n <= 0 || n >= len(args) {
+		return nil
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	return keys
+}
+
+// storeNumkeysKeys returns the keys of commands taking a destination
+// followed by numkeys style keys, such as ZUNIONSTORE.
+func storeNumkeysKeys(args [][]byte) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	return append([]string{string(args[0])}, numkeysKeys(args[1:])...)
+}
+
+// SetCommandSpec describes the command name, typically one registered with
+// Register or provided by a custom handler.
+func (srv *Server) SetCommandSpec(name string, spec CommandSpec) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.specs == nil {
+		srv.specs = make(map[string]CommandSpec)
+	}
+	srv.specs[strings.ToLower(name)] = spec
+}
+
+func (srv *Server) commandSpec(name string) CommandSpec {
+	name = strings.ToLower(name)
+	srv.mu.Lock()
+	spec, exists := srv.specs[name]
+	srv.mu.Unlock()
+	if exists {
+		return spec
+	}
+	if spec, exists := commandSpecs[name]; exists {
+		return spec
+	}
+	return defaultCommandSpec
+}
+
+// keys returns the keys among args according to the spec.
+func (spec CommandSpec) keys(args [][]byte) []string {
+	if spec.Keys != nil {
+		return spec.Keys(args)
+	}
+	if spec.FirstKey <= 0 || spec.FirstKey > len(args) {
+		return nil
+	}
+	last := spec.LastKey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	if last > len(args) {
+		last = len(args)
+	}
+	step := spec.Step
+	if step <= 0 {
+		step = 1
+	}
+	var keys []string
+	for i := spec.FirstKey; i <= last; i += step {
+		keys = append(keys, string(args[i-1]))
+	}
+	return keys
+}
@@ -1,10 +1,23 @@
 package redis
 
+import (
+	"crypto/tls"
+	"time"
+)
+
 type Config struct {
-	proto   string
-	host    string
-	port    int
-	handler interface{}
+	proto     string
+	host      string
+	port      int
+	handler   interface{}
+	tlsConfig *tls.Config
+	users     []userConfig
+	timeout   time.Duration
+}
+
+type userConfig struct {
+	name  string
+	rules []string
 }
 
 func DefaultConfig() *Config {
@@ -35,3 +48,34 @@ func (c *Config) Handler(h interface{}) *Config {
 	c.handler = h
 	return c
 }
+
+// TLS makes the server only accept TLS connections, configured by t. Set
+// t.ClientAuth to tls.RequireAndVerifyClientCert and t.ClientCAs to enable
+// mutual TLS.
+func (c *Config) TLS(t *tls.Config) *Config {
+	c.tlsConfig = t
+	return c
+}
+
+// CommandTimeout sets a deadline to the context of each command, d after it
+// started. Handlers are expected to give up once it expires, the server does
+// not interrupt them. There is no deadline if d is 0, the default.
+func (c *Config) CommandTimeout(d time.Duration) *Config {
+	c.timeout = d
+	return c
+}
+
+// User creates or changes the ACL user name with the given rules, as
+// ACL SETUSER does. Rules are applied in order, for instance:
+//
+//	DefaultConfig().User("default", "off").User("app", "on", ">secret", "~app:*", "+@all")
+func (c *Config) User(name string, rules ...string) *Config {
+	c.users = append(c.users, userConfig{name: name, rules: rules})
+	return c
+}
+
+// RequirePass requires clients to AUTH with password before running any
+// command, like the redis requirepass directive.
+func (c *Config) RequirePass(password string) *Config {
+	return c.User(defaultUser, "resetpass", ">"+password)
+}
@@ -0,0 +1,488 @@
+package redis
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dbShardCount is the number of partitions of a Database keyspace. Each
+// shard has its own lock, so commands on unrelated keys do not contend.
+const dbShardCount = 32
+
+var lastDatabaseId uint64
+
+type (
+	HashValue   map[string][]byte
+	HashHash    map[string]HashValue
+	HashSub     map[string][]*ChannelWriter
+	HashBrStack map[string]*Stack
+	SetValue    map[string]struct{}
+)
+
+// value is what a key holds. A key holds a single type of value, so that
+// deleting it deletes its expiration too.
+type value struct {
+	kind    string      // the type of data, as replied by TYPE
+	data    interface{} // []byte, *Stack, HashValue, SetValue or *SortedSet
+	expires time.Time   // zero unless the key has an expiration
+
+	// scan holds the members of a set, hash or sorted set sorted by hash
+	// while SSCAN, HSCAN or ZSCAN iterate over them, see scanMembers.
+	scan []hashedName
+}
+
+type dbShard struct {
+	sync.RWMutex
+	// order gives every shard of every database a distinct rank, used to
+	// lock several shards without deadlocking.
+	order uint64
+
+	keys map[string]*value
+	// volatile indexes the keys with an expiration, for the sweeper.
+	volatile map[string]struct{}
+}
+
+type Database struct {
+	children map[int]*Database
+	parent   *Database
+
+	shards [dbShardCount]*dbShard
+	clock  Clock // time source for expirations, the system clock if nil
+
+	sweepMu sync.Mutex
+	sweeper *time.Timer
+	closed  bool
+
+	// waiters are the clients blocked on keys of the database. SWAPDB
+	// exchanges them along with the databases, with every shard locked, so
+	// reading it requires a shard to be locked.
+	waiters *dbWaiters
+}
+
+// dbWaiters are the clients blocked on keys of a database. Clients wait on
+// a database index rather than on a Database: SWAPDB hands them over to
+// the database taking the index.
+type dbWaiters struct {
+	// blocked are the clients waiting for a sorted set, as with BZPOPMIN.
+	blocked Blocker
+
+	// lists are the clients blocked on lists, in the order they started
+	// waiting. Pushes hand them elements directly.
+	mu    sync.Mutex
+	lists map[string][]*listWaiter
+}
+
+func NewDatabase(parent *Database) *Database {
+	db := &Database{
+		children: map[int]*Database{},
+		parent:   parent,
+		waiters:  &dbWaiters{},
+	}
+	id := atomic.AddUint64(&lastDatabaseId, 1)
+	for i := range db.shards {
+		db.shards[i] = &dbShard{
+			order:    id*dbShardCount + uint64(i),
+			keys:     make(map[string]*value),
+			volatile: make(map[string]struct{}),
+		}
+	}
+	db.children[0] = db
+	return db
+}
+
+// keyHash returns the FNV-1a hash of key, inlined to avoid allocating a
+// hash.Hash per lookup.
+func keyHash(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// shard returns the shard owning key.
+func (db *Database) shard(key string) *dbShard {
+	return db.shards[keyHash(key)%dbShardCount]
+}
+
+// lock write-locks the shards owning keys and returns the function releasing them.
+func (db *Database) lock(keys ...string) func() {
+	return lockShards(false, db.shardsOf(keys)...)
+}
+
+// rlock read-locks the shards owning keys and returns the function releasing them.
+func (db *Database) rlock(keys ...string) func() {
+	return lockShards(true, db.shardsOf(keys)...)
+}
+
+func (db *Database) shardsOf(keys []string) []*dbShard {
+	shards := make([]*dbShard, 0, len(keys))
+	for _, key := range keys {
+		shards = append(shards, db.shard(key))
+	}
+	return shards
+}
+
+// lockShards locks each distinct shard once, always in the same order, so
+// that concurrent multi-key commands cannot deadlock.
+func lockShards(read bool, shards ...*dbShard) func() {
+	sort.Slice(shards, func(i, j int) bool { return shards[i].order < shards[j].order })
+	locked := shards[:0]
+	for i, s := range shards {
+		if i > 0 && s == shards[i-1] {
+			continue
+		}
+		if read {
+			s.RLock()
+		} else {
+			s.Lock()
+		}
+		locked = append(locked, s)
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			if read {
+				locked[i].RUnlock()
+			} else {
+				locked[i].Unlock()
+			}
+		}
+	}
+}
+
+// lookup returns the data stored at key if it is of type kind, nil
+// otherwise. When create is set, a missing key is set to the data returned
+// by newData.
+// The shard owning key must be locked.
+// Creating requires the shard to be write-locked.
+func (db *Database) lookup(key, kind string, create bool, newData func() interface{}) interface{} {
+	if create {
+		db.removeIfExpired(key)
+	} else if db.expired(key) {
+		return nil
+	}
+	s := db.shard(key)
+	v, exists := s.keys[key]
+	if !exists && create {
+		v = &value{kind: kind, data: newData()}
+		s.keys[key] = v
+	}
+	if v == nil || v.kind != kind {
+		return nil
+	}
+	return v.data
+}
+
+// stack returns the list stored at key, creating it when create is set.
+// The shard owning key must be locked.
+// Creating requires the shard to be write-locked; the caller must remove
+// the list once it is empty.
+func (db *Database) stack(key string, create bool) *Stack {
+	st, _ := db.lookup(key, typeList, create, func() interface{} { return NewStack(key) }).(*Stack)
+	return st
+}
+
+// str returns the string stored at key, and whether it exists.
+// The shard owning key must be locked.
+func (db *Database) str(key string) ([]byte, bool) {
+	v, exists := db.lookup(key, typeString, false, nil).([]byte)
+	return v, exists
+}
+
+// setString sets key to the string v, keeping its expiration. key must
+// not hold another type of value.
+// The shard owning key must be write-locked.
+func (db *Database) setString(key string, v []byte) {
+	s := db.shard(key)
+	if old, exists := s.keys[key]; exists {
+		old.data = v
+		return
+	}
+	s.keys[key] = &value{kind: typeString, data: v}
+}
+
+// Types of the values stored at keys, as replied by TYPE. Each key holds a
+// single type of value.
+const (
+	typeNone   = "none"
+	typeString = "string"
+	typeList   = "list"
+	typeHash   = "hash"
+	typeSet    = "set"
+	typeZSet   = "zset"
+)
+
+// keyType returns the type of the value stored at key.
+// The shard owning key must be locked.
+func (db *Database) keyType(key string) string {
+	v, exists := db.shard(key).keys[key]
+	if !exists || db.expired(key) {
+		return typeNone
+	}
+	return v.kind
+}
+
+// checkType returns ErrWrongType if one of keys holds a value of another
+// type than t. Missing keys are of any type.
+// The shards owning keys must be locked.
+func (db *Database) checkType(t string, keys ...string) error {
+	for _, key := range keys {
+		if kt := db.keyType(key); kt != typeNone && kt != t {
+			return ErrWrongType
+		}
+	}
+	return nil
+}
+
+// exists reports whether key holds a value of any type.
+// The shard owning key must be locked.
+func (db *Database) exists(key string) bool {
+	return db.keyType(key) != typeNone
+}
+
+// value returns the value stored at key whatever its type: []byte, *Stack,
+// HashValue, SetValue or *SortedSet. It returns nil if key does not exist.
+// The shard owning key must be locked.
+func (db *Database) value(key string) interface{} {
+	if db.keyType(key) == typeNone {
+		return nil
+	}
+	return db.shard(key).keys[key].data
+}
+
+// store stores v, as returned by value, at key. It replaces the previous
+// value of key whatever its type, but keeps its expiration. The clients
+// blocked on a list stored are left to the caller, see
+// DefaultHandler.handOff.
+// The shard owning key must be write-locked.
+func (db *Database) store(key string, v interface{}) {
+	s := db.shard(key)
+	stored := &value{data: v}
+	if old, exists := s.keys[key]; exists {
+		stored.expires = old.expires
+	}
+	s.keys[key] = stored
+	switch v.(type) {
+	case []byte:
+		stored.kind = typeString
+	case *Stack:
+		stored.kind = typeList
+	case HashValue:
+		stored.kind = typeHash
+	case SetValue:
+		stored.kind = typeSet
+	case *SortedSet:
+		stored.kind = typeZSet
+		db.waiters.blocked.Signal(key)
+	}
+}
+
+// copyValue returns a copy of v, as returned by value, that can be modified
+// independently.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *Stack:
+		// Elements are never modified in place: share them.
+		return &Stack{stack: v.Range(0, -1)}
+	case HashValue:
+		ret := make(HashValue, len(v))
+		for field, value := range v {
+			ret[field] = value
+		}
+		return ret
+	case SetValue:
+		ret := make(SetValue, len(v))
+		for m := range v {
+			ret[m] = struct{}{}
+		}
+		return ret
+	case *SortedSet:
+		ret := NewSortedSet()
+		for m, score := range v.scores {
+			ret.Add(m, score)
+		}
+		return ret
+	}
+	// Strings are never modified in place either.
+	return v
+}
+
+// set returns the set stored at key, creating it when create is set.
+// Creating requires the shard to be write-locked; the caller must remove
+// the set once it is empty.
+func (db *Database) set(key string, create bool) SetValue {
+	v, _ := db.lookup(key, typeSet, create, func() interface{} { return make(SetValue) }).(SetValue)
+	return v
+}
+
+// hash returns the hash stored at key, creating it when create is set.
+// Creating requires the shard to be write-locked; the caller must remove
+// the hash once it is empty.
+func (db *Database) hash(key string, create bool) HashValue {
+	v, _ := db.lookup(key, typeHash, create, func() interface{} { return make(HashValue) }).(HashValue)
+	return v
+}
+
+// zset returns the sorted set stored at key, creating it when create is set.
+// Creating requires the shard to be write-locked; the caller must remove
+// the sorted set once it is empty.
+func (db *Database) zset(key string, create bool) *SortedSet {
+	v, _ := db.lookup(key, typeZSet, create, func() interface{} { return NewSortedSet() }).(*SortedSet)
+	return v
+}
+
+// listWaiter is a client blocked until one of keys holds a non empty list,
+// as with BLPOP. Pushes hand it the popped element directly.
+type listWaiter struct {
+	keys  []string
+	front bool // pop the head of the list, the tail otherwise
+
+	// move is set for BLMOVE, which moves the element itself: it is
+	// woken with a nil element, which is left in the list for it.
+	move bool
+
+	// served receives the key and the element handed to the client.
+	served chan [2][]byte
+
+	// waiters holds the queues the client waits in.
+	waiters *dbWaiters
+}
+
+// queueListWaiter queues a client waiting for elements on the lists at
+// keys, after the clients already waiting on them. The shards owning keys
+// must be locked while checking the lists and queueing, so that no push is
+// missed in between.
+func (db *Database) queueListWaiter(keys []string, front, move bool) *listWaiter {
+	q := db.waiters
+	w := &listWaiter{keys: keys, front: front, move: move, served: make(chan [2][]byte, 1), waiters: q}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.lists == nil {
+		q.lists = make(map[string][]*listWaiter)
+	}
+	for _, key := range keys {
+		q.lists[key] = append(q.lists[key], w)
+	}
+	return w
+}
+
+// unqueue removes w from the queues. It returns false if w was served
+// meanwhile, in which case served holds the element.
+func (w *listWaiter) unqueue() bool {
+	w.waiters.mu.Lock()
+	defer w.waiters.mu.Unlock()
+	return w.waiters.unqueueLocked(w)
+}
+
+func (q *dbWaiters) unqueueLocked(w *listWaiter) bool {
+	queued := false
+	for _, key := range w.keys {
+		queue := q.lists[key]
+		for i, other := range queue {
+			if other == w {
+				queued = true
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(q.lists, key)
+		} else {
+			q.lists[key] = queue
+		}
+	}
+	return queued
+}
+
+// handOff pops the elements of the list at key for the clients blocked on
+// it, longest waiting first.
+// The shard owning key must be write-locked.
+func (db *Database) handOff(key string) {
+	q := db.waiters
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := db.stack(key, false)
+	if st == nil {
+		return
+	}
+	// Elements left for the clients moving them are not handed again.
+	available := st.Len()
+	for len(q.lists[key]) > 0 && available > 0 {
+		w := q.lists[key][0]
+		q.unqueueLocked(w)
+		available--
+		if w.move {
+			w.served <- [2][]byte{[]byte(key), nil}
+			continue
+		}
+		var v []byte
+		if w.front {
+			v = st.PopFront()
+		} else {
+			v = st.PopBack()
+		}
+		w.served <- [2][]byte{[]byte(key), v}
+	}
+	if st.Len() == 0 {
+		db.remove(key)
+	}
+}
+
+// wakeWaiters serves the clients blocked on keys that are ready, once
+// SWAPDB handed them to db.
+// Every shard of db must be write-locked.
+func (db *Database) wakeWaiters() {
+	q := db.waiters
+	q.mu.Lock()
+	keys := make([]string, 0, len(q.lists))
+	for key := range q.lists {
+		keys = append(keys, key)
+	}
+	q.mu.Unlock()
+	for _, key := range keys {
+		db.handOff(key)
+	}
+	q.blocked.signalAll()
+}
+
+// flush removes every key. The keyspace is cleared in place, so that the
+// clients blocked on keys keep waiting on this database.
+func (db *Database) flush() {
+	shards := append([]*dbShard(nil), db.shards[:]...)
+	defer lockShards(false, shards...)()
+	for _, s := range db.shards {
+		s.keys = make(map[string]*value)
+		s.volatile = make(map[string]struct{})
+	}
+}
+
+// forEachKey calls fn with every key holding a value and its type. It
+// locks one shard at a time, so fn must not lock the database.
+func (db *Database) forEachKey(fn func(key, t string)) {
+	for i := range db.shards {
+		db.forEachKeyIn(i, fn)
+	}
+}
+
+// forEachKeyIn calls fn with every key of the shard at index i, like
+// forEachKey.
+func (db *Database) forEachKeyIn(i int, fn func(key, t string)) {
+	s := db.shards[i]
+	s.RLock()
+	defer s.RUnlock()
+	for key, v := range s.keys {
+		if !db.expired(key) {
+			fn(key, v.kind)
+		}
+	}
+}
+
+// size returns the number of keys holding a value.
+func (db *Database) size() int {
+	count := 0
+	db.forEachKey(func(string, string) { count++ })
+	return count
+}
@@ -1,362 +1,3221 @@
 package redis
 
 import (
+	"container/heap"
 	"fmt"
-	"reflect"
+	"math"
+	"math/rand"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-type (
-	HashValue   map[string][]byte
-	HashHash    map[string]HashValue
-	HashSub     map[string][]*ChannelWriter
-	HashBrStack map[string]*Stack
+// DefaultHandler implements the redis commands on top of in-memory
+// databases. The database a command operates on is the one selected by the
+// calling connection (see Select), so every command takes the *Client first.
+//
+// It is safe for use by concurrent clients: the databases map and the pub/sub
+// registry have their own locks, and each Database locks its keys by shard.
+type DefaultHandler struct {
+	// Clock is the time source for key expirations, the system clock if
+	// nil. It must be set before the handler is used.
+	Clock Clock
+
+	mu  sync.RWMutex
+	dbs map[int]*Database
+
+	// Databases is the number of databases clients may select,
+	// DefaultDatabases if not positive. It must be set before the handler
+	// is used.
+	Databases int
+
+	// SubscriberBuffer is the number of messages buffered for each
+	// subscriber, DefaultSubscriberBuffer if not positive. SlowConsumers
+	// tells what happens to the messages published to subscribers whose
+	// buffer is full. They must be set before the handler is used.
+	SubscriberBuffer int
+	SlowConsumers    SlowConsumerPolicy
+
+	// PubSubStats counts the messages lost by slow subscribers.
+	PubSubStats PubSubStats
+
+	pubsub pubsub
+}
+
+// db returns the database currently selected by client, creating it if needed.
+func (h *DefaultHandler) db(client *Client) *Database {
+	return h.dbAt(client.Db)
+}
+
+func (h *DefaultHandler) dbAt(index int) *Database {
+	h.mu.RLock()
+	db, exists := h.dbs[index]
+	h.mu.RUnlock()
+	if exists {
+		return db
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.dbs == nil {
+		h.dbs = map[int]*Database{}
+	}
+	if db, exists = h.dbs[index]; !exists {
+		db = h.newDatabase()
+		h.dbs[index] = db
+	}
+	return db
+}
+
+// lockDb write-locks the shards owning keys in the database selected by
+// client, and returns the database along with the function releasing them.
+// SWAPDB locks every shard of the databases it exchanges, so the database
+// stays at the index of the client until then, as blocking commands need.
+func (h *DefaultHandler) lockDb(client *Client, keys ...string) (*Database, func()) {
+	for {
+		db := h.db(client)
+		unlock := db.lock(keys...)
+		if h.db(client) == db {
+			return db, unlock
+		}
+		unlock()
+	}
+}
+
+// handOff serves the clients blocked on the list at key in db, once the
+// transaction of client is over if it runs one: the commands of a
+// transaction see the elements pushed before them.
+// The shard owning key must be write-locked.
+func (h *DefaultHandler) handOff(client *Client, db *Database, key string) {
+	if client == nil || !client.inExec {
+		db.handOff(key)
+		return
+	}
+	client.afterExec = append(client.afterExec, func() {
+		defer db.lock(key)()
+		db.handOff(key)
+	})
+}
+
+func (h *DefaultHandler) newDatabase() *Database {
+	db := NewDatabase(nil)
+	db.clock = h.Clock
+	return db
+}
+
+// DefaultDatabases is the number of databases of a DefaultHandler unless
+// its Databases field says otherwise.
+const DefaultDatabases = 16
+
+// parseDbIndex returns the database index of SELECT, SWAPDB, MOVE and COPY.
+func (h *DefaultHandler) parseDbIndex(index string) (int, error) {
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return -1, ErrInvalidDbIndex
+	}
+	databases := h.Databases
+	if databases <= 0 {
+		databases = DefaultDatabases
+	}
+	if i < 0 || i >= databases {
+		return -1, ErrDbIndexOutOfRange
+	}
+	return i, nil
+}
+
+func (h *DefaultHandler) Rpush(client *Client, key string, value []byte, values ...[]byte) (int, error) {
+	values = append([][]byte{value}, values...)
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return 0, err
+	}
+	s := db.stack(key, true)
+	for _, value := range values {
+		s.PushBack(value)
+	}
+	// The length is replied before the waiting clients are served, as
+	// redis does.
+	n := s.Len()
+	h.handOff(client, db, key)
+	return n, nil
+}
+
+// bpop pops an element from the first non empty list at keys, from its
+// head if front is set, waiting up to timeout (forever if 0) for one of them
+// to receive elements. Clients waiting on the same key are served in the
+// order they started waiting.
+func (h *DefaultHandler) bpop(client *Client, keys []string, timeout string, front bool) ([2][]byte, bool, error) {
+	d, err := parseTimeout(timeout)
+	if err != nil {
+		return [2][]byte{}, false, err
+	}
+	db, unlock := h.lockDb(client, keys...)
+	if err := db.checkType(typeList, keys...); err != nil {
+		unlock()
+		return [2][]byte{}, false, err
+	}
+	for _, key := range keys {
+		if s := db.stack(key, false); s != nil && s.Len() > 0 {
+			var v []byte
+			if front {
+				v = s.PopFront()
+			} else {
+				v = s.PopBack()
+			}
+			if s.Len() == 0 {
+				db.remove(key)
+			}
+			unlock()
+			return [2][]byte{[]byte(key), v}, true, nil
+		}
+	}
+	if client.inExec {
+		unlock()
+		return [2][]byte{}, false, nil
+	}
+	w := db.queueListWaiter(keys, front, false)
+	unlock()
+
+	var timeoutChan <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+	defer client.releaseTx()()
+	select {
+	case popped := <-w.served:
+		return popped, true, nil
+	case <-timeoutChan:
+	case <-client.closed:
+	case <-client.done:
+		err = ErrServerClosed
+	}
+	if !w.unqueue() {
+		// Served meanwhile: the element was already popped for us.
+		return <-w.served, true, nil
+	}
+	return [2][]byte{}, false, err
+}
+
+// bpopArgs pops for BLPOP and BRPOP, whose last argument is the timeout.
+// It replies with a null array if the timeout expires.
+func (h *DefaultHandler) bpopArgs(client *Client, args []string, front bool) (ReplyWriter, error) {
+	if len(args) < 2 {
+		return nil, ErrWrongArgsNumber
+	}
+	popped, ok, err := h.bpop(client, args[:len(args)-1], args[len(args)-1], front)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return NewNullArrayReply(), nil
+	}
+	return &MultiBulkReply{values: []interface{}{popped[0], popped[1]}}, nil
+}
+
+func (h *DefaultHandler) Brpop(client *Client, key string, keys ...string) (ReplyWriter, error) {
+	return h.bpopArgs(client, append([]string{key}, keys...), false)
+}
+
+func (h *DefaultHandler) Lrange(client *Client, key string, start, stop int) ([][]byte, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return nil, err
+	}
+	s := db.stack(key, false)
+	if s == nil {
+		return nil, nil
+	}
+	return s.Range(start, stop), nil
+}
+
+func (h *DefaultHandler) Lindex(client *Client, key string, index int) ([]byte, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return nil, err
+	}
+	s := db.stack(key, false)
+	if s == nil {
+		return nil, nil
+	}
+	return s.GetIndex(index), nil
+}
+
+func (h *DefaultHandler) Lpush(client *Client, key string, value []byte, values ...[]byte) (int, error) {
+	values = append([][]byte{value}, values...)
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return 0, err
+	}
+	s := db.stack(key, true)
+	for _, value := range values {
+		s.PushFront(value)
+	}
+	n := s.Len()
+	h.handOff(client, db, key)
+	return n, nil
+}
+
+func (h *DefaultHandler) Blpop(client *Client, key string, keys ...string) (ReplyWriter, error) {
+	return h.bpopArgs(client, append([]string{key}, keys...), true)
+}
+
+// popCount pops elements from the head (or tail) of the list at key, like
+// LPOP and RPOP. Without count it replies with a single element.
+func (h *DefaultHandler) popCount(client *Client, key string, count []string, front bool) (ReplyWriter, error) {
+	n := 1
+	if len(count) > 1 {
+		return nil, ErrSyntax
+	}
+	if len(count) == 1 {
+		var err error
+		if n, err = strconv.Atoi(count[0]); err != nil || n < 0 {
+			return nil, NewError("value is out of range, must be positive")
+		}
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return nil, err
+	}
+	s := db.stack(key, false)
+	if s == nil || s.Len() == 0 {
+		if len(count) == 0 {
+			return &BulkReply{}, nil
+		}
+		return NewNullArrayReply(), nil
+	}
+	values := []interface{}{}
+	for i := 0; i < n && s.Len() > 0; i++ {
+		if front {
+			values = append(values, s.PopFront())
+		} else {
+			values = append(values, s.PopBack())
+		}
+	}
+	if s.Len() == 0 {
+		db.remove(key)
+	}
+	if len(count) == 0 {
+		return &BulkReply{value: values[0].([]byte)}, nil
+	}
+	return &MultiBulkReply{values: values}, nil
+}
+
+func (h *DefaultHandler) Lpop(client *Client, key string, count ...string) (ReplyWriter, error) {
+	return h.popCount(client, key, count, true)
+}
+
+func (h *DefaultHandler) Rpop(client *Client, key string, count ...string) (ReplyWriter, error) {
+	return h.popCount(client, key, count, false)
+}
+
+func (h *DefaultHandler) Llen(client *Client, key string) (int, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return 0, err
+	}
+	if s := db.stack(key, false); s != nil {
+		return s.Len(), nil
+	}
+	return 0, nil
+}
+
+func (h *DefaultHandler) Lset(client *Client, key string, index int, value []byte) error {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return err
+	}
+	s := db.stack(key, false)
+	if s == nil || s.Len() == 0 {
+		return ErrNoSuchKey
+	}
+	if !s.SetIndex(index, value) {
+		return ErrIndexOutOfRange
+	}
+	return nil
+}
+
+// Lrem removes count occurrences of value from the list at key, see
+// Stack.Remove.
+func (h *DefaultHandler) Lrem(client *Client, key string, count int, value []byte) (int, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return 0, err
+	}
+	s := db.stack(key, false)
+	if s == nil {
+		return 0, nil
+	}
+	removed := s.Remove(count, value)
+	if s.Len() == 0 {
+		db.remove(key)
+	}
+	return removed, nil
+}
+
+func (h *DefaultHandler) Ltrim(client *Client, key string, start, stop int) error {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return err
+	}
+	if s := db.stack(key, false); s != nil {
+		s.Trim(start, stop)
+		if s.Len() == 0 {
+			db.remove(key)
+		}
+	}
+	return nil
+}
+
+// Linsert inserts value before or after pivot. It returns the length of the
+// list, 0 if it does not exist and -1 if pivot was not found.
+func (h *DefaultHandler) Linsert(client *Client, key, where string, pivot, value []byte) (int, error) {
+	var before bool
+	switch strings.ToUpper(where) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+	default:
+		return 0, ErrSyntax
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return 0, err
+	}
+	s := db.stack(key, false)
+	if s == nil || s.Len() == 0 {
+		return 0, nil
+	}
+	return s.Insert(pivot, value, before), nil
+}
+
+// Lpos returns the index of element in the list at key. It accepts the RANK,
+// COUNT and MAXLEN options, see Stack.Positions. With COUNT it replies with
+// a list of indexes.
+func (h *DefaultHandler) Lpos(client *Client, key string, element []byte, options ...string) (ReplyWriter, error) {
+	rank, count, maxlen := 1, -1, 0
+	for i := 0; i < len(options); i += 2 {
+		if i+1 == len(options) {
+			return nil, ErrSyntax
+		}
+		n, err := strconv.Atoi(options[i+1])
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		switch strings.ToUpper(options[i]) {
+		case "RANK":
+			if n == 0 {
+				return nil, NewError("RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return nil, NewError("COUNT can't be negative")
+			}
+			count = n
+		case "MAXLEN":
+			if n < 0 {
+				return nil, NewError("MAXLEN can't be negative")
+			}
+			maxlen = n
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return nil, err
+	}
+	var positions []int
+	if s := db.stack(key, false); s != nil {
+		n := count
+		if n < 0 {
+			n = 1
+		}
+		positions = s.Positions(element, rank, n, maxlen)
+	}
+	if count < 0 {
+		if len(positions) == 0 {
+			return &BulkReply{}, nil
+		}
+		return &IntegerReply{number: positions[0]}, nil
+	}
+	values := make([]interface{}, len(positions))
+	for i, p := range positions {
+		values[i] = p
+	}
+	return &MultiBulkReply{values: values}, nil
+}
+
+// pushx pushes values on the list at key only if it exists.
+func (h *DefaultHandler) pushx(client *Client, key string, values [][]byte, front bool) (int, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeList, key); err != nil {
+		return 0, err
+	}
+	s := db.stack(key, false)
+	if s == nil || s.Len() == 0 {
+		return 0, nil
+	}
+	for _, value := range values {
+		if front {
+			s.PushFront(value)
+		} else {
+			s.PushBack(value)
+		}
+	}
+	return s.Len(), nil
+}
+
+func (h *DefaultHandler) Rpushx(client *Client, key string, value []byte, values ...[]byte) (int, error) {
+	return h.pushx(client, key, append([][]byte{value}, values...), false)
+}
+
+func (h *DefaultHandler) Lpushx(client *Client, key string, value []byte, values ...[]byte) (int, error) {
+	return h.pushx(client, key, append([][]byte{value}, values...), true)
+}
+
+// parseWhere parses the LEFT or RIGHT argument of LMOVE, returning true for
+// the head of the list.
+func parseWhere(where string) (bool, error) {
+	switch strings.ToUpper(where) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, ErrSyntax
+}
+
+// lmove pops an element from source and pushes it to destination, returning
+// nil if source is empty.
+func (h *DefaultHandler) lmove(client *Client, source, destination string, fromFront, toFront bool) ([]byte, error) {
+	db := h.db(client)
+	defer db.lock(source, destination)()
+	v, err := db.moveElement(source, destination, fromFront, toFront)
+	if v != nil {
+		h.handOff(client, db, destination)
+	}
+	return v, err
+}
+
+// moveElement is lmove for callers holding the shards owning source and
+// destination write-locked together, so that the element is always in
+// one of the lists. The clients blocked on destination are left to the
+// caller.
+func (db *Database) moveElement(source, destination string, fromFront, toFront bool) ([]byte, error) {
+	if err := db.checkType(typeList, destination, source); err != nil {
+		return nil, err
+	}
+	src := db.stack(source, false)
+	if src == nil || src.Len() == 0 {
+		return nil, nil
+	}
+	var v []byte
+	if fromFront {
+		v = src.PopFront()
+	} else {
+		v = src.PopBack()
+	}
+	if src.Len() == 0 {
+		db.remove(source)
+	}
+	dst := db.stack(destination, true)
+	if toFront {
+		dst.PushFront(v)
+	} else {
+		dst.PushBack(v)
+	}
+	return v, nil
+}
+
+// blmove is lmove waiting up to timeout for source to receive an element.
+// The element is moved with both lists locked: pushes only wake the client,
+// leaving the element in source for it.
+func (h *DefaultHandler) blmove(client *Client, source, destination string, fromFront, toFront bool, timeout string) ([]byte, error) {
+	d, err := parseTimeout(timeout)
+	if err != nil {
+		return nil, err
+	}
+	var timeoutChan <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	// served is set once a push woke the client, and last once it gave up
+	// waiting.
+	served, last := false, false
+	var waitErr error
+	for {
+		db, unlock := h.lockDb(client, source, destination)
+		v, err := db.moveElement(source, destination, fromFront, toFront)
+		if v != nil {
+			h.handOff(client, db, destination)
+		}
+		if err != nil && served {
+			// What the client was woken for goes to the next one.
+			db.handOff(source)
+		}
+		if v != nil || err != nil || client.inExec || last {
+			unlock()
+			if v == nil && err == nil {
+				err = waitErr
+			}
+			return v, err
+		}
+		w := db.queueListWaiter([]string{source}, fromFront, true)
+		unlock()
+
+		relock := client.releaseTx()
+		select {
+		case <-w.served:
+			relock()
+			served = true
+			continue
+		case <-timeoutChan:
+		case <-client.closed:
+		case <-client.done:
+			waitErr = ErrServerClosed
+		}
+		relock()
+		if w.unqueue() {
+			return nil, waitErr
+		}
+		// Woken meanwhile: take the element before giving up.
+		served, last = true, true
+	}
+}
+
+func (h *DefaultHandler) Lmove(client *Client, source, destination, wherefrom, whereto string) ([]byte, error) {
+	fromFront, err := parseWhere(wherefrom)
+	if err != nil {
+		return nil, err
+	}
+	toFront, err := parseWhere(whereto)
+	if err != nil {
+		return nil, err
+	}
+	return h.lmove(client, source, destination, fromFront, toFront)
+}
+
+func (h *DefaultHandler) Rpoplpush(client *Client, source, destination string) ([]byte, error) {
+	return h.lmove(client, source, destination, false, true)
+}
+
+func (h *DefaultHandler) Blmove(client *Client, source, destination, wherefrom, whereto, timeout string) ([]byte, error) {
+	fromFront, err := parseWhere(wherefrom)
+	if err != nil {
+		return nil, err
+	}
+	toFront, err := parseWhere(whereto)
+	if err != nil {
+		return nil, err
+	}
+	return h.blmove(client, source, destination, fromFront, toFront, timeout)
+}
+
+func (h *DefaultHandler) Brpoplpush(client *Client, source, destination, timeout string) ([]byte, error) {
+	return h.blmove(client, source, destination, false, true, timeout)
+}
+
+func (h *DefaultHandler) Hget(client *Client, key, subkey string) ([]byte, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return nil, err
+	}
+	if db.expired(key) {
+		return nil, nil
+	}
+	if v := db.hash(key, false); v != nil {
+		if v, exists := v[subkey]; exists {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// Hset sets the fields of the hash at key and returns the number of fields
+// that were added.
+func (h *DefaultHandler) Hset(client *Client, key string, values map[string][]byte) (int, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return 0, err
+	}
+	hash := db.hash(key, true)
+	added := 0
+	for field, value := range values {
+		if _, exists := hash[field]; !exists {
+			added++
+		}
+		hash[field] = value
+	}
+	return added, nil
+}
+
+func (h *DefaultHandler) Hmset(client *Client, key string, values map[string][]byte) error {
+	_, err := h.Hset(client, key, values)
+	return err
+}
+
+func (h *DefaultHandler) Hsetnx(client *Client, key, field string, value []byte) (int, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return 0, err
+	}
+	hash := db.hash(key, true)
+	if _, exists := hash[field]; exists {
+		return 0, nil
+	}
+	hash[field] = value
+	return 1, nil
+}
+
+func (h *DefaultHandler) Hgetall(client *Client, key string) (HashValue, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return nil, err
+	}
+	if db.expired(key) {
+		return nil, nil
+	}
+	// Copy the hash: the reply is written after the lock is released.
+	v := db.hash(key, false)
+	if v == nil {
+		return nil, nil
+	}
+	ret := make(HashValue, len(v))
+	for field, value := range v {
+		ret[field] = value
+	}
+	return ret, nil
+}
+
+func (h *DefaultHandler) Hmget(client *Client, key, field string, fields ...string) ([]interface{}, error) {
+	fields = append([]string{field}, fields...)
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return nil, err
+	}
+	hash := db.hash(key, false)
+	ret := make([]interface{}, len(fields))
+	for i, f := range fields {
+		if v, exists := hash[f]; exists {
+			ret[i] = v
+		}
+	}
+	return ret, nil
+}
+
+func (h *DefaultHandler) Hdel(client *Client, key, field string, fields ...string) (int, error) {
+	fields = append([]string{field}, fields...)
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return 0, err
+	}
+	hash := db.hash(key, false)
+	removed := 0
+	for _, f := range fields {
+		if _, exists := hash[f]; exists {
+			delete(hash, f)
+			removed++
+		}
+	}
+	if hash != nil && len(hash) == 0 {
+		db.remove(key)
+	}
+	return removed, nil
+}
+
+func (h *DefaultHandler) Hexists(client *Client, key, field string) (int, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return 0, err
+	}
+	if _, exists := db.hash(key, false)[field]; exists {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (h *DefaultHandler) Hlen(client *Client, key string) (int, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return 0, err
+	}
+	return len(db.hash(key, false)), nil
+}
+
+func (h *DefaultHandler) Hstrlen(client *Client, key, field string) (int, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return 0, err
+	}
+	return len(db.hash(key, false)[field]), nil
+}
+
+// sortedFields returns the fields of hash in sorted order.
+func sortedFields(hash HashValue) []string {
+	fields := make([]string, 0, len(hash))
+	for f := range hash {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Hkeys returns the fields of the hash at key, sorted.
+func (h *DefaultHandler) Hkeys(client *Client, key string) ([]interface{}, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return nil, err
+	}
+	fields := sortedFields(db.hash(key, false))
+	ret := make([]interface{}, len(fields))
+	for i, f := range fields {
+		ret[i] = []byte(f)
+	}
+	return ret, nil
+}
+
+// Hvals returns the values of the hash at key, ordered by field.
+func (h *DefaultHandler) Hvals(client *Client, key string) ([]interface{}, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return nil, err
+	}
+	hash := db.hash(key, false)
+	fields := sortedFields(hash)
+	ret := make([]interface{}, len(fields))
+	for i, f := range fields {
+		ret[i] = hash[f]
+	}
+	return ret, nil
+}
+
+// Hincrby adds increment to the integer stored in field of the hash at key
+// and returns the new value.
+func (h *DefaultHandler) Hincrby(client *Client, key, field, increment string) (int, error) {
+	incr, err := parseIncrement(increment)
+	if err != nil {
+		return 0, err
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return 0, err
+	}
+	var n int64
+	if v, exists := db.hash(key, false)[field]; exists {
+		if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, NewError("hash value is not an integer")
+		}
+	}
+	if (incr > 0 && n > math.MaxInt64-incr) || (incr < 0 && n < math.MinInt64-incr) {
+		return 0, ErrOverflow
+	}
+	n += incr
+	db.hash(key, true)[field] = []byte(strconv.FormatInt(n, 10))
+	return int(n), nil
+}
+
+// Hincrbyfloat adds increment to the float stored in field of the hash at
+// key and replies with the new value.
+func (h *DefaultHandler) Hincrbyfloat(client *Client, key, field, increment string) ([]byte, error) {
+	incr, ok := parseFloat(increment)
+	if !ok {
+		return nil, ErrNotFloat
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return nil, err
+	}
+	var f float64
+	if v, exists := db.hash(key, false)[field]; exists {
+		if f, ok = parseFloat(string(v)); !ok {
+			return nil, NewError("hash value is not a float")
+		}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, ErrNaN
+	}
+	value := []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	db.hash(key, true)[field] = value
+	return value, nil
+}
+
+// Hrandfield returns a random field of the hash at key. With a positive
+// count it returns up to count distinct fields, with a negative one exactly
+// -count fields which may repeat. WITHVALUES adds the values to the fields.
+func (h *DefaultHandler) Hrandfield(client *Client, key string, args ...string) (ReplyWriter, error) {
+	n := 1
+	withValues := false
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil {
+			return nil, ErrNotInteger
+		}
+		switch {
+		case len(args) == 1:
+		case len(args) == 2 && strings.ToUpper(args[1]) == "WITHVALUES":
+			withValues = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return nil, err
+	}
+	hash := db.hash(key, false)
+	fields := make([]string, 0, len(hash))
+	for f := range hash {
+		fields = append(fields, f)
+	}
+	rand.Shuffle(len(fields), func(i, j int) { fields[i], fields[j] = fields[j], fields[i] })
+	var picked []string
+	if n >= 0 {
+		if n > len(fields) {
+			n = len(fields)
+		}
+		picked = fields[:n]
+	} else if len(fields) > 0 {
+		for i := 0; i < -n; i++ {
+			picked = append(picked, fields[rand.Intn(len(fields))])
+		}
+	}
+
+	if len(args) == 0 {
+		if len(picked) == 0 {
+			return &BulkReply{}, nil
+		}
+		return &BulkReply{value: []byte(picked[0])}, nil
+	}
+	ret := make([]interface{}, 0, len(picked))
+	for _, f := range picked {
+		switch {
+		case !withValues:
+			ret = append(ret, []byte(f))
+		case client.Protocol == 3:
+			ret = append(ret, []interface{}{[]byte(f), hash[f]})
+		default:
+			ret = append(ret, []byte(f), hash[f])
+		}
+	}
+	return &MultiBulkReply{values: ret}, nil
+}
+
+// Hscan iterates over the fields of the hash at key, replying with the
+// fields and their values, see scanMembers.
+func (h *DefaultHandler) Hscan(client *Client, key, cursor string, options ...string) ([]interface{}, error) {
+	start, err := parseScanCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseScanOptions(options, false)
+	if err != nil {
+		return nil, err
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeHash, key); err != nil {
+		return nil, err
+	}
+	hash := db.hash(key, false)
+	fields, next := db.scanMembers(key, start, opts.pattern, opts.count, func() []string {
+		fields := make([]string, 0, len(hash))
+		for f := range hash {
+			fields = append(fields, f)
+		}
+		return fields
+	}, func(f string) bool {
+		_, exists := hash[f]
+		return exists
+	})
+	matches := make([]interface{}, 0, 2*len(fields))
+	for _, f := range fields {
+		matches = append(matches, []byte(f), hash[f])
+	}
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), matches}, nil
+}
+
+// Sadd adds the members to the set at key and returns the number of members
+// that were not already in the set.
+func (h *DefaultHandler) Sadd(client *Client, key, member string, members ...string) (int, error) {
+	members = append([]string{member}, members...)
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return 0, err
+	}
+	set := db.set(key, true)
+	added := 0
+	for _, m := range members {
+		if _, exists := set[m]; !exists {
+			set[m] = struct{}{}
+			added++
+		}
+	}
+	return added, nil
+}
+
+// Srem removes the members from the set at key and returns the number of
+// members removed. The key is deleted once the set is empty.
+func (h *DefaultHandler) Srem(client *Client, key, member string, members ...string) (int, error) {
+	members = append([]string{member}, members...)
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return 0, err
+	}
+	set := db.set(key, false)
+	removed := 0
+	for _, m := range members {
+		if _, exists := set[m]; exists {
+			delete(set, m)
+			removed++
+		}
+	}
+	if set != nil && len(set) == 0 {
+		db.remove(key)
+	}
+	return removed, nil
+}
+
+func (h *DefaultHandler) Sismember(client *Client, key, member string) (int, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return 0, err
+	}
+	if _, exists := db.set(key, false)[member]; exists {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (h *DefaultHandler) Smismember(client *Client, key, member string, members ...string) ([]interface{}, error) {
+	members = append([]string{member}, members...)
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return nil, err
+	}
+	set := db.set(key, false)
+	ret := make([]interface{}, len(members))
+	for i, m := range members {
+		ret[i] = 0
+		if _, exists := set[m]; exists {
+			ret[i] = 1
+		}
+	}
+	return ret, nil
+}
+
+func (h *DefaultHandler) Smembers(client *Client, key string) (SetValue, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return nil, err
+	}
+	// Copy the set: the reply is written after the lock is released.
+	set := db.set(key, false)
+	ret := make(SetValue, len(set))
+	for m := range set {
+		ret[m] = struct{}{}
+	}
+	return ret, nil
+}
+
+func (h *DefaultHandler) Scard(client *Client, key string) (int, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return 0, err
+	}
+	return len(db.set(key, false)), nil
+}
+
+// parseSetCount parses the optional count argument of SPOP and SRANDMEMBER.
+func parseSetCount(count []string) (int, error) {
+	if len(count) > 1 {
+		return 0, ErrSyntax
+	}
+	n, err := strconv.Atoi(count[0])
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
+
+// randomMembers returns n distinct members of set picked at random.
+func randomMembers(set SetValue, n int) []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	if n < len(members) {
+		members = members[:n]
+	}
+	return members
+}
+
+// Spop removes and returns a random member of the set at key, or count
+// random members if given.
+func (h *DefaultHandler) Spop(client *Client, key string, count ...string) (ReplyWriter, error) {
+	n := 1
+	if len(count) > 0 {
+		var err error
+		if n, err = parseSetCount(count); err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, NewError("value is out of range, must be positive")
+		}
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return nil, err
+	}
+	set := db.set(key, false)
+	popped := randomMembers(set, n)
+	for _, m := range popped {
+		delete(set, m)
+	}
+	if set != nil && len(set) == 0 {
+		db.remove(key)
+	}
+	if len(count) == 0 {
+		if len(popped) == 0 {
+			return &BulkReply{}, nil
+		}
+		return &BulkReply{value: []byte(popped[0])}, nil
+	}
+	ret := make([]interface{}, len(popped))
+	for i, m := range popped {
+		ret[i] = []byte(m)
+	}
+	return &MultiBulkReply{values: ret}, nil
+}
+
+// Srandmember returns a random member of the set at key. With a positive
+// count it returns up to count distinct members, with a negative one
+// exactly -count members which may repeat.
+func (h *DefaultHandler) Srandmember(client *Client, key string, count ...string) (ReplyWriter, error) {
+	n := 1
+	if len(count) > 0 {
+		var err error
+		if n, err = parseSetCount(count); err != nil {
+			return nil, err
+		}
+	}
+
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return nil, err
+	}
+	set := db.set(key, false)
+	var members []string
+	if n >= 0 {
+		members = randomMembers(set, n)
+	} else if len(set) > 0 {
+		all := randomMembers(set, len(set))
+		for i := 0; i < -n; i++ {
+			members = append(members, all[rand.Intn(len(all))])
+		}
+	}
+	if len(count) == 0 {
+		if len(members) == 0 {
+			return &BulkReply{}, nil
+		}
+		return &BulkReply{value: []byte(members[0])}, nil
+	}
+	ret := make([]interface{}, len(members))
+	for i, m := range members {
+		ret[i] = []byte(m)
+	}
+	return &MultiBulkReply{values: ret}, nil
+}
+
+// Smove moves member from the set at source to the set at destination.
+func (h *DefaultHandler) Smove(client *Client, source, destination, member string) (int, error) {
+	db := h.db(client)
+	defer db.lock(source, destination)()
+
+	if err := db.checkType(typeSet, source, destination); err != nil {
+		return 0, err
+	}
+	src := db.set(source, false)
+	if _, exists := src[member]; !exists {
+		return 0, nil
+	}
+	delete(src, member)
+	if len(src) == 0 {
+		db.remove(source)
+	}
+	db.set(destination, true)[member] = struct{}{}
+	return 1, nil
+}
+
+// Set operations of SINTER, SUNION and SDIFF.
+const (
+	setInter = iota
+	setUnion
+	setDiff
 )
 
-type Database struct {
-	children map[int]*Database
-	parent   *Database
+// combine returns the intersection, union or difference of the sets at keys.
+// The shards owning keys must be locked.
+func (db *Database) combine(op int, keys []string) (SetValue, error) {
+	if err := db.checkType(typeSet, keys...); err != nil {
+		return nil, err
+	}
+	ret := make(SetValue)
+	for m := range db.set(keys[0], false) {
+		ret[m] = struct{}{}
+	}
+	for _, key := range keys[1:] {
+		set := db.set(key, false)
+		switch op {
+		case setInter:
+			for m := range ret {
+				if _, exists := set[m]; !exists {
+					delete(ret, m)
+				}
+			}
+		case setUnion:
+			for m := range set {
+				ret[m] = struct{}{}
+			}
+		case setDiff:
+			for m := range set {
+				delete(ret, m)
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (h *DefaultHandler) combine(client *Client, op int, keys []string) (SetValue, error) {
+	db := h.db(client)
+	defer db.rlock(keys...)()
+
+	return db.combine(op, keys)
+}
+
+// combineStore stores the result of the set operation at destination,
+// replacing its value, and returns its size.
+func (h *DefaultHandler) combineStore(client *Client, op int, destination string, keys []string) (int, error) {
+	db := h.db(client)
+	defer db.lock(append(keys, destination)...)()
+
+	set, err := db.combine(op, keys)
+	if err != nil {
+		return 0, err
+	}
+	db.remove(destination)
+	if len(set) > 0 {
+		db.store(destination, set)
+	}
+	return len(set), nil
+}
+
+func (h *DefaultHandler) Sinter(client *Client, key string, keys ...string) (SetValue, error) {
+	return h.combine(client, setInter, append([]string{key}, keys...))
+}
+
+func (h *DefaultHandler) Sunion(client *Client, key string, keys ...string) (SetValue, error) {
+	return h.combine(client, setUnion, append([]string{key}, keys...))
+}
+
+func (h *DefaultHandler) Sdiff(client *Client, key string, keys ...string) (SetValue, error) {
+	return h.combine(client, setDiff, append([]string{key}, keys...))
+}
+
+func (h *DefaultHandler) Sinterstore(client *Client, destination, key string, keys ...string) (int, error) {
+	return h.combineStore(client, setInter, destination, append([]string{key}, keys...))
+}
+
+func (h *DefaultHandler) Sunionstore(client *Client, destination, key string, keys ...string) (int, error) {
+	return h.combineStore(client, setUnion, destination, append([]string{key}, keys...))
+}
+
+func (h *DefaultHandler) Sdiffstore(client *Client, destination, key string, keys ...string) (int, error) {
+	return h.combineStore(client, setDiff, destination, append([]string{key}, keys...))
+}
+
+// Sintercard returns the size of the intersection of the sets at the
+// numkeys keys, stopping at the LIMIT option if given.
+func (h *DefaultHandler) Sintercard(client *Client, numkeys string, args ...string) (int, error) {
+	n, err := strconv.Atoi(numkeys)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	if n <= 0 {
+		return 0, NewError("numkeys should be greater than 0")
+	}
+	if n > len(args) {
+		return 0, NewError("Number of keys can't be greater than number of args")
+	}
+	keys, options := args[:n], args[n:]
+	limit := 0
+	for i := 0; i < len(options); i += 2 {
+		if strings.ToUpper(options[i]) != "LIMIT" || i+1 == len(options) {
+			return 0, ErrSyntax
+		}
+		if limit, err = strconv.Atoi(options[i+1]); err != nil {
+			return 0, ErrNotInteger
+		}
+		if limit < 0 {
+			return 0, NewError("LIMIT can't be negative")
+		}
+	}
+	set, err := h.combine(client, setInter, keys)
+	if err != nil {
+		return 0, err
+	}
+	card := len(set)
+	if limit > 0 && card > limit {
+		card = limit
+	}
+	return card, nil
+}
+
+// scanOptions are the options of the SCAN commands.
+type scanOptions struct {
+	pattern string
+	count   int
+	t       string // type of the keys to return, any if empty
+}
+
+// parseScanOptions parses the MATCH and COUNT options of the SCAN commands,
+// and the TYPE option if withType is set.
+func parseScanOptions(options []string, withType bool) (*scanOptions, error) {
+	opts := &scanOptions{pattern: "*", count: 10}
+	for i := 0; i < len(options); i += 2 {
+		if i+1 == len(options) {
+			return nil, ErrSyntax
+		}
+		switch strings.ToUpper(options[i]) {
+		case "MATCH":
+			opts.pattern = options[i+1]
+		case "COUNT":
+			var err error
+			if opts.count, err = strconv.Atoi(options[i+1]); err != nil {
+				return nil, ErrNotInteger
+			}
+			if opts.count < 1 {
+				return nil, ErrSyntax
+			}
+		case "TYPE":
+			if !withType {
+				return nil, ErrSyntax
+			}
+			opts.t = strings.ToLower(options[i+1])
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	return opts, nil
+}
+
+// parseScanCursor parses the cursor of the SCAN commands.
+func parseScanCursor(cursor string) (uint64, error) {
+	start, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return 0, NewError("invalid cursor")
+	}
+	return start, nil
+}
+
+// hashedName is a key or member with its hash, the order the SCAN commands
+// iterate in.
+type hashedName struct {
+	hash uint32
+	name string
+}
+
+// appendHashed appends name to names if its hash is at least start.
+func appendHashed(names []hashedName, name string, start uint64) []hashedName {
+	if hash := keyHash(name); uint64(hash) >= start {
+		names = append(names, hashedName{hash, name})
+	}
+	return names
+}
+
+// hashHeap is a max-heap of hashes.
+type hashHeap []uint32
+
+func (h hashHeap) Len() int            { return len(h) }
+func (h hashHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h hashHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x interface{}) { *h = append(*h, x.(uint32)) }
+func (h *hashHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// lowestHashes returns the names with the count lowest hashes, sorted by
+// hash. Names sharing a hash are never split, so that the next call can
+// start at the following hash. Only the returned names are sorted.
+func lowestHashes(names []hashedName, count int) []hashedName {
+	if len(names) > count {
+		h := make(hashHeap, 0, count)
+		for _, n := range names {
+			if len(h) < count {
+				heap.Push(&h, n.hash)
+			} else if n.hash < h[0] {
+				h[0] = n.hash
+				heap.Fix(&h, 0)
+			}
+		}
+		var lowest []hashedName
+		for _, n := range names {
+			if n.hash <= h[0] {
+				lowest = append(lowest, n)
+			}
+		}
+		names = lowest
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].hash < names[j].hash || (names[i].hash == names[j].hash && names[i].name < names[j].name)
+	})
+	return names
+}
+
+// scanMembers returns the members of the set, hash or sorted set at key
+// that the SSCAN, HSCAN or ZSCAN call with cursor returns, those matching
+// pattern, along with the cursor of the call after it, 0 once the iteration
+// is over. names lists the members and exists tells whether one is still
+// there.
+//
+// The cursor is a hash, so that members present during the whole iteration
+// are returned exactly once, whatever is added or removed in between. The
+// members sorted by hash are kept with the key while it is iterated over,
+// so that each call only goes through the members it returns: those added
+// since the iteration started may be missed, as redis allows.
+// The shard owning key must be write-locked.
+func (db *Database) scanMembers(key string, cursor uint64, pattern string, count int, names func() []string, exists func(string) bool) ([]string, uint64) {
+	matches := []string{}
+	v := db.shard(key).keys[key]
+	if v == nil || db.expired(key) {
+		return matches, 0
+	}
+	if cursor == 0 || v.scan == nil {
+		v.scan = v.scan[:0]
+		for _, name := range names() {
+			v.scan = appendHashed(v.scan, name, 0)
+		}
+		sort.Slice(v.scan, func(i, j int) bool {
+			return v.scan[i].hash < v.scan[j].hash || (v.scan[i].hash == v.scan[j].hash && v.scan[i].name < v.scan[j].name)
+		})
+	}
+
+	i := sort.Search(len(v.scan), func(i int) bool { return uint64(v.scan[i].hash) >= cursor })
+	// Members sharing a hash are never split, so that the next call can
+	// start at the following hash.
+	for n := 0; i < len(v.scan) && (n < count || v.scan[i].hash == v.scan[i-1].hash); i++ {
+		if name := v.scan[i].name; exists(name) {
+			n++
+			if matchPattern(pattern, name) {
+				matches = append(matches, name)
+			}
+		}
+	}
+	if i == len(v.scan) {
+		v.scan = nil
+		return matches, 0
+	}
+	return matches, uint64(v.scan[i-1].hash) + 1
+}
+
+// Sscan iterates over the members of the set at key, see scanMembers.
+func (h *DefaultHandler) Sscan(client *Client, key, cursor string, options ...string) ([]interface{}, error) {
+	start, err := parseScanCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseScanOptions(options, false)
+	if err != nil {
+		return nil, err
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeSet, key); err != nil {
+		return nil, err
+	}
+	set := db.set(key, false)
+	found, next := db.scanMembers(key, start, opts.pattern, opts.count, func() []string {
+		members := make([]string, 0, len(set))
+		for m := range set {
+			members = append(members, m)
+		}
+		return members
+	}, func(m string) bool {
+		_, exists := set[m]
+		return exists
+	})
+	matches := make([]interface{}, len(found))
+	for i, m := range found {
+		matches[i] = []byte(m)
+	}
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), matches}, nil
+}
+
+// Zscan iterates over the members of the sorted set at key, replying with
+// the members and their scores, see scanMembers.
+func (h *DefaultHandler) Zscan(client *Client, key, cursor string, options ...string) ([]interface{}, error) {
+	start, err := parseScanCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseScanOptions(options, false)
+	if err != nil {
+		return nil, err
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return nil, err
+	}
+	var scores map[string]float64
+	if zset := db.zset(key, false); zset != nil {
+		scores = zset.scores
+	}
+	found, next := db.scanMembers(key, start, opts.pattern, opts.count, func() []string {
+		names := make([]string, 0, len(scores))
+		for m := range scores {
+			names = append(names, m)
+		}
+		return names
+	}, func(m string) bool {
+		_, exists := scores[m]
+		return exists
+	})
+	matches := make([]interface{}, 0, 2*len(found))
+	for _, m := range found {
+		matches = append(matches, []byte(m), &DoubleReply{value: scores[m]})
+	}
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), matches}, nil
+}
+
+// Keys returns the keys matching pattern, sorted.
+func (h *DefaultHandler) Keys(client *Client, pattern string) ([]interface{}, error) {
+	var keys []string
+	h.db(client).forEachKey(func(key, t string) {
+		if matchPattern(pattern, key) {
+			keys = append(keys, key)
+		}
+	})
+	sort.Strings(keys)
+	ret := make([]interface{}, len(keys))
+	for i, key := range keys {
+		ret[i] = []byte(key)
+	}
+	return ret, nil
+}
+
+// Scan iterates over the keys of the selected database, one shard after
+// the other. The cursor holds the index of the shard in its upper 32 bits,
+// and in its lower ones the hash to resume from within the shard: keys
+// present during the whole iteration are returned exactly once, whatever
+// other clients add or remove in between, and each call only goes through
+// the keys of the shards it returns keys from.
+func (h *DefaultHandler) Scan(client *Client, cursor string, options ...string) ([]interface{}, error) {
+	start, err := parseScanCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseScanOptions(options, true)
+	if err != nil {
+		return nil, err
+	}
+	shard, from := start>>32, start&math.MaxUint32
+	if shard >= dbShardCount {
+		return nil, NewError("invalid cursor")
+	}
+
+	db := h.db(client)
+	matches := []interface{}{}
+	next := uint64(0)
+	for n := 0; shard < dbShardCount; shard, from = shard+1, 0 {
+		if n >= opts.count {
+			next = shard << 32
+			break
+		}
+		var names []hashedName
+		types := make(map[string]string)
+		db.forEachKeyIn(int(shard), func(key, t string) {
+			names = appendHashed(names, key, from)
+			types[key] = t
+		})
+		total := len(names)
+		lowest := lowestHashes(names, opts.count-n)
+		n += len(lowest)
+		for _, k := range lowest {
+			if (opts.t == "" || opts.t == types[k.name]) && matchPattern(opts.pattern, k.name) {
+				matches = append(matches, []byte(k.name))
+			}
+		}
+		if len(lowest) < total {
+			next = shard<<32 | uint64(lowest[len(lowest)-1].hash) + 1
+			break
+		}
+	}
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), matches}, nil
+}
+
+// parseScore parses a sorted set score, which may be inf, +inf or -inf.
+func parseScore(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseScoreRange parses the min and max arguments of ZRANGEBYSCORE: a
+// score, exclusive when prefixed with "(".
+func parseScoreRange(min, max string) (*scoreRange, error) {
+	r := &scoreRange{}
+	var ok bool
+	if r.minex = strings.HasPrefix(min, "("); r.minex {
+		min = min[1:]
+	}
+	if r.maxex = strings.HasPrefix(max, "("); r.maxex {
+		max = max[1:]
+	}
+	if r.min, ok = parseScore(min); !ok {
+		return nil, NewError("min or max is not a float")
+	}
+	if r.max, ok = parseScore(max); !ok {
+		return nil, NewError("min or max is not a float")
+	}
+	return r, nil
+}
+
+func parseLexBound(s string) (lexBound, bool) {
+	switch {
+	case s == "-":
+		return lexBound{inf: -1}, true
+	case s == "+":
+		return lexBound{inf: 1}, true
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:], inclusive: true}, true
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:]}, true
+	}
+	return lexBound{}, false
+}
+
+// parseLexRange parses the min and max arguments of ZRANGE BYLEX.
+func parseLexRange(min, max string) (*lexRange, error) {
+	r := &lexRange{}
+	var ok bool
+	if r.min, ok = parseLexBound(min); !ok {
+		return nil, NewError("min or max not valid string range item")
+	}
+	if r.max, ok = parseLexBound(max); !ok {
+		return nil, NewError("min or max not valid string range item")
+	}
+	return r, nil
+}
+
+// scoredReply returns members, along with their scores if withScores is set:
+// as pairs for RESP3 connections and as a flat list otherwise.
+func scoredReply(client *Client, members []ScoredMember, withScores bool) ReplyWriter {
+	values := make([]interface{}, 0, len(members)*2)
+	for _, m := range members {
+		switch {
+		case !withScores:
+			values = append(values, []byte(m.Member))
+		case client.Protocol == 3:
+			values = append(values, []interface{}{[]byte(m.Member), &DoubleReply{value: m.Score}})
+		default:
+			values = append(values, []byte(m.Member), &DoubleReply{value: m.Score})
+		}
+	}
+	return &MultiBulkReply{values: values}
+}
+
+// Zadd sets the scores of members of the sorted set at key. It replies with
+// the number of members added (or changed, with CH), or with the new score
+// when INCR is given.
+func (h *DefaultHandler) Zadd(client *Client, key string, args ...string) (ReplyWriter, error) {
+	var nx, xx, gt, lt, ch, incr bool
+	i := 0
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, ErrSyntax
+	}
+	if nx && xx {
+		return nil, NewError("XX and NX options at the same time are not compatible")
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return nil, NewError("GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) > 2 {
+		return nil, NewError("INCR option supports a single increment-element pair")
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		var ok bool
+		if scores[j], ok = parseScore(pairs[2*j]); !ok {
+			return nil, ErrNotFloat
+		}
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return nil, err
+	}
+	zset := db.zset(key, !xx)
+	if zset == nil {
+		if incr {
+			return &BulkReply{}, nil
+		}
+		return &IntegerReply{number: 0}, nil
+	}
+	defer func() {
+		if zset.Len() == 0 {
+			db.remove(key)
+		}
+	}()
+
+	added, changed := 0, 0
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		old, exists := zset.Score(member)
+		if (nx && exists) || (xx && !exists) {
+			if incr {
+				return &BulkReply{}, nil
+			}
+			continue
+		}
+		if incr {
+			if score += old; math.IsNaN(score) {
+				return nil, NewError("resulting score is not a number (NaN)")
+			}
+		}
+		if exists && ((gt && score <= old) || (lt && score >= old)) {
+			if incr {
+				return &BulkReply{}, nil
+			}
+			continue
+		}
+		if zset.Add(member, score) {
+			added++
+		} else if old != score {
+			changed++
+		}
+		if incr {
+			scores[j] = score
+		}
+	}
+	if added > 0 {
+		db.waiters.blocked.Signal(key)
+	}
+	if incr {
+		return &DoubleReply{value: scores[0]}, nil
+	}
+	if ch {
+		return &IntegerReply{number: added + changed}, nil
+	}
+	return &IntegerReply{number: added}, nil
+}
+
+func (h *DefaultHandler) Zincrby(client *Client, key, increment, member string) (ReplyWriter, error) {
+	return h.Zadd(client, key, "INCR", increment, member)
+}
+
+func (h *DefaultHandler) Zrem(client *Client, key, member string, members ...string) (int, error) {
+	members = append([]string{member}, members...)
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return 0, err
+	}
+	zset := db.zset(key, false)
+	if zset == nil {
+		return 0, nil
+	}
+	removed := 0
+	for _, m := range members {
+		if zset.Remove(m) {
+			removed++
+		}
+	}
+	if zset.Len() == 0 {
+		db.remove(key)
+	}
+	return removed, nil
+}
+
+func (h *DefaultHandler) Zscore(client *Client, key, member string) (ReplyWriter, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return nil, err
+	}
+	if zset := db.zset(key, false); zset != nil {
+		if score, exists := zset.Score(member); exists {
+			return &DoubleReply{value: score}, nil
+		}
+	}
+	return &BulkReply{}, nil
+}
+
+func (h *DefaultHandler) Zcard(client *Client, key string) (int, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return 0, err
+	}
+	if zset := db.zset(key, false); zset != nil {
+		return zset.Len(), nil
+	}
+	return 0, nil
+}
+
+func (h *DefaultHandler) Zcount(client *Client, key, min, max string) (int, error) {
+	r, err := parseScoreRange(min, max)
+	if err != nil {
+		return 0, err
+	}
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return 0, err
+	}
+	if zset := db.zset(key, false); zset != nil {
+		return zset.count(r), nil
+	}
+	return 0, nil
+}
+
+func (h *DefaultHandler) zrank(client *Client, key, member string, reverse bool) (ReplyWriter, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return nil, err
+	}
+	if zset := db.zset(key, false); zset != nil {
+		if rank := zset.Rank(member, reverse); rank >= 0 {
+			return &IntegerReply{number: rank}, nil
+		}
+	}
+	return &BulkReply{}, nil
+}
+
+func (h *DefaultHandler) Zrank(client *Client, key, member string) (ReplyWriter, error) {
+	return h.zrank(client, key, member, false)
+}
+
+func (h *DefaultHandler) Zrevrank(client *Client, key, member string) (ReplyWriter, error) {
+	return h.zrank(client, key, member, true)
+}
+
+// zrangeOptions are the options of ZRANGE and ZRANGEBYSCORE.
+type zrangeOptions struct {
+	byScore, byLex, rev, withScores bool
+	limit                           bool
+	offset, count                   int
+}
+
+func parseZrangeOptions(options []string) (*zrangeOptions, error) {
+	opts := &zrangeOptions{}
+	for i := 0; i < len(options); i++ {
+		switch strings.ToUpper(options[i]) {
+		case "BYSCORE":
+			opts.byScore = true
+		case "BYLEX":
+			opts.byLex = true
+		case "REV":
+			opts.rev = true
+		case "WITHSCORES":
+			opts.withScores = true
+		case "LIMIT":
+			if i+2 >= len(options) {
+				return nil, ErrSyntax
+			}
+			var err1, err2 error
+			opts.offset, err1 = strconv.Atoi(options[i+1])
+			opts.count, err2 = strconv.Atoi(options[i+2])
+			if err1 != nil || err2 != nil {
+				return nil, ErrNotInteger
+			}
+			opts.limit = true
+			i += 2
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	return opts, nil
+}
+
+// zrange returns the members of the sorted set at key between start and
+// stop: ranks by default, scores or members with BYSCORE or BYLEX.
+func (h *DefaultHandler) zrange(client *Client, key, start, stop string, opts *zrangeOptions) (ReplyWriter, error) {
+	if opts.byScore && opts.byLex {
+		return nil, ErrSyntax
+	}
+	if opts.limit && !opts.byScore && !opts.byLex {
+		return nil, NewError("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if opts.withScores && opts.byLex {
+		return nil, NewError("syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	if opts.rev && (opts.byScore || opts.byLex) {
+		// Reversed ranges are given from max to min.
+		start, stop = stop, start
+	}
+	var r zrange
+	var startRank, stopRank int
+	var err error
+	switch {
+	case opts.byScore:
+		r, err = parseScoreRange(start, stop)
+	case opts.byLex:
+		r, err = parseLexRange(start, stop)
+	default:
+		var err1, err2 error
+		startRank, err1 = strconv.Atoi(start)
+		stopRank, err2 = strconv.Atoi(stop)
+		if err1 != nil || err2 != nil {
+			err = ErrNotInteger
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return nil, err
+	}
+	zset := db.zset(key, false)
+	var members []ScoredMember
+	switch {
+	case zset == nil:
+	case r == nil:
+		members = zset.RangeByRank(startRank, stopRank, opts.rev)
+	case !opts.limit:
+		members = zset.rangeBy(r, opts.rev, 0, -1)
+	case opts.offset >= 0:
+		members = zset.rangeBy(r, opts.rev, opts.offset, opts.count)
+	}
+	return scoredReply(client, members, opts.withScores), nil
+}
+
+func (h *DefaultHandler) Zrange(client *Client, key, start, stop string, options ...string) (ReplyWriter, error) {
+	opts, err := parseZrangeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return h.zrange(client, key, start, stop, opts)
+}
+
+func (h *DefaultHandler) Zrangebyscore(client *Client, key, min, max string, options ...string) (ReplyWriter, error) {
+	opts, err := parseZrangeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if opts.byScore || opts.byLex || opts.rev {
+		return nil, ErrSyntax
+	}
+	opts.byScore = true
+	return h.zrange(client, key, min, max, opts)
+}
+
+// zremRange removes the members of the sorted set at key selected by remove.
+func (h *DefaultHandler) zremRange(client *Client, key string, remove func(*SortedSet) int) (int, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeZSet, key); err != nil {
+		return 0, err
+	}
+	zset := db.zset(key, false)
+	if zset == nil {
+		return 0, nil
+	}
+	removed := remove(zset)
+	if zset.Len() == 0 {
+		db.remove(key)
+	}
+	return removed, nil
+}
+
+func (h *DefaultHandler) Zremrangebyscore(client *Client, key, min, max string) (int, error) {
+	r, err := parseScoreRange(min, max)
+	if err != nil {
+		return 0, err
+	}
+	return h.zremRange(client, key, func(zset *SortedSet) int { return zset.removeRange(r) })
+}
+
+func (h *DefaultHandler) Zremrangebylex(client *Client, key, min, max string) (int, error) {
+	r, err := parseLexRange(min, max)
+	if err != nil {
+		return 0, err
+	}
+	return h.zremRange(client, key, func(zset *SortedSet) int { return zset.removeRange(r) })
+}
+
+func (h *DefaultHandler) Zremrangebyrank(client *Client, key string, start, stop int) (int, error) {
+	return h.zremRange(client, key, func(zset *SortedSet) int { return zset.removeRangeByRank(start, stop) })
+}
+
+// zpop removes and returns the count members of the sorted set at key with
+// the lowest scores, or the highest ones if max is set.
+// The shard owning key must be write-locked.
+func (db *Database) zpop(key string, max bool, count int) ([]ScoredMember, error) {
+	if err := db.checkType(typeZSet, key); err != nil {
+		return nil, err
+	}
+	zset := db.zset(key, false)
+	if zset == nil || count <= 0 {
+		return nil, nil
+	}
+	popped := zset.RangeByRank(0, count-1, max)
+	for _, m := range popped {
+		zset.Remove(m.Member)
+	}
+	if zset.Len() == 0 {
+		db.remove(key)
+	}
+	return popped, nil
+}
+
+func (h *DefaultHandler) zpop(client *Client, key string, max bool, count []string) (ReplyWriter, error) {
+	n := 1
+	if len(count) > 0 {
+		var err error
+		if n, err = parseSetCount(count); err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, NewError("value is out of range, must be positive")
+		}
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	popped, err := db.zpop(key, max, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(count) == 0 {
+		// A single member is always replied as a flat pair.
+		values := []interface{}{}
+		for _, m := range popped {
+			values = append(values, []byte(m.Member), &DoubleReply{value: m.Score})
+		}
+		return &MultiBulkReply{values: values}, nil
+	}
+	return scoredReply(client, popped, true), nil
+}
+
+func (h *DefaultHandler) Zpopmin(client *Client, key string, count ...string) (ReplyWriter, error) {
+	return h.zpop(client, key, false, count)
+}
+
+func (h *DefaultHandler) Zpopmax(client *Client, key string, count ...string) (ReplyWriter, error) {
+	return h.zpop(client, key, true, count)
+}
+
+// parseTimeout parses the timeout of blocking commands, in seconds with
+// an optional fractional part.
+func parseTimeout(timeout string) (time.Duration, error) {
+	d, ok := parseSeconds(timeout)
+	if !ok {
+		return 0, ErrInvalidTimeout
+	}
+	if d < 0 {
+		return 0, NewError("timeout is negative")
+	}
+	return d, nil
+}
+
+// bzpop is zpop of a single member waiting for one of the sorted sets at
+// keys to receive a member, the last argument being the timeout.
+func (h *DefaultHandler) bzpop(client *Client, args []string, max bool) (ReplyWriter, error) {
+	if len(args) < 2 {
+		return nil, ErrWrongArgsNumber
+	}
+	keys := args[:len(args)-1]
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+	db, unlock := h.lockDb(client, keys...)
+	blocked := &db.waiters.blocked
+	unlock()
+	reply, err := blocked.Block(client, keys, timeout, func() (ReplyWriter, error) {
+		for _, key := range keys {
+			db, unlock := h.lockDb(client, key)
+			popped, err := db.zpop(key, max, 1)
+			unlock()
+			if err != nil {
+				return nil, err
+			}
+			if len(popped) > 0 {
+				return &MultiBulkReply{values: []interface{}{
+					[]byte(key), []byte(popped[0].Member), &DoubleReply{value: popped[0].Score},
+				}}, nil
+			}
+		}
+		return nil, nil
+	})
+	if reply == nil && err == nil {
+		return NewNullArrayReply(), nil
+	}
+	return reply, err
+}
+
+func (h *DefaultHandler) Bzpopmin(client *Client, key string, args ...string) (ReplyWriter, error) {
+	return h.bzpop(client, append([]string{key}, args...), false)
+}
+
+func (h *DefaultHandler) Bzpopmax(client *Client, key string, args ...string) (ReplyWriter, error) {
+	return h.bzpop(client, append([]string{key}, args...), true)
+}
+
+// zsetScores returns the scores of the members of the sorted set at key. The
+// members of a set score 1.
+// The shard owning key must be locked.
+func (db *Database) zsetScores(key string) (map[string]float64, error) {
+	if t := db.keyType(key); t != typeNone && t != typeZSet && t != typeSet {
+		return nil, ErrWrongType
+	}
+	scores := make(map[string]float64)
+	if zset := db.zset(key, false); zset != nil {
+		for m, score := range zset.scores {
+			scores[m] = score
+		}
+	}
+	for m := range db.set(key, false) {
+		scores[m] = 1
+	}
+	return scores, nil
+}
+
+// zstore stores at destination the union or intersection of the sorted sets
+// at the numkeys keys starting args, with the WEIGHTS and AGGREGATE options
+// following them, and returns the size of the result.
+func (h *DefaultHandler) zstore(client *Client, destination, numkeys string, args []string, union bool) (int, error) {
+	n, err := strconv.Atoi(numkeys)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	if n < 1 {
+		return 0, NewError("at least 1 input key is needed for ZUNIONSTORE/ZINTERSTORE")
+	}
+	if n > len(args) {
+		return 0, ErrSyntax
+	}
+	keys, options := args[:n], args[n:]
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := func(a, b float64) float64 { return a + b }
+	for i := 0; i < len(options); {
+		switch strings.ToUpper(options[i]) {
+		case "WEIGHTS":
+			if i+n >= len(options) {
+				return 0, ErrSyntax
+			}
+			for j := range weights {
+				var ok bool
+				if weights[j], ok = parseScore(options[i+1+j]); !ok {
+					return 0, NewError("weight value is not a float")
+				}
+			}
+			i += n + 1
+		case "AGGREGATE":
+			if i+1 >= len(options) {
+				return 0, ErrSyntax
+			}
+			switch strings.ToUpper(options[i+1]) {
+			case "SUM":
+				aggregate = func(a, b float64) float64 { return a + b }
+			case "MIN":
+				aggregate = math.Min
+			case "MAX":
+				aggregate = math.Max
+			default:
+				return 0, ErrSyntax
+			}
+			i += 2
+		default:
+			return 0, ErrSyntax
+		}
+	}
+	// inf - inf and 0 * inf are NaN, which redis turns into 0.
+	combine := func(a, b float64) float64 {
+		if v := aggregate(a, b); !math.IsNaN(v) {
+			return v
+		}
+		return 0
+	}
+	weighted := func(score, weight float64) float64 {
+		if v := score * weight; !math.IsNaN(v) {
+			return v
+		}
+		return 0
+	}
+
+	db := h.db(client)
+	defer db.lock(append(keys, destination)...)()
+
+	var result map[string]float64
+	for i, key := range keys {
+		scores, err := db.zsetScores(key)
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			result = make(map[string]float64, len(scores))
+			for m, score := range scores {
+				result[m] = weighted(score, weights[i])
+			}
+			continue
+		}
+		if union {
+			for m, score := range scores {
+				if acc, exists := result[m]; exists {
+					result[m] = combine(acc, weighted(score, weights[i]))
+				} else {
+					result[m] = weighted(score, weights[i])
+				}
+			}
+			continue
+		}
+		for m, acc := range result {
+			if score, exists := scores[m]; exists {
+				result[m] = combine(acc, weighted(score, weights[i]))
+			} else {
+				delete(result, m)
+			}
+		}
+	}
+
+	db.remove(destination)
+	if len(result) > 0 {
+		zset := db.zset(destination, true)
+		for m, score := range result {
+			zset.Add(m, score)
+		}
+		db.waiters.blocked.Signal(destination)
+	}
+	return len(result), nil
+}
+
+func (h *DefaultHandler) Zunionstore(client *Client, destination, numkeys string, args ...string) (int, error) {
+	return h.zstore(client, destination, numkeys, args, true)
+}
+
+func (h *DefaultHandler) Zinterstore(client *Client, destination, numkeys string, args ...string) (int, error) {
+	return h.zstore(client, destination, numkeys, args, false)
+}
+
+func (h *DefaultHandler) Get(client *Client, key string) ([]byte, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return nil, err
+	}
+	if db.expired(key) {
+		return nil, nil
+	}
+	v, _ := db.str(key)
+	return v, nil
+}
+
+type setOptions struct {
+	nx, xx, get, keepTTL bool
+	expire               func(now time.Time) time.Time // nil without EX, PX, EXAT or PXAT
+}
+
+func parseSetOptions(options []string) (setOptions, error) {
+	var opts setOptions
+	for i := 0; i < len(options); i++ {
+		switch option := strings.ToUpper(options[i]); option {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GET":
+			opts.get = true
+		case "KEEPTTL":
+			if opts.expire != nil {
+				return opts, ErrSyntax
+			}
+			opts.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if opts.expire != nil || opts.keepTTL || i+1 == len(options) {
+				return opts, ErrSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(options[i], 10, 64)
+			if err != nil {
+				return opts, ErrExpectInteger
+			}
+			if n <= 0 {
+				return opts, NewError("invalid expire time in 'set' command")
+			}
+			if opts.expire, err = expireFunc("set", option, n); err != nil {
+				return opts, err
+			}
+		default:
+			return opts, ErrSyntax
+		}
+	}
+	if opts.nx && opts.xx {
+		return opts, ErrSyntax
+	}
+	return opts, nil
+}
 
-	values  HashValue
-	hvalues HashHash
-	brstack HashBrStack
+// expireFunc returns the expiration time of a key for the EX, PX, EXAT and
+// PXAT options, or the EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT commands. It
+// returns an "invalid expire time" error, naming command, if n is out of
+// range for unit.
+func expireFunc(command, unit string, n int64) (func(now time.Time) time.Time, error) {
+	var max int64
+	switch unit {
+	case "EX":
+		max = math.MaxInt64 / int64(time.Second)
+	case "PX":
+		max = math.MaxInt64 / int64(time.Millisecond)
+	case "EXAT":
+		// Timestamps must be representable in milliseconds.
+		max = math.MaxInt64 / 1000
+	default:
+		max = math.MaxInt64
+	}
+	if n > max || n < -max {
+		return nil, NewError(fmt.Sprintf("invalid expire time in '%s' command", command))
+	}
 
-	sub HashSub
+	switch unit {
+	case "EX":
+		return func(now time.Time) time.Time { return now.Add(time.Duration(n) * time.Second) }, nil
+	case "PX":
+		return func(now time.Time) time.Time { return now.Add(time.Duration(n) * time.Millisecond) }, nil
+	case "EXAT":
+		return func(time.Time) time.Time { return time.Unix(n, 0) }, nil
+	default:
+		return func(time.Time) time.Time { return time.Unix(n/1000, n%1000*int64(time.Millisecond)) }, nil
+	}
 }
 
-func NewDatabase(parent *Database) *Database {
-	db := &Database{
-		values:   make(HashValue),
-		sub:      make(HashSub),
-		brstack:  make(HashBrStack),
-		children: map[int]*Database{},
-		parent:   parent,
+// Set stores value at key. The EX, PX, EXAT and PXAT options set an
+// expiration, which is otherwise cleared unless KEEPTTL is given. With NX
+// (resp. XX) the value is only set if key does not exist (resp. exists).
+// GET replies with the previous value instead of OK.
+func (h *DefaultHandler) Set(client *Client, key string, value []byte, options ...string) (ReplyWriter, error) {
+	opts, err := parseSetOptions(options)
+	if err != nil {
+		return nil, err
 	}
-	db.children[0] = db
-	return db
+	return h.set(client, key, value, opts)
 }
 
-type DefaultHandler struct {
-	*Database
-	currentDb int
-	dbs       map[int]*Database
-}
+// set stores value at key, replacing any value of another type unless the
+// previous value is to be returned.
+func (h *DefaultHandler) set(client *Client, key string, value []byte, opts setOptions) (ReplyWriter, error) {
+	db := h.db(client)
+	defer db.lock(key)()
 
-func (h *DefaultHandler) Rpush(key string, value []byte, values ...[]byte) (int, error) {
-	values = append([][]byte{value}, values...)
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
+	db.removeIfExpired(key)
+	if opts.get {
+		if err := db.checkType(typeString, key); err != nil {
+			return nil, err
+		}
 	}
-	if _, exists := h.brstack[key]; !exists {
-		h.brstack[key] = NewStack(key)
+	old, _ := db.str(key)
+	if (opts.nx && db.exists(key)) || (opts.xx && !db.exists(key)) {
+		if opts.get {
+			return &BulkReply{value: old}, nil
+		}
+		return &BulkReply{}, nil
 	}
-	for _, value := range values {
-		h.brstack[key].PushBack(value)
+	db.store(key, value)
+	if opts.expire != nil {
+		db.setExpire(key, opts.expire(db.now()))
+	} else if !opts.keepTTL {
+		db.persist(key)
 	}
-	return h.brstack[key].Len(), nil
+	if opts.get {
+		return &BulkReply{value: old}, nil
+	}
+	return &StatusReply{code: "OK"}, nil
 }
 
-func (h *DefaultHandler) Brpop(key string, keys ...string) (data [][]byte, err error) {
-	keys = append([]string{key}, keys...)
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
+// Setex sets key to value with an expiration of seconds.
+func (h *DefaultHandler) Setex(client *Client, key string, seconds int, value []byte) error {
+	if seconds <= 0 {
+		return NewError("invalid expire time in 'setex' command")
 	}
-
-	if len(keys) == 0 {
-		return nil, ErrParseTimeout
+	expire, err := expireFunc("setex", "EX", int64(seconds))
+	if err != nil {
+		return err
 	}
+	_, err = h.set(client, key, value, setOptions{expire: expire})
+	return err
+}
 
-	timeout, err := strconv.Atoi(keys[len(keys)-1])
+// Psetex sets key to value with an expiration of milliseconds.
+func (h *DefaultHandler) Psetex(client *Client, key string, milliseconds int, value []byte) error {
+	if milliseconds <= 0 {
+		return NewError("invalid expire time in 'psetex' command")
+	}
+	expire, err := expireFunc("psetex", "PX", int64(milliseconds))
 	if err != nil {
-		return nil, ErrParseTimeout
+		return err
 	}
-	keys = keys[:len(keys)-1]
+	_, err = h.set(client, key, value, setOptions{expire: expire})
+	return err
+}
 
-	var timeoutChan <-chan time.Time
-	if timeout > 0 {
-		timeoutChan = time.After(time.Duration(timeout) * time.Second)
+// expire sets the expiration of key, deleting it right away if the time is
+// already past. It returns 0 if the key does not exist.
+func (h *DefaultHandler) expire(client *Client, key string, at func(now time.Time) time.Time) int {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	db.removeIfExpired(key)
+	if !db.exists(key) {
+		return 0
+	}
+	now := db.now()
+	if t := at(now); t.After(now) {
+		db.setExpire(key, t)
 	} else {
-		timeoutChan = make(chan time.Time)
+		db.remove(key)
 	}
+	return 1
+}
 
-	finishedChan := make(chan struct{})
-	go func() {
-		defer close(finishedChan)
-		selectCases := []reflect.SelectCase{}
-		for _, k := range keys {
-			key := string(k)
-			if _, exists := h.brstack[key]; !exists {
-				h.brstack[key] = NewStack(k)
-			}
-			selectCases = append(selectCases, reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: reflect.ValueOf(h.brstack[key].Chan),
-			})
-		}
-		_, recv, _ := reflect.Select(selectCases)
-		s, ok := recv.Interface().(*Stack)
-		if !ok {
-			err = fmt.Errorf("Impossible to retrieve data. Wrong type.")
-			return
-		}
-		data = [][]byte{[]byte(s.Key), s.PopBack()}
-	}()
-
-	select {
-	case <-finishedChan:
-		return data, err
-	case <-timeoutChan:
-		return nil, nil
+func (h *DefaultHandler) Expire(client *Client, key string, seconds int) (int, error) {
+	at, err := expireFunc("expire", "EX", int64(seconds))
+	if err != nil {
+		return 0, err
 	}
-	return nil, nil
+	return h.expire(client, key, at), nil
 }
 
-func (h *DefaultHandler) Lrange(key string, start, stop int) ([][]byte, error) {
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
-	}
-	if _, exists := h.brstack[key]; !exists {
-		h.brstack[key] = NewStack(key)
+func (h *DefaultHandler) Pexpire(client *Client, key string, milliseconds int) (int, error) {
+	at, err := expireFunc("pexpire", "PX", int64(milliseconds))
+	if err != nil {
+		return 0, err
 	}
+	return h.expire(client, key, at), nil
+}
 
-	if start < 0 {
-		if start = h.brstack[key].Len() + start; start < 0 {
-			start = 0
-		}
+func (h *DefaultHandler) Expireat(client *Client, key string, timestamp int) (int, error) {
+	at, err := expireFunc("expireat", "EXAT", int64(timestamp))
+	if err != nil {
+		return 0, err
 	}
+	return h.expire(client, key, at), nil
+}
 
-	var ret [][]byte
-	for i := start; i <= stop; i++ {
-		if val := h.brstack[key].GetIndex(i); val != nil {
-			ret = append(ret, val)
-		}
+func (h *DefaultHandler) Pexpireat(client *Client, key string, timestamp int) (int, error) {
+	at, err := expireFunc("pexpireat", "PXAT", int64(timestamp))
+	if err != nil {
+		return 0, err
 	}
-	return ret, nil
+	return h.expire(client, key, at), nil
 }
 
-func (h *DefaultHandler) Lindex(key string, index int) ([]byte, error) {
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
+// ttl returns the time to live of key rounded to unit, -2 if the key does
+// not exist and -1 if it has no expiration.
+func (h *DefaultHandler) ttl(client *Client, key string, unit time.Duration) int {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if !db.exists(key) {
+		return -2
 	}
-	if _, exists := h.brstack[key]; !exists {
-		h.brstack[key] = NewStack(key)
+	t, volatile := db.expiration(key)
+	if !volatile {
+		return -1
 	}
-	return h.brstack[key].GetIndex(index), nil
+	return int((t.Sub(db.now()) + unit/2) / unit)
 }
 
-func (h *DefaultHandler) Lpush(key string, value []byte, values ...[]byte) (int, error) {
-	values = append([][]byte{value}, values...)
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
+func (h *DefaultHandler) Ttl(client *Client, key string) (int, error) {
+	return h.ttl(client, key, time.Second), nil
+}
+
+func (h *DefaultHandler) Pttl(client *Client, key string) (int, error) {
+	return h.ttl(client, key, time.Millisecond), nil
+}
+
+// Persist removes the expiration of key. It returns 0 if the key does not
+// exist or has no expiration.
+func (h *DefaultHandler) Persist(client *Client, key string) (int, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	db.removeIfExpired(key)
+	if db.persist(key) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// maxStringLength is the maximum size of a string value, like the redis
+// proto-max-bulk-len default.
+const maxStringLength = 512 * 1024 * 1024
+
+// incrBy adds increment to the integer stored at key, which is set to 0
+// first if it does not exist. The expiration of key is kept.
+func (h *DefaultHandler) incrBy(client *Client, key string, increment int64) (int, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return 0, err
 	}
-	if _, exists := h.brstack[key]; !exists {
-		h.brstack[key] = NewStack(key)
+	db.removeIfExpired(key)
+	var n int64
+	if v, exists := db.str(key); exists {
+		var err error
+		if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
 	}
-	for _, value := range values {
-		h.brstack[key].PushFront(value)
+	if (increment > 0 && n > math.MaxInt64-increment) || (increment < 0 && n < math.MinInt64-increment) {
+		return 0, ErrOverflow
 	}
-	return h.brstack[key].Len(), nil
+	n += increment
+	db.setString(key, []byte(strconv.FormatInt(n, 10)))
+	return int(n), nil
 }
 
-func (h *DefaultHandler) Blpop(key string, keys ...string) (data [][]byte, err error) {
-	keys = append([]string{key}, keys...)
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
+func parseIncrement(increment string) (int64, error) {
+	n, err := strconv.ParseInt(increment, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
 	}
+	return n, nil
+}
+
+func (h *DefaultHandler) Incr(client *Client, key string) (int, error) {
+	return h.incrBy(client, key, 1)
+}
+
+func (h *DefaultHandler) Decr(client *Client, key string) (int, error) {
+	return h.incrBy(client, key, -1)
+}
 
-	if len(keys) == 0 {
-		return nil, ErrParseTimeout
+func (h *DefaultHandler) Incrby(client *Client, key, increment string) (int, error) {
+	n, err := parseIncrement(increment)
+	if err != nil {
+		return 0, err
 	}
+	return h.incrBy(client, key, n)
+}
 
-	timeout, err := strconv.Atoi(keys[len(keys)-1])
+func (h *DefaultHandler) Decrby(client *Client, key, decrement string) (int, error) {
+	n, err := parseIncrement(decrement)
 	if err != nil {
-		return nil, ErrParseTimeout
+		return 0, err
+	}
+	if n == math.MinInt64 {
+		return 0, ErrOverflow
 	}
-	keys = keys[:len(keys)-1]
+	return h.incrBy(client, key, -n)
+}
 
-	var timeoutChan <-chan time.Time
-	if timeout > 0 {
-		timeoutChan = time.After(time.Duration(timeout) * time.Second)
-	} else {
-		timeoutChan = make(chan time.Time)
+// parseFloat parses a float the way redis does, refusing NaN and infinity.
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
 	}
+	return f, true
+}
 
-	finishedChan := make(chan struct{})
+// Incrbyfloat adds increment to the float stored at key and replies with
+// the new value.
+func (h *DefaultHandler) Incrbyfloat(client *Client, key, increment string) ([]byte, error) {
+	incr, ok := parseFloat(increment)
+	if !ok {
+		return nil, ErrNotFloat
+	}
 
-	go func() {
-		defer close(finishedChan)
-		selectCases := []reflect.SelectCase{}
-		for _, k := range keys {
-			key := string(k)
-			if _, exists := h.brstack[key]; !exists {
-				h.brstack[key] = NewStack(k)
-			}
-			selectCases = append(selectCases, reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: reflect.ValueOf(h.brstack[key].Chan),
-			})
-		}
-		_, recv, _ := reflect.Select(selectCases)
-		s, ok := recv.Interface().(*Stack)
-		if !ok {
-			err = fmt.Errorf("Impossible to retrieve data. Wrong type.")
-			return
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return nil, err
+	}
+	db.removeIfExpired(key)
+	var f float64
+	if v, exists := db.str(key); exists {
+		if f, ok = parseFloat(string(v)); !ok {
+			return nil, ErrNotFloat
 		}
-		data = [][]byte{[]byte(s.Key), s.PopFront()}
-	}()
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, ErrNaN
+	}
+	value := []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	db.setString(key, value)
+	return value, nil
+}
 
-	select {
-	case <-finishedChan:
-		return data, err
-	case <-timeoutChan:
-		return nil, nil
+// Append adds value at the end of the string stored at key and returns
+// its new length.
+func (h *DefaultHandler) Append(client *Client, key string, value []byte) (int, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return 0, err
 	}
-	return nil, nil
+	db.removeIfExpired(key)
+	old, _ := db.str(key)
+	if len(old)+len(value) > maxStringLength {
+		return 0, ErrStringTooLong
+	}
+	// Copy: old may be shared with a reply being written.
+	v := make([]byte, 0, len(old)+len(value))
+	v = append(append(v, old...), value...)
+	db.setString(key, v)
+	return len(v), nil
+}
+
+func (h *DefaultHandler) Strlen(client *Client, key string) (int, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return 0, err
+	}
+	if db.expired(key) {
+		return 0, nil
+	}
+	v, _ := db.str(key)
+	return len(v), nil
 }
 
-func (h *DefaultHandler) Hget(key, subkey string) ([]byte, error) {
-	if h.Database == nil || h.hvalues == nil {
+// Getrange returns the substring of the value at key between start and end,
+// both included. Negative offsets count from the end of the string.
+func (h *DefaultHandler) Getrange(client *Client, key string, start, end int) ([]byte, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return nil, err
+	}
+	if db.expired(key) {
+		return nil, nil
+	}
+	v, _ := db.str(key)
+	if start < 0 && end < 0 && start > end {
+		return nil, nil
+	}
+	if start < 0 {
+		start += len(v)
+	}
+	if end < 0 {
+		end += len(v)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= len(v) {
+		end = len(v) - 1
+	}
+	if start > end || len(v) == 0 {
 		return nil, nil
 	}
+	return v[start : end+1], nil
+}
 
-	if v, exists := h.hvalues[key]; exists {
-		if v, exists := v[subkey]; exists {
-			return v, nil
-		}
+// Setrange overwrites the value at key from offset, padding it with zero
+// bytes if needed, and returns its new length.
+func (h *DefaultHandler) Setrange(client *Client, key string, offset int, value []byte) (int, error) {
+	if offset < 0 {
+		return 0, ErrOffsetOutOfRange
 	}
-	return nil, nil
+	if offset+len(value) > maxStringLength {
+		return 0, ErrStringTooLong
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return 0, err
+	}
+	db.removeIfExpired(key)
+	old, _ := db.str(key)
+	if len(value) == 0 {
+		return len(old), nil
+	}
+	size := len(old)
+	if offset+len(value) > size {
+		size = offset + len(value)
+	}
+	v := make([]byte, size)
+	copy(v, old)
+	copy(v[offset:], value)
+	db.setString(key, v)
+	return len(v), nil
 }
 
-func (h *DefaultHandler) Hset(key, subkey string, value []byte) (int, error) {
-	ret := 0
+func (h *DefaultHandler) Mget(client *Client, key string, keys ...string) ([][]byte, error) {
+	keys = append([]string{key}, keys...)
+	db := h.db(client)
+	defer db.rlock(keys...)()
 
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i], _ = db.str(k)
 	}
-	if _, exists := h.hvalues[key]; !exists {
-		h.hvalues[key] = make(HashValue)
-		ret = 1
+	return values, nil
+}
+
+// mset sets all the values, clearing their expiration. When nx is set,
+// nothing is set if one of the keys exists.
+func (h *DefaultHandler) mset(client *Client, values map[string][]byte, nx bool) bool {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
 	}
+	db := h.db(client)
+	defer db.lock(keys...)()
 
-	if _, exists := h.hvalues[key][subkey]; !exists {
-		ret = 1
+	for _, k := range keys {
+		db.removeIfExpired(k)
+		if nx && db.exists(k) {
+			return false
+		}
+	}
+	for k, v := range values {
+		db.store(k, v)
+		db.persist(k)
 	}
+	return true
+}
+
+func (h *DefaultHandler) Mset(client *Client, values map[string][]byte) error {
+	h.mset(client, values, false)
+	return nil
+}
 
-	h.hvalues[key][subkey] = value
+func (h *DefaultHandler) Msetnx(client *Client, values map[string][]byte) (int, error) {
+	if h.mset(client, values, true) {
+		return 1, nil
+	}
+	return 0, nil
+}
 
-	return ret, nil
+func (h *DefaultHandler) Setnx(client *Client, key string, value []byte) (int, error) {
+	reply, err := h.set(client, key, value, setOptions{nx: true})
+	if _, ok := reply.(*StatusReply); ok {
+		return 1, nil
+	}
+	return 0, err
 }
 
-func (h *DefaultHandler) Hgetall(key string) (HashValue, error) {
-	if h.Database == nil || h.hvalues == nil {
-		return nil, nil
+func (h *DefaultHandler) Getset(client *Client, key string, value []byte) ([]byte, error) {
+	reply, err := h.set(client, key, value, setOptions{get: true})
+	if err != nil {
+		return nil, err
 	}
-	return h.hvalues[key], nil
+	return reply.(*BulkReply).value, nil
 }
 
-func (h *DefaultHandler) Get(key string) ([]byte, error) {
-	if h.Database == nil || h.values == nil {
-		return nil, nil
+func (h *DefaultHandler) Getdel(client *Client, key string) ([]byte, error) {
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return nil, err
 	}
-	return h.values[key], nil
+	db.removeIfExpired(key)
+	v, exists := db.str(key)
+	if exists {
+		db.remove(key)
+	}
+	return v, nil
 }
 
-func (h *DefaultHandler) Set(key string, value []byte) error {
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
+// Getex returns the value at key like GET, and sets its expiration with the
+// EX, PX, EXAT or PXAT options, or removes it with PERSIST.
+func (h *DefaultHandler) Getex(client *Client, key string, options ...string) ([]byte, error) {
+	var expire func(now time.Time) time.Time
+	persist := false
+	for i := 0; i < len(options); i++ {
+		switch option := strings.ToUpper(options[i]); option {
+		case "PERSIST":
+			if expire != nil {
+				return nil, ErrSyntax
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expire != nil || persist || i+1 == len(options) {
+				return nil, ErrSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(options[i], 10, 64)
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+			if n <= 0 {
+				return nil, NewError("invalid expire time in 'getex' command")
+			}
+			if expire, err = expireFunc("getex", option, n); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	db := h.db(client)
+	defer db.lock(key)()
+
+	if err := db.checkType(typeString, key); err != nil {
+		return nil, err
 	}
-	h.values[key] = value
-	return nil
+	db.removeIfExpired(key)
+	v, exists := db.str(key)
+	if !exists {
+		return nil, nil
+	}
+	if expire != nil {
+		if now := db.now(); expire(now).After(now) {
+			db.setExpire(key, expire(now))
+		} else {
+			db.remove(key)
+		}
+	} else if persist {
+		db.persist(key)
+	}
+	return v, nil
 }
 
-func (h *DefaultHandler) Del(key string, keys ...string) (int, error) {
+func (h *DefaultHandler) Del(client *Client, key string, keys ...string) (int, error) {
 	keys = append([]string{key}, keys...)
-	if h.Database == nil {
-		return 0, nil
-	}
+	db := h.db(client)
+	defer db.lock(keys...)()
+
 	count := 0
 	for _, k := range keys {
-		if _, exists := h.values[k]; exists {
-			delete(h.values, k)
+		if db.exists(k) {
 			count++
 		}
-		if _, exists := h.hvalues[key]; exists {
-			delete(h.hvalues, k)
+		db.remove(k)
+	}
+	return count, nil
+}
+
+// Unlink is Del: values are freed by the garbage collector anyway.
+func (h *DefaultHandler) Unlink(client *Client, key string, keys ...string) (int, error) {
+	return h.Del(client, key, keys...)
+}
+
+// Exists returns the number of keys that exist, counting a key as many times
+// as it is given.
+func (h *DefaultHandler) Exists(client *Client, key string, keys ...string) (int, error) {
+	keys = append([]string{key}, keys...)
+	db := h.db(client)
+	defer db.rlock(keys...)()
+
+	count := 0
+	for _, k := range keys {
+		if db.exists(k) {
 			count++
 		}
 	}
 	return count, nil
 }
 
+// Touch returns the number of keys that exist. There is no access time to
+// update.
+func (h *DefaultHandler) Touch(client *Client, key string, keys ...string) (int, error) {
+	return h.Exists(client, key, keys...)
+}
+
+func (h *DefaultHandler) Type(client *Client, key string) (*StatusReply, error) {
+	db := h.db(client)
+	defer db.rlock(key)()
+
+	return &StatusReply{code: db.keyType(key)}, nil
+}
+
+// rename moves the value of key to newkey along with its expiration. With
+// nx it does nothing if newkey exists, returning false.
+func (h *DefaultHandler) rename(client *Client, key, newkey string, nx bool) (bool, error) {
+	db := h.db(client)
+	defer db.lock(key, newkey)()
+
+	db.removeIfExpired(key)
+	db.removeIfExpired(newkey)
+	v := db.value(key)
+	if v == nil {
+		return false, ErrNoSuchKey
+	}
+	if key == newkey {
+		return !nx, nil
+	}
+	if nx && db.exists(newkey) {
+		return false, nil
+	}
+	t, volatile := db.expiration(key)
+	db.remove(newkey)
+	db.store(newkey, v)
+	h.handOff(client, db, newkey)
+	db.remove(key)
+	if volatile {
+		db.setExpire(newkey, t)
+	}
+	return true, nil
+}
+
+func (h *DefaultHandler) Rename(client *Client, key, newkey string) error {
+	_, err := h.rename(client, key, newkey, false)
+	return err
+}
+
+func (h *DefaultHandler) Renamenx(client *Client, key, newkey string) (int, error) {
+	renamed, err := h.rename(client, key, newkey, true)
+	if renamed {
+		return 1, err
+	}
+	return 0, err
+}
+
+// Copy copies the value of source to destination, in the selected database
+// or the one given with the DB option. It does nothing if destination
+// exists, unless REPLACE is given.
+func (h *DefaultHandler) Copy(client *Client, source, destination string, options ...string) (int, error) {
+	index, replace := client.Db, false
+	for i := 0; i < len(options); i++ {
+		switch strings.ToUpper(options[i]) {
+		case "DB":
+			if i+1 == len(options) {
+				return 0, ErrSyntax
+			}
+			i++
+			var err error
+			if index, err = h.parseDbIndex(options[i]); err != nil {
+				return 0, err
+			}
+		case "REPLACE":
+			replace = true
+		default:
+			return 0, ErrSyntax
+		}
+	}
+	if index == client.Db && source == destination {
+		return 0, ErrSameObject
+	}
+	src, dst := h.db(client), h.dbAt(index)
+	defer lockShards(false, src.shard(source), dst.shard(destination))()
+
+	src.removeIfExpired(source)
+	dst.removeIfExpired(destination)
+	v := src.value(source)
+	if v == nil || (dst.exists(destination) && !replace) {
+		return 0, nil
+	}
+	dst.remove(destination)
+	dst.store(destination, copyValue(v))
+	h.handOff(client, dst, destination)
+	if t, volatile := src.expiration(source); volatile {
+		dst.setExpire(destination, t)
+	}
+	return 1, nil
+}
+
 func (h *DefaultHandler) Ping() (*StatusReply, error) {
 	return &StatusReply{code: "PONG"}, nil
 }
 
-func (h *DefaultHandler) Subscribe(channels ...[]byte) (*MultiChannelWriter, error) {
-	if h.Database == nil {
-		h.Database = NewDatabase(nil)
+func (h *DefaultHandler) subscriberBuffer() int {
+	if h.SubscriberBuffer <= 0 {
+		return DefaultSubscriberBuffer
 	}
-	ret := &MultiChannelWriter{Chans: make([]*ChannelWriter, 0, len(channels))}
-	for _, key := range channels {
-		Debugf("SUBSCRIBE on %s\n", key)
-		cw := &ChannelWriter{
-			FirstReply: []interface{}{
-				"subscribe",
-				key,
-				1,
-			},
-			Channel: make(chan []interface{}),
+	return h.SubscriberBuffer
+}
+
+func (h *DefaultHandler) Subscribe(client *Client, channel string, channels ...string) (*MultiChannelWriter, error) {
+	return h.pubsub.subscribe(client, false, append([]string{channel}, channels...), h.subscriberBuffer()), nil
+}
+
+func (h *DefaultHandler) Psubscribe(client *Client, pattern string, patterns ...string) (*MultiChannelWriter, error) {
+	return h.pubsub.subscribe(client, true, append([]string{pattern}, patterns...), h.subscriberBuffer()), nil
+}
+
+func (h *DefaultHandler) Unsubscribe(client *Client, channels ...string) (*MultiChannelWriter, error) {
+	return h.pubsub.unsubscribe(client, false, channels), nil
+}
+
+func (h *DefaultHandler) Punsubscribe(client *Client, patterns ...string) (*MultiChannelWriter, error) {
+	return h.pubsub.unsubscribe(client, true, patterns), nil
+}
+
+func (h *DefaultHandler) Publish(channel string, message []byte) (int, error) {
+	return h.pubsub.publish(channel, message, h.SlowConsumers, &h.PubSubStats), nil
+}
+
+// Pubsub implements PUBSUB CHANNELS, NUMSUB and NUMPAT.
+func (h *DefaultHandler) Pubsub(subcommand string, args ...string) (ReplyWriter, error) {
+	switch sub := strings.ToLower(subcommand); {
+	case sub == "channels" && len(args) <= 1:
+		pattern := ""
+		if len(args) == 1 {
+			pattern = args[0]
 		}
-		if h.sub[string(key)] == nil {
-			h.sub[string(key)] = []*ChannelWriter{cw}
-		} else {
-			h.sub[string(key)] = append(h.sub[string(key)], cw)
+		values := []interface{}{}
+		for _, name := range h.pubsub.activeChannels(pattern) {
+			values = append(values, []byte(name))
+		}
+		return &MultiBulkReply{values: values}, nil
+	case sub == "numsub":
+		values := make([]interface{}, 0, 2*len(args))
+		for _, channel := range args {
+			values = append(values, []byte(channel), h.pubsub.numsub(channel))
 		}
-		ret.Chans = append(ret.Chans, cw)
+		return &MultiBulkReply{values: values}, nil
+	case sub == "numpat" && len(args) == 0:
+		return &IntegerReply{number: h.pubsub.numpat()}, nil
 	}
-	return ret, nil
+	return NewError(fmt.Sprintf("Unknown subcommand or wrong number of arguments for '%s'", subcommand)), nil
 }
 
-func (h *DefaultHandler) Publish(key string, value []byte) (int, error) {
-	if h.Database == nil || h.sub == nil {
-		return 0, nil
+// Select changes the database of the calling connection only.
+func (h *DefaultHandler) Select(client *Client, index string) error {
+	i, err := h.parseDbIndex(index)
+	if err != nil {
+		return err
 	}
-	//	Debugf("Publishing %s on %s\n", value, key)
-	v, exists := h.sub[key]
-	if !exists {
-		return 0, nil
+	client.Db = i
+	return nil
+}
+
+// Swapdb exchanges the content of two databases. Connections that selected
+// one of them see the data of the other one right away.
+func (h *DefaultHandler) Swapdb(client *Client, index1, index2 string) error {
+	i1, err := h.parseDbIndex(index1)
+	if err != nil {
+		return err
 	}
-	i := 0
-	for _, c := range v {
-		select {
-		case c.Channel <- []interface{}{
-			"message",
-			key,
-			value,
-		}:
-			i++
-		default:
+	i2, err := h.parseDbIndex(index2)
+	if err != nil {
+		return err
+	}
+	for {
+		db1, db2 := h.dbAt(i1), h.dbAt(i2)
+		shards := append(append([]*dbShard(nil), db1.shards[:]...), db2.shards[:]...)
+		unlock := lockShards(false, shards...)
+		h.mu.Lock()
+		if h.dbs[i1] != db1 || h.dbs[i2] != db2 {
+			// Swapped meanwhile.
+			h.mu.Unlock()
+			unlock()
+			continue
 		}
+		h.dbs[i1], h.dbs[i2] = db2, db1
+		h.mu.Unlock()
+
+		// The clients blocked on an index keep waiting on it, and are
+		// served right away if the database taking it has what they
+		// wait for.
+		db1.waiters, db2.waiters = db2.waiters, db1.waiters
+		wake := func() {
+			db1.wakeWaiters()
+			db2.wakeWaiters()
+		}
+		if client != nil && client.inExec {
+			client.afterExec = append(client.afterExec, func() {
+				defer lockShards(false, shards...)()
+				wake()
+			})
+		} else {
+			wake()
+		}
+		unlock()
+		return nil
 	}
-	return i, nil
 }
 
-func (h *DefaultHandler) Select(key string) error {
-	if h.dbs == nil {
-		h.dbs = map[int]*Database{0: h.Database}
-	}
-	index, err := strconv.Atoi(key)
+// Move transfers key from the selected database to the database at index.
+// It returns 0 if the key does not exist or already exists in the target.
+func (h *DefaultHandler) Move(client *Client, key, index string) (int, error) {
+	i, err := h.parseDbIndex(index)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if i == client.Db {
+		return 0, ErrSameObject
+	}
+	src, dst := h.db(client), h.dbAt(i)
+	defer lockShards(false, src.shard(key), dst.shard(key))()
+
+	src.removeIfExpired(key)
+	dst.removeIfExpired(key)
+	v := src.value(key)
+	if v == nil || dst.exists(key) {
+		return 0, nil
+	}
+	t, volatile := src.expiration(key)
+	dst.store(key, v)
+	h.handOff(client, dst, key)
+	src.remove(key)
+	if volatile {
+		dst.setExpire(key, t)
+	}
+	return 1, nil
+}
+
+func (h *DefaultHandler) Dbsize(client *Client) (int, error) {
+	return h.db(client).size(), nil
+}
+
+func (h *DefaultHandler) Flushdb(client *Client) error {
+	h.db(client).flush()
+	return nil
+}
+
+func (h *DefaultHandler) Flushall() error {
+	h.mu.RLock()
+	dbs := make([]*Database, 0, len(h.dbs))
+	for _, db := range h.dbs {
+		dbs = append(dbs, db)
 	}
-	h.dbs[h.currentDb] = h.Database
-	h.currentDb = index
-	if _, exists := h.dbs[index]; !exists {
-		println("DB not exits, create ", index)
-		h.dbs[index] = NewDatabase(nil)
+	h.mu.RUnlock()
+	// Databases are flushed without h.mu, which SWAPDB takes with their
+	// shards locked.
+	for _, db := range dbs {
+		db.flush()
 	}
-	h.Database = h.dbs[index]
 	return nil
 }
 
@@ -364,12 +3223,8 @@ func (h *DefaultHandler) Monitor() (*MonitorReply, error) {
 	return &MonitorReply{}, nil
 }
 
+// NewDefaultHandler returns a handler with no databases yet: each one is
+// created on first use, with the Clock set by then.
 func NewDefaultHandler() *DefaultHandler {
-	db := NewDatabase(nil)
-	ret := &DefaultHandler{
-		Database:  db,
-		currentDb: 0,
-		dbs:       map[int]*Database{0: db},
-	}
-	return ret
+	return &DefaultHandler{}
 }
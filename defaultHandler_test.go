@@ -0,0 +1,1007 @@
+package redis
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type handlerTest struct {
+	client   *Client
+	request  *Request
+	expected string
+}
+
+func newDefaultServer(t *testing.T) *Server {
+	srv, err := NewServer(DefaultConfig().Handler(NewDefaultHandler()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return srv
+}
+
+func runHandlerTests(t *testing.T, srv *Server, tests []handlerTest) {
+	for _, v := range tests {
+		v.request.Client = v.client
+		reply, err := srv.ApplyString(v.request)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if reply != v.expected {
+			t.Fatalf("Expected %q, got: %q for request %s %q", v.expected, reply, v.request.Name, v.request.Args)
+		}
+	}
+}
+
+func req(name string, args ...string) *Request {
+	return &Request{Name: name, Args: b(args...)}
+}
+
+func TestDefaultHandlerSelect(t *testing.T) {
+	srv := newDefaultServer(t)
+	c1, c2 := newClient("c1"), newClient("c2")
+	runHandlerTests(t, srv, []handlerTest{
+		{c1, req("SET", "key", "zero"), "+OK\r\n"},
+		{c1, req("SELECT", "3"), "+OK\r\n"},
+		{c1, req("GET", "key"), "$-1\r\n"},
+		{c2, req("GET", "key"), "$4\r\nzero\r\n"},
+		{c1, req("SET", "key", "three"), "+OK\r\n"},
+		{c2, req("GET", "key"), "$4\r\nzero\r\n"},
+		{c1, req("GET", "key"), "$5\r\nthree\r\n"},
+		{c1, req("SELECT", "x"), "-ERROR invalid DB index\r\n"},
+		{c1, req("SELECT", "-1"), "-ERROR DB index is out of range\r\n"},
+		{c1, req("SELECT", "16"), "-ERROR DB index is out of range\r\n"},
+		{c1, req("SELECT", "15"), "+OK\r\n"},
+		{c1, req("SELECT", "3"), "+OK\r\n"},
+		{c1, req("DBSIZE"), ":1\r\n"},
+	})
+
+	h := NewDefaultHandler()
+	h.Databases = 2
+	srv, err := NewServer(DefaultConfig().Handler(h))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c1, req("SELECT", "1"), "+OK\r\n"},
+		{c1, req("SELECT", "2"), "-ERROR DB index is out of range\r\n"},
+	})
+}
+
+func TestDefaultHandlerSwapdb(t *testing.T) {
+	srv := newDefaultServer(t)
+	c1, c2 := newClient("c1"), newClient("c2")
+	runHandlerTests(t, srv, []handlerTest{
+		{c1, req("SET", "key", "zero"), "+OK\r\n"},
+		{c2, req("SELECT", "1"), "+OK\r\n"},
+		{c2, req("RPUSH", "list", "a", "b"), ":2\r\n"},
+		{c1, req("SWAPDB", "0", "1"), "+OK\r\n"},
+		{c1, req("GET", "key"), "$-1\r\n"},
+		{c1, req("LRANGE", "list", "0", "1"), "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{c2, req("GET", "key"), "$4\r\nzero\r\n"},
+		{c2, req("SWAPDB", "0", "a"), "-ERROR invalid DB index\r\n"},
+		{c2, req("SWAPDB", "0", "16"), "-ERROR DB index is out of range\r\n"},
+	})
+}
+
+func TestDefaultHandlerSwapdbBlocked(t *testing.T) {
+	srv := newDefaultServer(t)
+	c1, c2, other := newClient("c1"), newClient("c2"), newClient("other")
+	other.Db = 1
+
+	// Blocked clients keep waiting on the index of their database.
+	blocked := blockingApply(srv, c1, req("BLPOP", "l", "0"))
+	time.Sleep(10 * time.Millisecond)
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("SWAPDB", "0", "1"), "+OK\r\n"},
+		{other, req("RPUSH", "l", "x"), ":1\r\n"},
+	})
+	select {
+	case reply := <-blocked:
+		t.Fatalf("Expected the client to keep waiting on db 0, got %q", reply)
+	case <-time.After(10 * time.Millisecond):
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c2, req("RPUSH", "l", "zero"), ":1\r\n"},
+	})
+	expectReply(t, blocked, "*2\r\n$1\r\nl\r\n$4\r\nzero\r\n")
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("DEL", "l"), ":1\r\n"},
+	})
+
+	// They are served if the database taking the index has what they wait for.
+	for _, v := range []struct {
+		blocking *Request
+		push     *Request
+		expected string
+	}{
+		{req("BLPOP", "l", "0"), req("RPUSH", "l", "one"), "*2\r\n$1\r\nl\r\n$3\r\none\r\n"},
+		{req("BZPOPMIN", "z", "0"), req("ZADD", "z", "1", "m"), "*3\r\n$1\r\nz\r\n$1\r\nm\r\n$1\r\n1\r\n"},
+	} {
+		blocked = blockingApply(srv, c1, v.blocking)
+		time.Sleep(10 * time.Millisecond)
+		runHandlerTests(t, srv, []handlerTest{
+			{other, v.push, ":1\r\n"},
+			{other, req("SWAPDB", "1", "0"), "+OK\r\n"},
+		})
+		expectReply(t, blocked, v.expected)
+	}
+}
+
+func TestDefaultHandlerConcurrentSwapdb(t *testing.T) {
+	srv := newDefaultServer(t)
+	const dbs = 4
+	for i := 0; i < dbs; i++ {
+		c := newClient("c")
+		c.Db = i
+		runHandlerTests(t, srv, []handlerTest{
+			{c, req("SET", "db", strconv.Itoa(i)), "+OK\r\n"},
+		})
+	}
+
+	// Concurrent swaps only ever exchange whole databases.
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				srv.Apply(req("SWAPDB", strconv.Itoa((w+i)%dbs), strconv.Itoa((w+2*i+1)%dbs)))
+			}
+		}(w)
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for i := 0; i < dbs; i++ {
+		c := newClient("c")
+		c.Db = i
+		reply, err := srv.ApplyString(&Request{Name: "GET", Args: b("db"), Client: c})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if seen[reply] {
+			t.Fatalf("Expected every database once, got %q twice", reply)
+		}
+		seen[reply] = true
+	}
+}
+
+func TestDefaultHandlerMove(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SET", "key", "value"), "+OK\r\n"},
+		{c, req("MOVE", "key", "0"), "-ERROR source and destination objects are the same\r\n"},
+		{c, req("MOVE", "missing", "1"), ":0\r\n"},
+		{c, req("MOVE", "key", "16"), "-ERROR DB index is out of range\r\n"},
+		{c, req("MOVE", "key", "1"), ":1\r\n"},
+		{c, req("DBSIZE"), ":0\r\n"},
+		{c, req("SET", "key", "other"), "+OK\r\n"},
+		{c, req("MOVE", "key", "1"), ":0\r\n"},
+		{c, req("SELECT", "1"), "+OK\r\n"},
+		{c, req("GET", "key"), "$5\r\nvalue\r\n"},
+		{c, req("DBSIZE"), ":1\r\n"},
+	})
+}
+
+func TestDefaultHandlerFlush(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SET", "a", "1"), "+OK\r\n"},
+		{c, req("SELECT", "1"), "+OK\r\n"},
+		{c, req("SET", "b", "1"), "+OK\r\n"},
+		{c, req("SET", "c", "1"), "+OK\r\n"},
+		{c, req("DBSIZE"), ":2\r\n"},
+		{c, req("FLUSHDB"), "+OK\r\n"},
+		{c, req("DBSIZE"), ":0\r\n"},
+		{c, req("SELECT", "0"), "+OK\r\n"},
+		{c, req("DBSIZE"), ":1\r\n"},
+		{c, req("FLUSHALL"), "+OK\r\n"},
+		{c, req("DBSIZE"), ":0\r\n"},
+	})
+}
+
+func TestDefaultHandlerStrings(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("INCR", "n"), ":1\r\n"},
+		{c, req("INCRBY", "n", "41"), ":42\r\n"},
+		{c, req("DECR", "n"), ":41\r\n"},
+		{c, req("DECRBY", "n", "-9"), ":50\r\n"},
+		{c, req("GET", "n"), "$2\r\n50\r\n"},
+		{c, req("INCRBY", "n", "x"), "-ERROR value is not an integer or out of range\r\n"},
+		{c, req("INCRBY", "n", "1.5"), "-ERROR value is not an integer or out of range\r\n"},
+		{c, req("SET", "max", "9223372036854775807"), "+OK\r\n"},
+		{c, req("INCR", "max"), "-ERROR increment or decrement would overflow\r\n"},
+		{c, req("DECRBY", "n", "-9223372036854775808"), "-ERROR increment or decrement would overflow\r\n"},
+		{c, req("SET", "s", "abc"), "+OK\r\n"},
+		{c, req("INCR", "s"), "-ERROR value is not an integer or out of range\r\n"},
+
+		{c, req("INCRBYFLOAT", "f", "10.5"), "$4\r\n10.5\r\n"},
+		{c, req("INCRBYFLOAT", "f", "0.1"), "$4\r\n10.6\r\n"},
+		{c, req("INCRBYFLOAT", "f", "-5.0e3"), "$7\r\n-4989.4\r\n"},
+		{c, req("INCRBYFLOAT", "f", "x"), "-ERROR value is not a valid float\r\n"},
+		{c, req("INCRBYFLOAT", "s", "1"), "-ERROR value is not a valid float\r\n"},
+		{c, req("INCRBYFLOAT", "f", "inf"), "-ERROR value is not a valid float\r\n"},
+		{c, req("SET", "big", "1.7e308"), "+OK\r\n"},
+		{c, req("INCRBYFLOAT", "big", "1.7e308"), "-ERROR increment would produce NaN or Infinity\r\n"},
+
+		{c, req("APPEND", "a", "Hello"), ":5\r\n"},
+		{c, req("APPEND", "a", " World"), ":11\r\n"},
+		{c, req("STRLEN", "a"), ":11\r\n"},
+		{c, req("STRLEN", "missing"), ":0\r\n"},
+		{c, req("GETRANGE", "a", "0", "4"), "$5\r\nHello\r\n"},
+		{c, req("GETRANGE", "a", "-5", "-1"), "$5\r\nWorld\r\n"},
+		{c, req("GETRANGE", "a", "6", "100"), "$5\r\nWorld\r\n"},
+		{c, req("GETRANGE", "a", "5", "2"), "$-1\r\n"},
+		{c, req("SETRANGE", "a", "6", "Redis"), ":11\r\n"},
+		{c, req("GET", "a"), "$11\r\nHello Redis\r\n"},
+		{c, req("SETRANGE", "z", "3", "x"), ":4\r\n"},
+		{c, req("GET", "z"), "$4\r\n\x00\x00\x00x\r\n"},
+		{c, req("SETRANGE", "z", "-1", "x"), "-ERROR offset is out of range\r\n"},
+		{c, req("SETRANGE", "z", "536870911", "xx"), "-ERROR string exceeds maximum allowed size (proto-max-bulk-len)\r\n"},
+
+		{c, req("MSET", "k1", "v1", "k2", "v2"), "+OK\r\n"},
+		{c, req("MGET", "k1", "missing", "k2"), "*3\r\n$2\r\nv1\r\n$-1\r\n$2\r\nv2\r\n"},
+		{c, req("MSET", "k1"), "-ERROR Got uneven number of key val pairs\r\n"},
+		{c, req("MSETNX", "k2", "x", "k3", "v3"), ":0\r\n"},
+		{c, req("GET", "k3"), "$-1\r\n"},
+		{c, req("MSETNX", "k3", "v3", "k4", "v4"), ":1\r\n"},
+		{c, req("MGET", "k3", "k4"), "*2\r\n$2\r\nv3\r\n$2\r\nv4\r\n"},
+
+		{c, req("SETNX", "k1", "x"), ":0\r\n"},
+		{c, req("SETNX", "k5", "v5"), ":1\r\n"},
+		{c, req("GETSET", "k5", "new"), "$2\r\nv5\r\n"},
+		{c, req("GETSET", "k6", "v6"), "$-1\r\n"},
+		{c, req("GET", "k5"), "$3\r\nnew\r\n"},
+		{c, req("GETDEL", "k5"), "$3\r\nnew\r\n"},
+		{c, req("GETDEL", "k5"), "$-1\r\n"},
+	})
+}
+
+func TestDefaultHandlerGetex(t *testing.T) {
+	srv, _, clock := newExpireServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SET", "key", "v"), "+OK\r\n"},
+		{c, req("GETEX", "key"), "$1\r\nv\r\n"},
+		{c, req("TTL", "key"), ":-1\r\n"},
+		{c, req("GETEX", "key", "EX", "10"), "$1\r\nv\r\n"},
+		{c, req("TTL", "key"), ":10\r\n"},
+		{c, req("GETEX", "key", "PERSIST"), "$1\r\nv\r\n"},
+		{c, req("TTL", "key"), ":-1\r\n"},
+		{c, req("GETEX", "key", "PX", "100"), "$1\r\nv\r\n"},
+		{c, req("GETEX", "key", "EX", "1", "PERSIST"), "-ERROR syntax error\r\n"},
+		{c, req("GETEX", "key", "EX", "0"), "-ERROR invalid expire time in 'getex' command\r\n"},
+		{c, req("GETEX", "key", "EX", "9223372036854775807"), "-ERROR invalid expire time in 'getex' command\r\n"},
+		{c, req("GETEX", "key", "EX", "x"), "-ERROR value is not an integer or out of range\r\n"},
+		{c, req("GETEX", "missing", "EX", "10"), "$-1\r\n"},
+		{c, req("INCR", "n"), ":1\r\n"},
+		{c, req("EXPIRE", "n", "10"), ":1\r\n"},
+		// INCR keeps the expiration, SETNX on an expired key works.
+		{c, req("INCR", "n"), ":2\r\n"},
+		{c, req("TTL", "n"), ":10\r\n"},
+	})
+	clock.advance(time.Second)
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("GET", "key"), "$-1\r\n"},
+		{c, req("SETNX", "key", "w"), ":1\r\n"},
+		{c, req("STRLEN", "key"), ":1\r\n"},
+	})
+}
+
+func TestDefaultHandlerLists(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("RPUSH", "l", "a", "b", "c", "d", "e"), ":5\r\n"},
+		{c, req("LRANGE", "l", "0", "-1"), "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{c, req("LRANGE", "l", "1", "-2"), "*3\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n"},
+		{c, req("LRANGE", "l", "-2", "100"), "*2\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{c, req("LRANGE", "l", "3", "1"), "*0\r\n"},
+		{c, req("LLEN", "l"), ":5\r\n"},
+		{c, req("LLEN", "missing"), ":0\r\n"},
+		{c, req("LPOP", "l"), "$1\r\na\r\n"},
+		{c, req("RPOP", "l"), "$1\r\ne\r\n"},
+		{c, req("LPOP", "l", "2"), "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{c, req("RPOP", "l", "5"), "*1\r\n$1\r\nd\r\n"},
+		{c, req("LPOP", "l"), "$-1\r\n"},
+		{c, req("LPOP", "l", "2"), "*-1\r\n"},
+		{c, req("RPOP", "missing", "1"), "*-1\r\n"},
+		{c, req("LPOP", "l", "-1"), "-ERROR value is out of range, must be positive\r\n"},
+
+		{c, req("LPUSHX", "l", "x"), ":0\r\n"},
+		{c, req("RPUSHX", "l", "x"), ":0\r\n"},
+		{c, req("RPUSH", "l", "a", "b", "a", "c", "a"), ":5\r\n"},
+		{c, req("LPUSHX", "l", "z"), ":6\r\n"},
+		{c, req("RPUSHX", "l", "y", "a"), ":8\r\n"},
+		{c, req("LSET", "l", "0", "a"), "+OK\r\n"},
+		{c, req("LSET", "l", "-2", "w"), "+OK\r\n"},
+		{c, req("LSET", "l", "8", "w"), "-ERROR index out of range\r\n"},
+		{c, req("LSET", "missing", "0", "w"), "-ERROR no such key\r\n"},
+		// l = a a b a c a w a
+		{c, req("LPOS", "l", "a"), ":0\r\n"},
+		{c, req("LPOS", "l", "a", "RANK", "3"), ":3\r\n"},
+		{c, req("LPOS", "l", "a", "RANK", "-1"), ":7\r\n"},
+		{c, req("LPOS", "l", "a", "COUNT", "0"), "*5\r\n:0\r\n:1\r\n:3\r\n:5\r\n:7\r\n"},
+		{c, req("LPOS", "l", "a", "COUNT", "2", "RANK", "-2"), "*2\r\n:5\r\n:3\r\n"},
+		{c, req("LPOS", "l", "a", "COUNT", "0", "MAXLEN", "3"), "*2\r\n:0\r\n:1\r\n"},
+		{c, req("LPOS", "l", "x"), "$-1\r\n"},
+		{c, req("LPOS", "l", "x", "COUNT", "1"), "*0\r\n"},
+		{c, req("LPOS", "l", "a", "RANK", "0"), "-ERROR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list\r\n"},
+		{c, req("LPOS", "l", "a", "COUNT", "-1"), "-ERROR COUNT can't be negative\r\n"},
+		{c, req("LPOS", "l", "a", "MAXLEN"), "-ERROR syntax error\r\n"},
+		{c, req("LREM", "l", "2", "a"), ":2\r\n"},
+		{c, req("LREM", "l", "-1", "a"), ":1\r\n"},
+		// l = b a c a w
+		{c, req("LRANGE", "l", "0", "-1"), "*5\r\n$1\r\nb\r\n$1\r\na\r\n$1\r\nc\r\n$1\r\na\r\n$1\r\nw\r\n"},
+		{c, req("LREM", "l", "0", "a"), ":2\r\n"},
+		{c, req("LINSERT", "l", "BEFORE", "c", "x"), ":4\r\n"},
+		{c, req("LINSERT", "l", "after", "w", "y"), ":5\r\n"},
+		{c, req("LINSERT", "l", "AFTER", "nope", "y"), ":-1\r\n"},
+		{c, req("LINSERT", "missing", "AFTER", "w", "y"), ":0\r\n"},
+		{c, req("LINSERT", "l", "AROUND", "w", "y"), "-ERROR syntax error\r\n"},
+		{c, req("LTRIM", "l", "1", "-2"), "+OK\r\n"},
+		{c, req("LRANGE", "l", "0", "-1"), "*3\r\n$1\r\nx\r\n$1\r\nc\r\n$1\r\nw\r\n"},
+
+		{c, req("RPOPLPUSH", "l", "l2"), "$1\r\nw\r\n"},
+		{c, req("LMOVE", "l", "l2", "LEFT", "RIGHT"), "$1\r\nx\r\n"},
+		{c, req("LMOVE", "l2", "l2", "LEFT", "RIGHT"), "$1\r\nw\r\n"},
+		{c, req("LMOVE", "l", "l2", "UP", "RIGHT"), "-ERROR syntax error\r\n"},
+		{c, req("LRANGE", "l2", "0", "-1"), "*2\r\n$1\r\nx\r\n$1\r\nw\r\n"},
+		{c, req("LMOVE", "missing", "l2", "LEFT", "RIGHT"), "$-1\r\n"},
+		{c, req("LTRIM", "l", "5", "10"), "+OK\r\n"},
+		{c, req("LLEN", "l"), ":0\r\n"},
+		{c, req("BRPOPLPUSH", "l2", "l3", "1"), "$1\r\nw\r\n"},
+		{c, req("BLMOVE", "l2", "l3", "LEFT", "LEFT", "-1"), "-ERROR timeout is negative\r\n"},
+		{c, req("EXISTS", "l"), ":0\r\n"},
+
+		// Emptied lists are deleted, along with their expiration.
+		{c, req("RPUSH", "k", "a"), ":1\r\n"},
+		{c, req("EXPIRE", "k", "100"), ":1\r\n"},
+		{c, req("LPOP", "k"), "$1\r\na\r\n"},
+		{c, req("EXISTS", "k"), ":0\r\n"},
+		{c, req("HSET", "k", "f", "v"), ":1\r\n"},
+		{c, req("TTL", "k"), ":-1\r\n"},
+		{c, req("DEL", "k"), ":1\r\n"},
+		{c, req("RPUSH", "k", "a", "b"), ":2\r\n"},
+		{c, req("EXPIRE", "k", "100"), ":1\r\n"},
+		{c, req("LREM", "k", "0", "a"), ":1\r\n"},
+		{c, req("LTRIM", "k", "1", "0"), "+OK\r\n"},
+		{c, req("INCR", "k"), ":1\r\n"},
+		{c, req("TTL", "k"), ":-1\r\n"},
+		{c, req("DBSIZE"), ":3\r\n"},
+	})
+}
+
+func TestDefaultHandlerBlmove(t *testing.T) {
+	srv := newDefaultServer(t)
+	c1, c2 := newClient("c1"), newClient("c2")
+
+	replies := make(chan string)
+	go func() {
+		reply, _ := srv.ApplyString(&Request{Name: "BLMOVE", Args: b("src", "dst", "LEFT", "RIGHT", "0"), Client: c1})
+		replies <- reply
+	}()
+	select {
+	case reply := <-replies:
+		t.Fatalf("Expected BLMOVE to block, got %q", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c2, req("RPUSH", "src", "v"), ":1\r\n"},
+	})
+	select {
+	case reply := <-replies:
+		if reply != "$1\r\nv\r\n" {
+			t.Fatalf("Unexpected reply %q", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected BLMOVE to return")
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c2, req("LRANGE", "dst", "0", "-1"), "*1\r\n$1\r\nv\r\n"},
+		{c2, req("LLEN", "src"), ":0\r\n"},
+		{c2, req("BRPOPLPUSH", "src", "dst", "1"), "$-1\r\n"},
+	})
+
+	// An element never leaves source for a destination of another type.
+	moved := blockingApply(srv, c1, req("BLMOVE", "src", "dst", "LEFT", "RIGHT", "0"))
+	time.Sleep(10 * time.Millisecond)
+	runHandlerTests(t, srv, []handlerTest{
+		{c2, req("DEL", "dst"), ":1\r\n"},
+		{c2, req("SET", "dst", "string"), "+OK\r\n"},
+		{c2, req("RPUSH", "src", "w"), ":1\r\n"},
+	})
+	expectReply(t, moved, ErrWrongType.Error())
+	runHandlerTests(t, srv, []handlerTest{
+		{c2, req("LRANGE", "src", "0", "-1"), "*1\r\n$1\r\nw\r\n"},
+		{c2, req("BLMOVE", "src", "dst", "LEFT", "RIGHT", "0"), ErrWrongType.Error()},
+	})
+}
+
+// blockingApply runs r in the background, returning the channel its reply
+// is sent on.
+func blockingApply(srv *Server, c *Client, r *Request) chan string {
+	replies := make(chan string, 1)
+	r.Client = c
+	go func() {
+		reply, err := srv.ApplyString(r)
+		if err != nil {
+			reply = err.Error()
+		}
+		replies <- reply
+	}()
+	return replies
+}
+
+func TestDefaultHandlerBlockingLists(t *testing.T) {
+	srv := newDefaultServer(t)
+	c1, c2, c3, other := newClient("c1"), newClient("c2"), newClient("c3"), newClient("other")
+	goroutines := runtime.NumGoroutine()
+
+	// Clients are served in the order they started waiting.
+	first := blockingApply(srv, c1, req("BLPOP", "a", "b", "0"))
+	time.Sleep(10 * time.Millisecond)
+	second := blockingApply(srv, c2, req("BRPOP", "b", "0"))
+	time.Sleep(10 * time.Millisecond)
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("RPUSH", "b", "1", "2", "3"), ":3\r\n"},
+	})
+	for _, v := range []struct {
+		replies  chan string
+		expected string
+	}{
+		{first, "*2\r\n$1\r\nb\r\n$1\r\n1\r\n"},
+		{second, "*2\r\n$1\r\nb\r\n$1\r\n3\r\n"},
+	} {
+		select {
+		case reply := <-v.replies:
+			if reply != v.expected {
+				t.Fatalf("Expected %q, got %q", v.expected, reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the blocked clients to be served")
+		}
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("LRANGE", "b", "0", "-1"), "*1\r\n$1\r\n2\r\n"},
+		{other, req("BLPOP", "a", "0.05"), "*-1\r\n"},
+		{other, req("BLPOP", "a", "x"), "-ERROR timeout is not a float or out of range\r\n"},
+		{other, req("BLPOP", "a", "1e300"), "-ERROR timeout is not a float or out of range\r\n"},
+		{other, req("BLPOP", "a"), "-ERROR Wrong number of arguments\r\n"},
+	})
+
+	// Clients that timed out or disconnected are skipped, without losing
+	// elements.
+	timedOut := blockingApply(srv, c1, req("BLPOP", "c", "0.01"))
+	if reply := <-timedOut; reply != "*-1\r\n" {
+		t.Fatalf("Expected %q, got %q", "*-1\r\n", reply)
+	}
+	gone := blockingApply(srv, c2, req("BLPOP", "c", "0"))
+	waiting := blockingApply(srv, c3, req("BLMOVE", "c", "d", "LEFT", "LEFT", "0"))
+	time.Sleep(10 * time.Millisecond)
+	c2.close()
+	if reply := <-gone; reply != "*-1\r\n" {
+		t.Fatalf("Expected %q, got %q", "*-1\r\n", reply)
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("LPUSH", "c", "x"), ":1\r\n"},
+	})
+	if reply := <-waiting; reply != "$1\r\nx\r\n" {
+		t.Fatalf("Expected %q, got %q", "$1\r\nx\r\n", reply)
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("LRANGE", "d", "0", "-1"), "*1\r\n$1\r\nx\r\n"},
+		{other, req("LLEN", "c"), ":0\r\n"},
+		// Lists emptied by blocked clients are deleted.
+		{other, req("EXISTS", "c"), ":0\r\n"},
+	})
+
+	// Flushing keeps the blocked clients waiting on the database.
+	for _, flush := range []string{"FLUSHDB", "FLUSHALL"} {
+		flushed := blockingApply(srv, c1, req("BLPOP", "q", "0"))
+		time.Sleep(10 * time.Millisecond)
+		runHandlerTests(t, srv, []handlerTest{
+			{other, req(flush), "+OK\r\n"},
+			{other, req("LPUSH", "q", "x"), ":1\r\n"},
+		})
+		expectReply(t, flushed, "*2\r\n$1\r\nq\r\n$1\r\nx\r\n")
+	}
+
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d goroutines, got %d", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDefaultHandlerSets(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SADD", "s1", "a", "b", "c", "a"), ":3\r\n"},
+		{c, req("SADD", "s1", "c", "d"), ":1\r\n"},
+		{c, req("SCARD", "s1"), ":4\r\n"},
+		{c, req("SCARD", "missing"), ":0\r\n"},
+		{c, req("SMEMBERS", "s1"), "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n"},
+		{c, req("SMEMBERS", "missing"), "*0\r\n"},
+		{c, req("SISMEMBER", "s1", "a"), ":1\r\n"},
+		{c, req("SISMEMBER", "s1", "z"), ":0\r\n"},
+		{c, req("SMISMEMBER", "s1", "a", "z", "d"), "*3\r\n:1\r\n:0\r\n:1\r\n"},
+		{c, req("SREM", "s1", "d", "z"), ":1\r\n"},
+		{c, req("SADD", "s2", "b", "c", "e"), ":3\r\n"},
+		{c, req("SINTER", "s1", "s2"), "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{c, req("SINTER", "s1", "missing"), "*0\r\n"},
+		{c, req("SUNION", "s1", "s2", "missing"), "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\ne\r\n"},
+		{c, req("SDIFF", "s1", "s2"), "*1\r\n$1\r\na\r\n"},
+		{c, req("SINTERSTORE", "dst", "s1", "s2"), ":2\r\n"},
+		{c, req("SMEMBERS", "dst"), "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{c, req("SUNIONSTORE", "dst", "s1", "s2"), ":4\r\n"},
+		{c, req("SDIFFSTORE", "dst", "s2", "s1"), ":1\r\n"},
+		{c, req("SMEMBERS", "dst"), "*1\r\n$1\r\ne\r\n"},
+		{c, req("SDIFFSTORE", "dst", "s1", "s1"), ":0\r\n"},
+		{c, req("DBSIZE"), ":2\r\n"},
+		{c, req("SINTERCARD", "2", "s1", "s2"), ":2\r\n"},
+		{c, req("SINTERCARD", "2", "s1", "s2", "LIMIT", "1"), ":1\r\n"},
+		{c, req("SINTERCARD", "0", "s1"), "-ERROR numkeys should be greater than 0\r\n"},
+		{c, req("SINTERCARD", "3", "s1", "s2"), "-ERROR Number of keys can't be greater than number of args\r\n"},
+		{c, req("SINTERCARD", "1", "s1", "LIMIT", "-1"), "-ERROR LIMIT can't be negative\r\n"},
+		{c, req("SMOVE", "s1", "s3", "a"), ":1\r\n"},
+		{c, req("SMOVE", "s1", "s3", "a"), ":0\r\n"},
+		{c, req("SMEMBERS", "s3"), "*1\r\n$1\r\na\r\n"},
+		{c, req("SPOP", "s3"), "$1\r\na\r\n"},
+		{c, req("SPOP", "s3"), "$-1\r\n"},
+		{c, req("SRANDMEMBER", "s3"), "$-1\r\n"},
+		{c, req("SRANDMEMBER", "s3", "2"), "*0\r\n"},
+		{c, req("SPOP", "s1", "-1"), "-ERROR value is out of range, must be positive\r\n"},
+		{c, req("SRANDMEMBER", "s1", "x"), "-ERROR value is not an integer or out of range\r\n"},
+	})
+
+	// Random replies: only check their size.
+	for _, v := range []struct {
+		request  *Request
+		expected string
+	}{
+		{req("SRANDMEMBER", "s1", "-5"), "*5\r\n"},
+		{req("SRANDMEMBER", "s1", "1"), "*1\r\n"},
+		{req("SRANDMEMBER", "s1", "5"), "*2\r\n"},
+		{req("SPOP", "s2", "2"), "*2\r\n"},
+		{req("SCARD", "s2"), ":1\r\n"},
+	} {
+		v.request.Client = c
+		reply, err := srv.ApplyString(v.request)
+		if err != nil || reply[:len(v.expected)] != v.expected {
+			t.Fatalf("Expected %q, got %q (%v)", v.expected, reply, err)
+		}
+	}
+}
+
+func TestDefaultHandlerSscan(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SADD", "s", "a1", "a2", "b1", "b2", "c1"), ":5\r\n"},
+		// Members come in hash order: a1, a2, c1, b1 and b2.
+		{c, req("SSCAN", "s", "0"), "*2\r\n$1\r\n0\r\n*5\r\n$2\r\na1\r\n$2\r\na2\r\n$2\r\nc1\r\n$2\r\nb1\r\n$2\r\nb2\r\n"},
+		{c, req("SSCAN", "s", "0", "COUNT", "2"), "*2\r\n$9\r\n488946235\r\n*2\r\n$2\r\na1\r\n$2\r\na2\r\n"},
+		{c, req("SSCAN", "s", "488946235", "COUNT", "2"), "*2\r\n$10\r\n2351703229\r\n*2\r\n$2\r\nc1\r\n$2\r\nb1\r\n"},
+		{c, req("SSCAN", "s", "2351703229", "COUNT", "2"), "*2\r\n$1\r\n0\r\n*1\r\n$2\r\nb2\r\n"},
+		{c, req("SSCAN", "s", "0", "MATCH", "*1"), "*2\r\n$1\r\n0\r\n*3\r\n$2\r\na1\r\n$2\r\nc1\r\n$2\r\nb1\r\n"},
+
+		// Removing returned members does not skip the others.
+		{c, req("SADD", "s2", "a", "b", "c", "d"), ":4\r\n"},
+		{c, req("SSCAN", "s2", "0", "COUNT", "2"), "*2\r\n$10\r\n3826002221\r\n*2\r\n$1\r\nd\r\n$1\r\na\r\n"},
+		{c, req("SREM", "s2", "a", "d"), ":2\r\n"},
+		{c, req("SSCAN", "s2", "3826002221", "COUNT", "2"), "*2\r\n$1\r\n0\r\n*2\r\n$1\r\nc\r\n$1\r\nb\r\n"},
+		{c, req("SSCAN", "missing", "0"), "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{c, req("SSCAN", "s", "x"), "-ERROR invalid cursor\r\n"},
+		{c, req("SSCAN", "s", "0", "COUNT", "0"), "-ERROR syntax error\r\n"},
+		{c, req("SSCAN", "s", "0", "MATCH"), "-ERROR syntax error\r\n"},
+	})
+}
+
+func TestDefaultHandlerSetsResp3(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	c.Protocol = 3
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SADD", "s", "b", "a"), ":2\r\n"},
+		{c, req("SMEMBERS", "s"), "~2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+	})
+}
+
+func TestDefaultHandlerSortedSets(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("ZADD", "z", "1", "a", "2", "b", "3", "c"), ":3\r\n"},
+		{c, req("ZADD", "z", "1", "a", "2.5", "b", "4", "d"), ":1\r\n"},
+		{c, req("ZADD", "z", "CH", "2", "b", "5", "e"), ":2\r\n"},
+		{c, req("ZADD", "z", "NX", "10", "a", "6", "f"), ":1\r\n"},
+		{c, req("ZADD", "z", "XX", "10", "x"), ":0\r\n"},
+		{c, req("ZADD", "z", "GT", "CH", "0", "a", "8", "f"), ":1\r\n"},
+		{c, req("ZADD", "z", "LT", "CH", "0", "a", "9", "f"), ":1\r\n"},
+		{c, req("ZADD", "z", "INCR", "2", "a"), "$1\r\n2\r\n"},
+		{c, req("ZADD", "z", "NX", "INCR", "2", "a"), "$-1\r\n"},
+		{c, req("ZADD", "missing", "XX", "1", "a"), ":0\r\n"},
+		{c, req("ZADD", "z", "NX", "XX", "1", "a"), "-ERROR XX and NX options at the same time are not compatible\r\n"},
+		{c, req("ZADD", "z", "GT", "LT", "1", "a"), "-ERROR GT, LT, and/or NX options at the same time are not compatible\r\n"},
+		{c, req("ZADD", "z", "INCR", "1", "a", "2", "b"), "-ERROR INCR option supports a single increment-element pair\r\n"},
+		{c, req("ZADD", "z", "x", "a"), "-ERROR value is not a valid float\r\n"},
+		{c, req("ZADD", "z", "1"), "-ERROR syntax error\r\n"},
+		{c, req("ZINCRBY", "z", "-0.5", "b"), "$3\r\n1.5\r\n"},
+		{c, req("ZSCORE", "z", "b"), "$3\r\n1.5\r\n"},
+		{c, req("ZSCORE", "z", "x"), "$-1\r\n"},
+		{c, req("ZCARD", "z"), ":6\r\n"},
+		{c, req("ZCARD", "missing"), ":0\r\n"},
+		// a=2 b=1.5 c=3 d=4 e=5 f=8
+		{c, req("ZRANK", "z", "b"), ":0\r\n"},
+		{c, req("ZRANK", "z", "f"), ":5\r\n"},
+		{c, req("ZREVRANK", "z", "f"), ":0\r\n"},
+		{c, req("ZRANK", "z", "x"), "$-1\r\n"},
+		{c, req("ZCOUNT", "z", "2", "4"), ":3\r\n"},
+		{c, req("ZCOUNT", "z", "(2", "+inf"), ":4\r\n"},
+		{c, req("ZCOUNT", "z", "-inf", "(1.5"), ":0\r\n"},
+		{c, req("ZCOUNT", "z", "x", "1"), "-ERROR min or max is not a float\r\n"},
+		{c, req("ZRANGE", "z", "0", "2"), "*3\r\n$1\r\nb\r\n$1\r\na\r\n$1\r\nc\r\n"},
+		{c, req("ZRANGE", "z", "-2", "-1", "WITHSCORES"), "*4\r\n$1\r\ne\r\n$1\r\n5\r\n$1\r\nf\r\n$1\r\n8\r\n"},
+		{c, req("ZRANGE", "z", "0", "1", "REV"), "*2\r\n$1\r\nf\r\n$1\r\ne\r\n"},
+		{c, req("ZRANGE", "z", "(2", "5", "BYSCORE"), "*3\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{c, req("ZRANGE", "z", "5", "(2", "BYSCORE", "REV", "LIMIT", "1", "1"), "*1\r\n$1\r\nd\r\n"},
+		{c, req("ZRANGE", "z", "0", "1", "LIMIT", "0", "1"), "-ERROR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n"},
+		{c, req("ZRANGE", "z", "-", "+", "BYLEX", "WITHSCORES"), "-ERROR syntax error, WITHSCORES not supported in combination with BYLEX\r\n"},
+		{c, req("ZRANGEBYSCORE", "z", "-inf", "2", "WITHSCORES"), "*4\r\n$1\r\nb\r\n$3\r\n1.5\r\n$1\r\na\r\n$1\r\n2\r\n"},
+		{c, req("ZRANGEBYSCORE", "z", "3", "+inf", "LIMIT", "1", "2"), "*2\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{c, req("ZRANGEBYSCORE", "missing", "-inf", "+inf"), "*0\r\n"},
+
+		{c, req("ZADD", "lex", "0", "a", "0", "b", "0", "c", "0", "d"), ":4\r\n"},
+		{c, req("ZRANGE", "lex", "[b", "(d", "BYLEX"), "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{c, req("ZRANGE", "lex", "+", "(b", "BYLEX", "REV"), "*2\r\n$1\r\nd\r\n$1\r\nc\r\n"},
+		{c, req("ZRANGE", "lex", "-", "+", "BYLEX", "LIMIT", "3", "5"), "*1\r\n$1\r\nd\r\n"},
+		{c, req("ZRANGE", "lex", "a", "+", "BYLEX"), "-ERROR min or max not valid string range item\r\n"},
+		{c, req("ZREMRANGEBYLEX", "lex", "(a", "[c"), ":2\r\n"},
+		{c, req("ZRANGE", "lex", "0", "-1"), "*2\r\n$1\r\na\r\n$1\r\nd\r\n"},
+
+		{c, req("ZREM", "z", "a", "x"), ":1\r\n"},
+		{c, req("ZREMRANGEBYSCORE", "z", "5", "+inf"), ":2\r\n"},
+		{c, req("ZREMRANGEBYRANK", "z", "0", "0"), ":1\r\n"},
+		{c, req("ZRANGE", "z", "0", "-1", "WITHSCORES"), "*4\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nd\r\n$1\r\n4\r\n"},
+		{c, req("ZREMRANGEBYRANK", "z", "0", "-1"), ":2\r\n"},
+		{c, req("ZCARD", "z"), ":0\r\n"},
+
+		{c, req("ZADD", "p", "1", "a", "2", "b", "3", "c"), ":3\r\n"},
+		{c, req("ZPOPMIN", "p"), "*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{c, req("ZPOPMAX", "p", "5"), "*4\r\n$1\r\nc\r\n$1\r\n3\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{c, req("ZPOPMIN", "p"), "*0\r\n"},
+		{c, req("ZPOPMIN", "p", "-1"), "-ERROR value is out of range, must be positive\r\n"},
+	})
+}
+
+func TestDefaultHandlerZstore(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("ZADD", "z1", "1", "a", "2", "b"), ":2\r\n"},
+		{c, req("ZADD", "z2", "10", "b", "20", "c"), ":2\r\n"},
+		{c, req("SADD", "s", "a", "c"), ":2\r\n"},
+		{c, req("ZUNIONSTORE", "dst", "2", "z1", "z2"), ":3\r\n"},
+		{c, req("ZRANGE", "dst", "0", "-1", "WITHSCORES"), "*6\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$2\r\n12\r\n$1\r\nc\r\n$2\r\n20\r\n"},
+		{c, req("ZUNIONSTORE", "dst", "2", "z1", "z2", "WEIGHTS", "2", "1", "AGGREGATE", "MIN"), ":3\r\n"},
+		{c, req("ZRANGE", "dst", "0", "-1", "WITHSCORES"), "*6\r\n$1\r\na\r\n$1\r\n2\r\n$1\r\nb\r\n$1\r\n4\r\n$1\r\nc\r\n$2\r\n20\r\n"},
+		{c, req("ZINTERSTORE", "dst", "2", "z1", "z2", "AGGREGATE", "MAX"), ":1\r\n"},
+		{c, req("ZRANGE", "dst", "0", "-1", "WITHSCORES"), "*2\r\n$1\r\nb\r\n$2\r\n10\r\n"},
+		// Members of sets score 1.
+		{c, req("ZINTERSTORE", "dst", "2", "z2", "s"), ":1\r\n"},
+		{c, req("ZSCORE", "dst", "c"), "$2\r\n21\r\n"},
+		{c, req("ZINTERSTORE", "dst", "2", "z1", "missing"), ":0\r\n"},
+		{c, req("ZCARD", "dst"), ":0\r\n"},
+		{c, req("ZUNIONSTORE", "dst", "0", "z1"), "-ERROR at least 1 input key is needed for ZUNIONSTORE/ZINTERSTORE\r\n"},
+		{c, req("ZUNIONSTORE", "dst", "3", "z1"), "-ERROR syntax error\r\n"},
+		{c, req("ZUNIONSTORE", "dst", "1", "z1", "WEIGHTS"), "-ERROR syntax error\r\n"},
+		{c, req("ZUNIONSTORE", "dst", "1", "z1", "AGGREGATE", "AVG"), "-ERROR syntax error\r\n"},
+	})
+}
+
+func TestDefaultHandlerSortedSetsResp3(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	c.Protocol = 3
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("ZADD", "z", "1.5", "a", "2", "b"), ":2\r\n"},
+		{c, req("ZSCORE", "z", "a"), ",1.5\r\n"},
+		{c, req("ZRANGE", "z", "0", "-1", "WITHSCORES"), "*2\r\n*2\r\n$1\r\na\r\n,1.5\r\n*2\r\n$1\r\nb\r\n,2\r\n"},
+		{c, req("ZPOPMIN", "z"), "*2\r\n$1\r\na\r\n,1.5\r\n"},
+	})
+}
+
+func TestDefaultHandlerBzpop(t *testing.T) {
+	srv := newDefaultServer(t)
+	c1, c2 := newClient("c1"), newClient("c2")
+
+	replies := make(chan string)
+	go func() {
+		reply, _ := srv.ApplyString(&Request{Name: "BZPOPMAX", Args: b("z1", "z2", "0"), Client: c1})
+		replies <- reply
+	}()
+	select {
+	case reply := <-replies:
+		t.Fatalf("Expected BZPOPMAX to block, got %q", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c2, req("ZADD", "z2", "1", "a", "2", "b"), ":2\r\n"},
+	})
+	select {
+	case reply := <-replies:
+		if reply != "*3\r\n$2\r\nz2\r\n$1\r\nb\r\n$1\r\n2\r\n" {
+			t.Fatalf("Unexpected reply %q", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected BZPOPMAX to return")
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c2, req("BZPOPMIN", "z1", "z2", "0.01"), "*3\r\n$2\r\nz2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{c2, req("BZPOPMIN", "z1", "z2", "0.01"), "*-1\r\n"},
+		{c2, req("BZPOPMIN", "z1", "-1"), "-ERROR timeout is negative\r\n"},
+		{c2, req("BZPOPMIN", "z1", "x"), "-ERROR timeout is not a float or out of range\r\n"},
+	})
+	resp3 := newClient("resp3")
+	resp3.Protocol = 3
+	runHandlerTests(t, srv, []handlerTest{
+		{resp3, req("BZPOPMAX", "z1", "0.01"), "_\r\n"},
+		{resp3, req("BLPOP", "l", "0.01"), "_\r\n"},
+	})
+
+	// Flushing keeps the blocked clients waiting on the database.
+	for _, flush := range []string{"FLUSHDB", "FLUSHALL"} {
+		flushed := blockingApply(srv, c1, req("BZPOPMIN", "z", "0"))
+		time.Sleep(10 * time.Millisecond)
+		runHandlerTests(t, srv, []handlerTest{
+			{c2, req(flush), "+OK\r\n"},
+			{c2, req("ZADD", "z", "1", "a"), ":1\r\n"},
+		})
+		expectReply(t, flushed, "*3\r\n$1\r\nz\r\n$1\r\na\r\n$1\r\n1\r\n")
+	}
+}
+
+func TestDefaultHandlerHashes(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("HSET", "h", "a", "1", "b", "2"), ":2\r\n"},
+		{c, req("HSET", "h", "b", "3", "c", "4"), ":1\r\n"},
+		{c, req("HSET", "h", "a"), "-ERROR Got uneven number of key val pairs\r\n"},
+		{c, req("HMSET", "h", "d", "5"), "+OK\r\n"},
+		{c, req("HSETNX", "h", "d", "6"), ":0\r\n"},
+		{c, req("HSETNX", "h", "e", "hello"), ":1\r\n"},
+		{c, req("HMGET", "h", "a", "x", "e"), "*3\r\n$1\r\n1\r\n$-1\r\n$5\r\nhello\r\n"},
+		{c, req("HEXISTS", "h", "a"), ":1\r\n"},
+		{c, req("HEXISTS", "h", "x"), ":0\r\n"},
+		{c, req("HLEN", "h"), ":5\r\n"},
+		{c, req("HLEN", "missing"), ":0\r\n"},
+		{c, req("HSTRLEN", "h", "e"), ":5\r\n"},
+		{c, req("HSTRLEN", "h", "x"), ":0\r\n"},
+		{c, req("HKEYS", "h"), "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{c, req("HVALS", "h"), "*5\r\n$1\r\n1\r\n$1\r\n3\r\n$1\r\n4\r\n$1\r\n5\r\n$5\r\nhello\r\n"},
+		{c, req("HKEYS", "missing"), "*0\r\n"},
+		{c, req("HINCRBY", "h", "a", "10"), ":11\r\n"},
+		{c, req("HINCRBY", "h", "new", "-2"), ":-2\r\n"},
+		{c, req("HINCRBY", "h", "e", "1"), "-ERROR hash value is not an integer\r\n"},
+		{c, req("HINCRBY", "h", "a", "x"), "-ERROR value is not an integer or out of range\r\n"},
+		{c, req("HSET", "h", "big", "9223372036854775807"), ":1\r\n"},
+		{c, req("HINCRBY", "h", "big", "1"), "-ERROR increment or decrement would overflow\r\n"},
+		{c, req("HINCRBYFLOAT", "h", "b", "0.5"), "$3\r\n3.5\r\n"},
+		{c, req("HINCRBYFLOAT", "h", "e", "1"), "-ERROR hash value is not a float\r\n"},
+		{c, req("HINCRBYFLOAT", "incr", "f", "x"), "-ERROR value is not a valid float\r\n"},
+		{c, req("HLEN", "incr"), ":0\r\n"},
+		{c, req("HDEL", "h", "a", "b", "x"), ":2\r\n"},
+		{c, req("HDEL", "h", "c", "d", "e", "new", "big"), ":5\r\n"},
+		{c, req("HGETALL", "h"), "*0\r\n"},
+		{c, req("DBSIZE"), ":0\r\n"},
+
+		{c, req("HSET", "r", "a", "1"), ":1\r\n"},
+		{c, req("HRANDFIELD", "r"), "$1\r\na\r\n"},
+		{c, req("HRANDFIELD", "r", "5", "WITHVALUES"), "*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{c, req("HRANDFIELD", "r", "-3"), "*3\r\n$1\r\na\r\n$1\r\na\r\n$1\r\na\r\n"},
+		{c, req("HRANDFIELD", "r", "1", "BOGUS"), "-ERROR syntax error\r\n"},
+		{c, req("HRANDFIELD", "missing"), "$-1\r\n"},
+		{c, req("HRANDFIELD", "missing", "2"), "*0\r\n"},
+	})
+}
+
+func TestDefaultHandlerHscan(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("HSET", "h", "a1", "x", "a2", "y", "b1", "z"), ":3\r\n"},
+		{c, req("HSCAN", "h", "0", "COUNT", "2"), "*2\r\n$9\r\n488946235\r\n*4\r\n$2\r\na1\r\n$1\r\nx\r\n$2\r\na2\r\n$1\r\ny\r\n"},
+		// Removing returned fields does not skip the others.
+		{c, req("HDEL", "h", "a1"), ":1\r\n"},
+		{c, req("HSCAN", "h", "488946235", "COUNT", "2"), "*2\r\n$1\r\n0\r\n*2\r\n$2\r\nb1\r\n$1\r\nz\r\n"},
+		{c, req("HSCAN", "h", "0", "MATCH", "b*"), "*2\r\n$1\r\n0\r\n*2\r\n$2\r\nb1\r\n$1\r\nz\r\n"},
+		{c, req("HSCAN", "h", "x"), "-ERROR invalid cursor\r\n"},
+	})
+}
+
+func TestDefaultHandlerKeyspace(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SET", "str", "v"), "+OK\r\n"},
+		{c, req("RPUSH", "list", "a", "b"), ":2\r\n"},
+		{c, req("HSET", "hash", "f", "v"), ":1\r\n"},
+		{c, req("SADD", "set", "m"), ":1\r\n"},
+		{c, req("ZADD", "zset", "1", "m"), ":1\r\n"},
+		{c, req("TYPE", "str"), "+string\r\n"},
+		{c, req("TYPE", "list"), "+list\r\n"},
+		{c, req("TYPE", "hash"), "+hash\r\n"},
+		{c, req("TYPE", "set"), "+set\r\n"},
+		{c, req("TYPE", "zset"), "+zset\r\n"},
+		{c, req("TYPE", "missing"), "+none\r\n"},
+
+		{c, req("GET", "list"), wrongType},
+		{c, req("INCR", "hash"), wrongType},
+		{c, req("APPEND", "set", "x"), wrongType},
+		{c, req("LPUSH", "str", "x"), wrongType},
+		{c, req("LRANGE", "hash", "0", "-1"), wrongType},
+		{c, req("LMOVE", "list", "str", "LEFT", "LEFT"), wrongType},
+		{c, req("BLPOP", "str", "0"), wrongType},
+		{c, req("HSET", "list", "f", "v"), wrongType},
+		{c, req("HGET", "str", "f"), wrongType},
+		{c, req("SADD", "zset", "m"), wrongType},
+		{c, req("SUNION", "set", "str"), wrongType},
+		{c, req("ZADD", "set", "1", "m"), wrongType},
+		{c, req("ZRANGE", "hash", "0", "-1"), wrongType},
+		{c, req("ZPOPMIN", "str"), wrongType},
+		{c, req("ZUNIONSTORE", "dst", "2", "zset", "hash"), wrongType},
+		{c, req("GETSET", "list", "v"), wrongType},
+		{c, req("SET", "list", "v", "GET"), wrongType},
+		{c, req("MGET", "str", "list"), "*2\r\n$1\r\nv\r\n$-1\r\n"},
+		// SET replaces a value of any type.
+		{c, req("SET", "list", "v"), "+OK\r\n"},
+		{c, req("TYPE", "list"), "+string\r\n"},
+		{c, req("LLEN", "list"), wrongType},
+
+		{c, req("EXISTS", "str", "hash", "missing", "str"), ":3\r\n"},
+		{c, req("TOUCH", "str", "missing"), ":1\r\n"},
+		{c, req("DEL", "hash", "set", "missing"), ":2\r\n"},
+		{c, req("UNLINK", "zset", "zset"), ":1\r\n"},
+		{c, req("DBSIZE"), ":2\r\n"},
+	})
+}
+
+func TestDefaultHandlerRename(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("RPUSH", "list", "a", "b"), ":2\r\n"},
+		{c, req("SET", "str", "v"), "+OK\r\n"},
+		{c, req("RENAME", "list", "renamed"), "+OK\r\n"},
+		{c, req("LRANGE", "renamed", "0", "-1"), "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{c, req("EXISTS", "list"), ":0\r\n"},
+		{c, req("RENAME", "missing", "x"), "-ERROR no such key\r\n"},
+		{c, req("RENAMENX", "renamed", "str"), ":0\r\n"},
+		{c, req("RENAMENX", "renamed", "list"), ":1\r\n"},
+		// RENAME replaces a value of any type.
+		{c, req("RENAME", "str", "list"), "+OK\r\n"},
+		{c, req("GET", "list"), "$1\r\nv\r\n"},
+		{c, req("RENAME", "list", "list"), "+OK\r\n"},
+		{c, req("DBSIZE"), ":1\r\n"},
+
+		{c, req("SADD", "set", "a", "b"), ":2\r\n"},
+		{c, req("COPY", "set", "copy"), ":1\r\n"},
+		{c, req("SADD", "copy", "c"), ":1\r\n"},
+		{c, req("SCARD", "set"), ":2\r\n"},
+		{c, req("COPY", "set", "copy"), ":0\r\n"},
+		{c, req("COPY", "list", "copy", "REPLACE"), ":1\r\n"},
+		{c, req("TYPE", "copy"), "+string\r\n"},
+		{c, req("COPY", "set", "set"), "-ERROR source and destination objects are the same\r\n"},
+		{c, req("COPY", "set", "set", "DB", "1"), ":1\r\n"},
+		{c, req("COPY", "missing", "x"), ":0\r\n"},
+		{c, req("COPY", "set", "x", "BOGUS"), "-ERROR syntax error\r\n"},
+		{c, req("SELECT", "1"), "+OK\r\n"},
+		{c, req("SMEMBERS", "set"), "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+	})
+}
+
+func TestDefaultHandlerKeys(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("MSET", "hello", "1", "hallo", "2", "hxllo", "3", "h*llo", "4"), "+OK\r\n"},
+		{c, req("RPUSH", "list", "a"), ":1\r\n"},
+		{c, req("KEYS", "*"), "*5\r\n$5\r\nh*llo\r\n$5\r\nhallo\r\n$5\r\nhello\r\n$5\r\nhxllo\r\n$4\r\nlist\r\n"},
+		{c, req("KEYS", "h[ae]llo"), "*2\r\n$5\r\nhallo\r\n$5\r\nhello\r\n"},
+		{c, req("KEYS", "h[^e]llo"), "*3\r\n$5\r\nh*llo\r\n$5\r\nhallo\r\n$5\r\nhxllo\r\n"},
+		{c, req("KEYS", "h[a-f]llo"), "*2\r\n$5\r\nhallo\r\n$5\r\nhello\r\n"},
+		{c, req("KEYS", "h\\*llo"), "*1\r\n$5\r\nh*llo\r\n"},
+		{c, req("KEYS", "nothing"), "*0\r\n"},
+		{c, req("SCAN", "0", "TYPE", "list"), "*2\r\n$1\r\n0\r\n*1\r\n$4\r\nlist\r\n"},
+		{c, req("SCAN", "0", "MATCH", "h?llo", "TYPE", "string", "COUNT", "100"), "*2\r\n$1\r\n0\r\n*4\r\n$5\r\nhallo\r\n$5\r\nhello\r\n$5\r\nhxllo\r\n$5\r\nh*llo\r\n"},
+		{c, req("SCAN", "x"), "-ERROR invalid cursor\r\n"},
+		{c, req("SCAN", "0", "COUNT", "0"), "-ERROR syntax error\r\n"},
+		{c, req("SSCAN", "s", "0", "TYPE", "set"), "-ERROR syntax error\r\n"},
+
+		{c, req("ZADD", "z", "1", "a", "2", "b", "3", "c"), ":3\r\n"},
+		{c, req("ZSCAN", "z", "0", "COUNT", "2"), "*2\r\n$10\r\n3859557459\r\n*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{c, req("ZREM", "z", "a"), ":1\r\n"},
+		{c, req("ZSCAN", "z", "3859557459", "COUNT", "2"), "*2\r\n$1\r\n0\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{c, req("ZSCAN", "z", "0", "MATCH", "[c-z]"), "*2\r\n$1\r\n0\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{c, req("ZSCAN", "list", "0"), "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+	})
+}
+
+func TestDefaultHandlerScanMutations(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+
+	apply := func(name string, args ...string) ReplyWriter {
+		r := req(name, args...)
+		r.Client = c
+		reply, err := srv.Apply(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return reply
+	}
+	for i := 0; i < 200; i++ {
+		apply("SET", "stable"+strconv.Itoa(i), "v")
+	}
+	seen := map[string]bool{}
+	cursor := "0"
+	for i := 0; ; i++ {
+		reply := apply("SCAN", cursor, "COUNT", "7").(*MultiBulkReply)
+		cursor = string(reply.values[0].([]byte))
+		for _, key := range reply.values[1].([]interface{}) {
+			seen[string(key.([]byte))] = true
+		}
+		// Other clients add and remove keys during the iteration,
+		// including the ones already returned.
+		apply("SET", "new"+strconv.Itoa(i), "v")
+		apply("DEL", "new"+strconv.Itoa(i-1))
+		if keys := reply.values[1].([]interface{}); len(keys) > 0 {
+			apply("DEL", string(keys[0].([]byte)))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if !seen["stable"+strconv.Itoa(i)] {
+			t.Fatalf("Expected SCAN to return stable%d", i)
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		apply("SADD", "s", "stable"+strconv.Itoa(i))
+	}
+	seen = map[string]bool{}
+	cursor = "0"
+	for i := 0; ; i++ {
+		reply := apply("SSCAN", "s", cursor, "COUNT", "7").(*MultiBulkReply)
+		cursor = string(reply.values[0].([]byte))
+		for _, m := range reply.values[1].([]interface{}) {
+			seen[string(m.([]byte))] = true
+		}
+		apply("SADD", "s", "new"+strconv.Itoa(i))
+		apply("SREM", "s", "new"+strconv.Itoa(i-1))
+		if members := reply.values[1].([]interface{}); len(members) > 0 {
+			apply("SREM", "s", string(members[0].([]byte)))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if !seen["stable"+strconv.Itoa(i)] {
+			t.Fatalf("Expected SSCAN to return stable%d", i)
+		}
+	}
+}
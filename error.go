@@ -14,6 +14,30 @@ var (
 	ErrExpectPositivInteger = NewError("Expected positive integer")
 	ErrExpectMorePair       = NewError("Expected at least one key val pair")
 	ErrExpectEvenPair       = NewError("Got uneven number of key val pairs")
+	ErrInvalidDbIndex       = NewError("invalid DB index")
+	ErrDbIndexOutOfRange    = NewError("DB index is out of range")
+	ErrSameObject           = NewError("source and destination objects are the same")
+	ErrSyntax               = NewError("syntax error")
+	ErrNotInteger           = NewError("value is not an integer or out of range")
+	ErrNotFloat             = NewError("value is not a valid float")
+	ErrInvalidTimeout       = NewError("timeout is not a float or out of range")
+	ErrOverflow             = NewError("increment or decrement would overflow")
+	ErrNaN                  = NewError("increment would produce NaN or Infinity")
+	ErrOffsetOutOfRange     = NewError("offset is out of range")
+	ErrNoSuchKey            = NewError("no such key")
+	ErrIndexOutOfRange      = NewError("index out of range")
+	ErrStringTooLong        = NewError("string exceeds maximum allowed size (proto-max-bulk-len)")
+	ErrWrongType            = &ErrorReply{code: "WRONGTYPE", message: "Operation against a key holding the wrong kind of value"}
+	ErrNoAuth               = &ErrorReply{code: "NOAUTH", message: "Authentication required."}
+	ErrWrongPass            = &ErrorReply{code: "WRONGPASS", message: "invalid username-password pair or user is disabled."}
+	ErrNoPermKey            = &ErrorReply{code: "NOPERM", message: "No permissions to access a key"}
+	ErrNoProto              = &ErrorReply{code: "NOPROTO", message: "unsupported protocol version"}
+	ErrNestedMulti          = NewError("MULTI calls can not be nested")
+	ErrExecNoMulti          = NewError("EXEC without MULTI")
+	ErrDiscardNoMulti       = NewError("DISCARD without MULTI")
+	ErrWatchInMulti         = NewError("WATCH inside MULTI is not allowed")
+	ErrExecAbort            = &ErrorReply{code: "EXECABORT", message: "Transaction discarded because of previous errors."}
+	ErrNotBlocking          = NewError("command not flagged CmdBlocking can not block")
 )
 
 var (
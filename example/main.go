@@ -15,9 +15,9 @@ func (h *MyHandler) Test() ([]byte, error) {
 }
 
 // Get override the DefaultHandler's method.
-func (h *MyHandler) Get(key string) ([]byte, error) {
+func (h *MyHandler) Get(client *redis.Client, key string) ([]byte, error) {
 	// However, we still can call the DefaultHandler GET method and use it.
-	ret, err := h.DefaultHandler.Get(key)
+	ret, err := h.DefaultHandler.Get(client, key)
 	if ret == nil {
 		return nil, err
 	}
@@ -0,0 +1,161 @@
+package redis
+
+import (
+	"time"
+)
+
+const (
+	// sweepInterval is the delay between two runs of the sweeper, which
+	// deletes expired keys nobody accessed.
+	sweepInterval = 100 * time.Millisecond
+	// sweepSamples is the number of keys with an expiration checked per
+	// shard at each round of the sweeper.
+	sweepSamples = 20
+)
+
+// Clock is the time source of the expiration subsystem. Tests can replace
+// it to expire keys without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+func (db *Database) now() time.Time {
+	if db.clock == nil {
+		return time.Now()
+	}
+	return db.clock.Now()
+}
+
+// expired reports whether key has an expiration time in the past. Expired
+// keys are treated as missing until they are removed.
+// The shard owning key must be locked.
+func (db *Database) expired(key string) bool {
+	t, volatile := db.expiration(key)
+	return volatile && !db.now().Before(t)
+}
+
+// expiration returns the time key expires at, if it has an expiration.
+// The shard owning key must be locked.
+func (db *Database) expiration(key string) (time.Time, bool) {
+	v, exists := db.shard(key).keys[key]
+	if !exists || v.expires.IsZero() {
+		return time.Time{}, false
+	}
+	return v.expires, true
+}
+
+// removeIfExpired deletes key if it expired. Commands modifying a key call
+// it first so that they never see stale data.
+// The shard owning key must be write-locked.
+func (db *Database) removeIfExpired(key string) bool {
+	if !db.expired(key) {
+		return false
+	}
+	db.remove(key)
+	return true
+}
+
+// remove deletes key whatever its type, along with its expiration.
+// The shard owning key must be write-locked.
+func (db *Database) remove(key string) {
+	s := db.shard(key)
+	delete(s.keys, key)
+	delete(s.volatile, key)
+}
+
+// setExpire makes key expire at t. key must exist.
+// The shard owning key must be write-locked.
+func (db *Database) setExpire(key string, t time.Time) {
+	s := db.shard(key)
+	s.keys[key].expires = t
+	s.volatile[key] = struct{}{}
+	db.scheduleSweep()
+}
+
+// persist removes the expiration of key, reporting whether it had one.
+// The shard owning key must be write-locked.
+func (db *Database) persist(key string) bool {
+	s := db.shard(key)
+	v, exists := s.keys[key]
+	if !exists || v.expires.IsZero() {
+		return false
+	}
+	v.expires = time.Time{}
+	delete(s.volatile, key)
+	return true
+}
+
+// sweep deletes expired keys, sampling sweepSamples keys with an expiration
+// per shard. Like redis, it samples a shard again as long as more than a
+// quarter of the keys were expired. It returns the number of keys removed.
+func (db *Database) sweep() int {
+	removed := 0
+	for _, s := range db.shards {
+		for {
+			s.Lock()
+			now := db.now()
+			sampled, expired := 0, 0
+			for key := range s.volatile {
+				if sampled == sweepSamples {
+					break
+				}
+				sampled++
+				if !now.Before(s.keys[key].expires) {
+					db.remove(key)
+					expired++
+				}
+			}
+			s.Unlock()
+			removed += expired
+			if expired <= sweepSamples/4 {
+				break
+			}
+		}
+	}
+	return removed
+}
+
+// volatileKeys returns the number of keys with an expiration.
+func (db *Database) volatileKeys() int {
+	count := 0
+	for _, s := range db.shards {
+		s.RLock()
+		count += len(s.volatile)
+		s.RUnlock()
+	}
+	return count
+}
+
+// scheduleSweep arms the sweeper, unless it is already armed. It only runs
+// while some keys have an expiration, so idle databases cost nothing.
+func (db *Database) scheduleSweep() {
+	db.sweepMu.Lock()
+	defer db.sweepMu.Unlock()
+	if db.sweeper == nil && !db.closed {
+		db.sweeper = time.AfterFunc(sweepInterval, db.runSweeper)
+	}
+}
+
+func (db *Database) runSweeper() {
+	db.sweep()
+
+	// Disarm before counting, so that an expiration set in between
+	// arms the sweeper again.
+	db.sweepMu.Lock()
+	db.sweeper = nil
+	db.sweepMu.Unlock()
+	if db.volatileKeys() > 0 {
+		db.scheduleSweep()
+	}
+}
+
+// close stops the sweeper of a database that is no longer used.
+func (db *Database) close() {
+	db.sweepMu.Lock()
+	defer db.sweepMu.Unlock()
+	db.closed = true
+	if db.sweeper != nil {
+		db.sweeper.Stop()
+		db.sweeper = nil
+	}
+}
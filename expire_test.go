@@ -0,0 +1,231 @@
+package redis
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newExpireServer(t *testing.T) (*Server, *DefaultHandler, *fakeClock) {
+	clock := newFakeClock()
+	h := NewDefaultHandler()
+	h.Clock = clock
+	srv, err := NewServer(DefaultConfig().Handler(h))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return srv, h, clock
+}
+
+func TestDefaultHandlerExpire(t *testing.T) {
+	srv, _, clock := newExpireServer(t)
+	c := newClient("c")
+	now := clock.Now().Unix()
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SET", "key", "v"), "+OK\r\n"},
+		{c, req("TTL", "key"), ":-1\r\n"},
+		{c, req("TTL", "missing"), ":-2\r\n"},
+		{c, req("EXPIRE", "missing", "10"), ":0\r\n"},
+		{c, req("EXPIRE", "key", "10"), ":1\r\n"},
+		{c, req("TTL", "key"), ":10\r\n"},
+		{c, req("PTTL", "key"), ":10000\r\n"},
+		{c, req("EXPIRE", "key", "x"), "-ERROR Expected integer\r\n"},
+		{c, req("EXPIRE", "key", "9223372036854775807"), "-ERROR invalid expire time in 'expire' command\r\n"},
+		{c, req("PEXPIRE", "key", "-9223372036854775807"), "-ERROR invalid expire time in 'pexpire' command\r\n"},
+		{c, req("EXPIREAT", "key", "9223372036854775807"), "-ERROR invalid expire time in 'expireat' command\r\n"},
+		{c, req("TTL", "key"), ":10\r\n"},
+		{c, req("RPUSH", "list", "a"), ":1\r\n"},
+		{c, req("PEXPIRE", "list", "1500"), ":1\r\n"},
+		{c, req("HSET", "hash", "f", "v"), ":1\r\n"},
+		{c, req("EXPIREAT", "hash", strconv.FormatInt(now+20, 10)), ":1\r\n"},
+		{c, req("TTL", "hash"), ":20\r\n"},
+		{c, req("SET", "persistent", "v"), "+OK\r\n"},
+		{c, req("PEXPIREAT", "persistent", strconv.FormatInt(now*1000+5000, 10)), ":1\r\n"},
+		{c, req("PERSIST", "persistent"), ":1\r\n"},
+		{c, req("PERSIST", "persistent"), ":0\r\n"},
+		{c, req("DBSIZE"), ":4\r\n"},
+	})
+
+	clock.advance(1500 * time.Millisecond)
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("LRANGE", "list", "0", "-1"), "*0\r\n"},
+		{c, req("TTL", "list"), ":-2\r\n"},
+		{c, req("TTL", "key"), ":9\r\n"},
+		{c, req("PTTL", "key"), ":8500\r\n"},
+		{c, req("DBSIZE"), ":3\r\n"},
+		// A new list does not inherit the expiration.
+		{c, req("RPUSH", "list", "b"), ":1\r\n"},
+		{c, req("TTL", "list"), ":-1\r\n"},
+	})
+
+	clock.advance(10 * time.Second)
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("GET", "key"), "$-1\r\n"},
+		{c, req("EXPIRE", "key", "10"), ":0\r\n"},
+		{c, req("HGET", "hash", "f"), "$1\r\nv\r\n"},
+		{c, req("GET", "persistent"), "$1\r\nv\r\n"},
+		{c, req("DEL", "key", "persistent"), ":1\r\n"},
+		// A time in the past deletes the key.
+		{c, req("EXPIRE", "hash", "-1"), ":1\r\n"},
+		{c, req("HGETALL", "hash"), "*0\r\n"},
+	})
+}
+
+func TestDefaultHandlerSetOptions(t *testing.T) {
+	srv, _, clock := newExpireServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SET", "key", "v1", "EX", "10"), "+OK\r\n"},
+		{c, req("TTL", "key"), ":10\r\n"},
+		{c, req("SET", "key", "v2", "KEEPTTL"), "+OK\r\n"},
+		{c, req("TTL", "key"), ":10\r\n"},
+		{c, req("SET", "key", "v3"), "+OK\r\n"},
+		{c, req("TTL", "key"), ":-1\r\n"},
+		{c, req("SET", "key", "v4", "px", "2500"), "+OK\r\n"},
+		{c, req("PTTL", "key"), ":2500\r\n"},
+		{c, req("SET", "key", "v5", "NX"), "$-1\r\n"},
+		{c, req("SET", "new", "v", "XX"), "$-1\r\n"},
+		{c, req("SET", "new", "v", "NX", "GET"), "$-1\r\n"},
+		{c, req("SET", "new", "w", "XX", "GET"), "$1\r\nv\r\n"},
+		{c, req("SET", "new", "x", "NX", "GET"), "$1\r\nw\r\n"},
+		{c, req("GET", "new"), "$1\r\nw\r\n"},
+		{c, req("SET", "at", "v", "EXAT", strconv.FormatInt(clock.Now().Unix()+30, 10)), "+OK\r\n"},
+		{c, req("TTL", "at"), ":30\r\n"},
+
+		{c, req("SET", "key", "v", "NX", "XX"), "-ERROR syntax error\r\n"},
+		{c, req("SET", "key", "v", "EX", "1", "PX", "1"), "-ERROR syntax error\r\n"},
+		{c, req("SET", "key", "v", "EX", "1", "KEEPTTL"), "-ERROR syntax error\r\n"},
+		{c, req("SET", "key", "v", "EX"), "-ERROR syntax error\r\n"},
+		{c, req("SET", "key", "v", "EX", "x"), "-ERROR Expected integer\r\n"},
+		{c, req("SET", "key", "v", "EX", "0"), "-ERROR invalid expire time in 'set' command\r\n"},
+		{c, req("SET", "key", "v", "EX", "9223372036854775807"), "-ERROR invalid expire time in 'set' command\r\n"},
+		{c, req("SET", "key", "v", "PX", "9223372036854775807"), "-ERROR invalid expire time in 'set' command\r\n"},
+		{c, req("SET", "key", "v", "EXAT", "9223372036854775807"), "-ERROR invalid expire time in 'set' command\r\n"},
+		{c, req("SET", "key", "v", "BOGUS"), "-ERROR syntax error\r\n"},
+		{c, req("GET", "key"), "$2\r\nv4\r\n"},
+
+		{c, req("SETEX", "ex", "5", "v"), "+OK\r\n"},
+		{c, req("TTL", "ex"), ":5\r\n"},
+		{c, req("SETEX", "ex", "0", "v"), "-ERROR invalid expire time in 'setex' command\r\n"},
+		{c, req("SETEX", "ex", "9223372036854775807", "v"), "-ERROR invalid expire time in 'setex' command\r\n"},
+		{c, req("PSETEX", "pex", "500", "v"), "+OK\r\n"},
+		{c, req("PTTL", "pex"), ":500\r\n"},
+	})
+
+	clock.advance(3 * time.Second)
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("GET", "key"), "$-1\r\n"},
+		{c, req("GET", "pex"), "$-1\r\n"},
+		{c, req("SET", "key", "v", "XX"), "$-1\r\n"},
+		{c, req("SET", "key", "v", "NX"), "+OK\r\n"},
+		{c, req("GET", "ex"), "$1\r\nv\r\n"},
+	})
+}
+
+func TestDefaultHandlerMoveExpire(t *testing.T) {
+	srv, _, clock := newExpireServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SET", "key", "v", "EX", "10"), "+OK\r\n"},
+		{c, req("MOVE", "key", "1"), ":1\r\n"},
+		{c, req("SELECT", "1"), "+OK\r\n"},
+		{c, req("TTL", "key"), ":10\r\n"},
+	})
+	clock.advance(10 * time.Second)
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("MOVE", "key", "0"), ":0\r\n"},
+		{c, req("DBSIZE"), ":0\r\n"},
+	})
+}
+
+func TestDatabaseSweep(t *testing.T) {
+	clock := newFakeClock()
+	db := NewDatabase(nil)
+	db.clock = clock
+	defer db.close()
+
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		unlock := db.lock(key)
+		db.setString(key, []byte("v"))
+		if i%2 == 0 {
+			db.setExpire(key, clock.Now().Add(time.Second))
+		}
+		unlock()
+	}
+	if n := db.sweep(); n != 0 {
+		t.Fatalf("Expected no key to be swept, got %d", n)
+	}
+	clock.advance(time.Second)
+	// Expired keys are not counted, even before they are removed.
+	if n := db.size(); n != 500 {
+		t.Fatalf("Expected 500 keys, got %d", n)
+	}
+	// Expired keys keep being sampled while most samples are expired.
+	if n := db.sweep(); n < 500-dbShardCount*sweepSamples/4 {
+		t.Fatalf("Expected most of the expired keys to be swept, got %d", n)
+	}
+}
+
+func TestDatabaseSweeper(t *testing.T) {
+	db := NewDatabase(nil)
+	defer db.close()
+
+	unlock := db.lock("key")
+	db.setString("key", []byte("v"))
+	db.setExpire("key", time.Now().Add(time.Millisecond))
+	unlock()
+
+	// The sweeper removes the key, then stops since no key has an
+	// expiration anymore.
+	armed := func() bool {
+		db.sweepMu.Lock()
+		defer db.sweepMu.Unlock()
+		return db.sweeper != nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for db.volatileKeys() > 0 || armed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the sweeper to remove the key and stop (%d keys left)", db.volatileKeys())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDefaultHandlerRenameExpire(t *testing.T) {
+	srv, _, _ := newExpireServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SET", "key", "v", "EX", "10"), "+OK\r\n"},
+		{c, req("SET", "other", "v", "EX", "20"), "+OK\r\n"},
+		{c, req("RENAME", "key", "other"), "+OK\r\n"},
+		{c, req("TTL", "other"), ":10\r\n"},
+		{c, req("COPY", "other", "copy"), ":1\r\n"},
+		{c, req("TTL", "copy"), ":10\r\n"},
+		{c, req("SET", "persistent", "v"), "+OK\r\n"},
+		{c, req("RENAME", "persistent", "copy"), "+OK\r\n"},
+		{c, req("TTL", "copy"), ":-1\r\n"},
+	})
+}
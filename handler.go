@@ -1,10 +1,24 @@
 package redis
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"strings"
 )
 
+// subscribedCommands are the only commands a RESP2 connection can run while
+// subscribed to channels or patterns.
+var subscribedCommands = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+	"reset":        true,
+}
+
 type HandlerFn func(r *Request) (ReplyWriter, error)
 
 func (srv *Server) RegisterFct(key string, f interface{}) error {
@@ -27,16 +41,87 @@ func (srv *Server) Register(name string, fn HandlerFn) {
 	}
 }
 
+// Apply runs the command of r. Within a transaction, commands are queued
+// until EXEC instead. RESP2 connections subscribed to channels can only
+// run the subscribedCommands.
 func (srv *Server) Apply(r *Request) (ReplyWriter, error) {
 	if srv == nil || srv.methods == nil {
 		Debugf("The method map is uninitialized")
 		return ErrMethodNotSupported, nil
 	}
-	fn, exists := srv.methods[strings.ToLower(r.Name)]
+	name := strings.ToLower(r.Name)
+	spec := srv.commandSpec(name)
+	queue := r.Client != nil && r.Client.multi != nil && spec.Flags&CmdTransaction == 0
+	fn, exists := srv.methods[name]
 	if !exists {
+		if queue {
+			r.Client.multi.aborted = true
+		}
 		return ErrMethodNotSupported, nil
 	}
-	return fn(r)
+	if reply := srv.checkPermissions(r); reply != nil {
+		if queue {
+			r.Client.multi.aborted = true
+		}
+		return reply, nil
+	}
+	if r.Client != nil && r.Client.subscriptions > 0 && !r.resp3() {
+		if !subscribedCommands[name] {
+			return NewError(fmt.Sprintf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", name)), nil
+		}
+		if name == "ping" && len(r.Args) <= 1 {
+			message := []byte{}
+			if len(r.Args) == 1 {
+				message = r.Args[0]
+			}
+			return &MultiBulkReply{values: []interface{}{[]byte("pong"), message}}, nil
+		}
+	}
+	if queue {
+		r.Client.multi.queue = append(r.Client.multi.queue, r)
+		return &StatusReply{code: "QUEUED"}, nil
+	}
+	// Pub/sub commands touch no key, and PUBLISH may wait for subscribers.
+	if spec.Flags&(CmdTransaction|CmdPubSub) == 0 {
+		srv.txMu.RLock()
+		defer srv.txMu.RUnlock()
+		if c := r.Client; c != nil && spec.Flags&CmdBlocking != 0 {
+			c.tx = &srv.txMu
+			defer func() { c.tx = nil }()
+		} else if c != nil {
+			c.txLocked = true
+			defer func() { c.txLocked = false }()
+		}
+	}
+	reply, err := srv.call(r, fn, spec)
+	if err == nil && r.Client != nil {
+		r.Client.countSubscriptions(reply)
+	}
+	return reply, err
+}
+
+// call runs fn and, if it may have modified keys, marks the clients
+// watching them.
+func (srv *Server) call(r *Request, fn HandlerFn, spec CommandSpec) (ReplyWriter, error) {
+	parent := r.ctx
+	ctx, cancel := srv.requestContext(r)
+	defer func() {
+		cancel()
+		r.ctx = parent
+	}()
+	r.ctx = ctx
+
+	reply, err := fn(r)
+	if err != nil {
+		return reply, err
+	}
+	if _, failed := reply.(*ErrorReply); !failed && spec.Flags&CmdWrite != 0 {
+		srv.touch(r, spec)
+	}
+	if r.resp3() {
+		return reply, nil
+	}
+	return resp2Reply(reply), nil
 }
 
 func (srv *Server) ApplyString(r *Request) (string, error) {
@@ -46,3 +131,40 @@ func (srv *Server) ApplyString(r *Request) (string, error) {
 	}
 	return ReplyToString(reply)
 }
+
+// requestContext returns the context handlers receive for the command of r.
+// It carries the client, see ClientFromContext, and is cancelled when the
+// client disconnects, when the server shuts down, once the command returns,
+// or after the CommandTimeout.
+func (srv *Server) requestContext(r *Request) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(r.Context(), clientContextKey, r.Client)
+	var cancel context.CancelFunc
+	if srv.commandTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, srv.commandTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	// Requests not read by ServeClient do not derive from the server
+	// context.
+	stop := context.AfterFunc(srv.baseContext(), cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// contextKey is the type of the keys of the values the server stores in
+// the contexts of requests.
+type contextKey struct {
+	name string
+}
+
+var clientContextKey = &contextKey{"client"}
+
+// ClientFromContext returns the client that sent the command of a context
+// passed to a handler, nil if there is none. Its Id and Username tell who
+// runs the command.
+func ClientFromContext(ctx context.Context) *Client {
+	c, _ := ctx.Value(clientContextKey).(*Client)
+	return c
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"io/ioutil"
-	"strings"
 	"testing"
 )
 
@@ -36,7 +35,7 @@ func TestParseBadRequests(t *testing.T) {
 		"*2\r\n$3\r\ngEt\r\n$100\r\nx\r\n",
 	}
 	for _, v := range requests {
-		_, err := parseRequest(ioutil.NopCloser(strings.NewReader(v)))
+		_, err := parseRequest(r(v))
 		if err == nil {
 			t.Fatalf("Expected error for request [%s]", v)
 		}
@@ -55,7 +54,7 @@ func TestSucess(t *testing.T) {
 	}
 
 	for _, p := range expected {
-		request, err := parseRequest(ioutil.NopCloser(strings.NewReader(p.s)))
+		request, err := parseRequest(r(p.s))
 		if err != nil {
 			t.Fatalf("Un xxpected eror %s when parsting", err, p.s)
 		}
@@ -73,6 +72,27 @@ func TestSucess(t *testing.T) {
 	}
 }
 
+func TestParsePipelined(t *testing.T) {
+	reader := r("*2\r\n$3\r\nGET\r\n$1\r\na\r\nPING\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\nc\r\n")
+	expected := []Request{
+		{Name: "get", Args: b("a")},
+		{Name: "ping"},
+		{Name: "set", Args: b("b", "c")},
+	}
+	for _, p := range expected {
+		request, err := parseRequest(reader)
+		if err != nil {
+			t.Fatalf("Unexpected error %s when parsing %s", err, p.Name)
+		}
+		if request.Name != p.Name || len(request.Args) != len(p.Args) {
+			t.Fatalf("Expected %s %q, got %s %q", p.Name, p.Args, request.Name, request.Args)
+		}
+	}
+	if reader.Buffered() != 0 {
+		t.Fatalf("Expected every byte to be consumed, %d left", reader.Buffered())
+	}
+}
+
 func b(args ...string) [][]byte {
 	arr := make([][]byte, len(args))
 	for i := 0; i < len(args); i += 1 {
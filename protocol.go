@@ -0,0 +1,154 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// serverVersion is the version of redis whose protocol the server speaks,
+// as reported by HELLO.
+const serverVersion = "6.0.0"
+
+// resp3 reports whether the reply to r should use the RESP3 encoding.
+func (r *Request) resp3() bool {
+	return r.Client != nil && r.Client.Protocol == 3
+}
+
+// helloCommand implements HELLO [protover [AUTH username password]
+// [SETNAME clientname]], which switches the connection protocol and
+// replies with information about the server.
+func (srv *Server) helloCommand(r *Request) (ReplyWriter, error) {
+	if r.Client == nil {
+		r.Client = newClient(r.Host)
+	}
+	protocol := r.Client.Protocol
+	if protocol == 0 {
+		protocol = 2
+	}
+	if len(r.Args) > 0 {
+		v, err := strconv.Atoi(string(r.Args[0]))
+		if err != nil {
+			return NewError("Protocol version is not an integer or out of range"), nil
+		}
+		if v != 2 && v != 3 {
+			return ErrNoProto, nil
+		}
+		protocol = v
+	}
+
+	var name string
+	setName := false
+	a := srv.getACL()
+	for i := 1; i < len(r.Args); i++ {
+		switch opt := strings.ToLower(string(r.Args[i])); {
+		case opt == "auth" && i+2 < len(r.Args):
+			user, ok := a.authenticate(string(r.Args[i+1]), string(r.Args[i+2]))
+			if !ok {
+				return ErrWrongPass, nil
+			}
+			r.Client.user = user
+			i += 2
+		case opt == "setname" && i+1 < len(r.Args):
+			name, setName = string(r.Args[i+1]), true
+			i++
+		default:
+			return NewError("Syntax error in HELLO option '" + string(r.Args[i]) + "'"), nil
+		}
+	}
+	if r.Client.user == nil {
+		user, ok := a.authenticate(defaultUser, "")
+		if !ok {
+			return &ErrorReply{
+				code:    "NOAUTH",
+				message: "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time",
+			}, nil
+		}
+		r.Client.user = user
+	}
+	if setName {
+		r.Client.Name = name
+	}
+	r.Client.Protocol = protocol
+
+	info := []interface{}{
+		[]byte("server"), []byte("redis"),
+		[]byte("version"), []byte(serverVersion),
+		[]byte("proto"), protocol,
+		[]byte("id"), int(r.Client.Id),
+		[]byte("mode"), []byte("standalone"),
+		[]byte("role"), []byte("master"),
+		[]byte("modules"), []interface{}{},
+	}
+	if protocol == 3 {
+		return &MapReply{values: info}, nil
+	}
+	return &MultiBulkReply{values: info}, nil
+}
+
+// resp2Reply converts the RESP3 replies, including nested ones, to their
+// RESP2 equivalent for connections that did not switch protocol.
+func resp2Reply(reply ReplyWriter) ReplyWriter {
+	switch v := reply.(type) {
+	case *MapReply:
+		values, _ := resp2Values(v.values)
+		return &MultiBulkReply{values: values}
+	case *SetReply:
+		values, _ := resp2Values(v.values)
+		return &MultiBulkReply{values: values}
+	case *PushReply:
+		values, _ := resp2Values(v.values)
+		return &MultiBulkReply{values: values}
+	case *MultiBulkReply:
+		if values, changed := resp2Values(v.values); changed {
+			return &MultiBulkReply{values: values}
+		}
+	case *DoubleReply:
+		return &BulkReply{value: []byte(formatDouble(v.value))}
+	case *BooleanReply:
+		if v.value {
+			return &IntegerReply{number: 1}
+		}
+		return &IntegerReply{number: 0}
+	case *NullReply:
+		if v.array {
+			return &nullArrayReply{}
+		}
+		return &BulkReply{}
+	case *BigNumberReply:
+		return &BulkReply{value: []byte(v.value.String())}
+	case *VerbatimReply:
+		return &BulkReply{value: v.value}
+	}
+	return reply
+}
+
+// resp2Values converts the RESP3 replies among values. values is copied
+// only if it holds some.
+func resp2Values(values []interface{}) ([]interface{}, bool) {
+	changed := false
+	for i, value := range values {
+		var v interface{}
+		switch value := value.(type) {
+		case ReplyWriter:
+			converted := resp2Reply(value)
+			if converted == value {
+				continue
+			}
+			v = converted
+		case []interface{}:
+			nested, ok := resp2Values(value)
+			if !ok {
+				continue
+			}
+			v = nested
+		default:
+			continue
+		}
+		if !changed {
+			values = append([]interface{}(nil), values...)
+			changed = true
+		}
+		values[i] = v
+	}
+	return values, changed
+}
@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"strconv"
+	"testing"
+)
+
+type Resp3Handler struct{}
+
+func (h *Resp3Handler) SCORE(key string) (float64, error) {
+	return 1.5, nil
+}
+
+func (h *Resp3Handler) EXISTS(key string) (bool, error) {
+	return key == "yes", nil
+}
+
+func (h *Resp3Handler) INFO() (map[string]interface{}, error) {
+	return map[string]interface{}{"uptime": 42}, nil
+}
+
+func (h *Resp3Handler) MEMBERS() (*SetReply, error) {
+	return NewSetReply([]interface{}{[]byte("a")}), nil
+}
+
+func helloReply(protocol int, id int64) string {
+	prefix := "*14"
+	if protocol == 3 {
+		prefix = "%7"
+	}
+	idStr := strconv.FormatInt(id, 10)
+	return prefix + "\r\n" +
+		"$6\r\nserver\r\n$5\r\nredis\r\n" +
+		"$7\r\nversion\r\n$5\r\n6.0.0\r\n" +
+		"$5\r\nproto\r\n:" + strconv.Itoa(protocol) + "\r\n" +
+		"$2\r\nid\r\n:" + idStr + "\r\n" +
+		"$4\r\nmode\r\n$10\r\nstandalone\r\n" +
+		"$4\r\nrole\r\n$6\r\nmaster\r\n" +
+		"$7\r\nmodules\r\n*0\r\n"
+}
+
+func TestHello(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("HSET", "h", "k", "v"), ":1\r\n"},
+		{c, req("HGETALL", "h"), "*2\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{c, req("HELLO"), helloReply(2, c.Id)},
+		{c, req("HELLO", "4"), "-NOPROTO unsupported protocol version\r\n"},
+		{c, req("HELLO", "x"), "-ERROR Protocol version is not an integer or out of range\r\n"},
+		{c, req("HELLO", "3", "bogus"), "-ERROR Syntax error in HELLO option 'bogus'\r\n"},
+		{c, req("HELLO", "3", "SETNAME", "conn"), helloReply(3, c.Id)},
+		{c, req("HGETALL", "h"), "%1\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{c, req("HELLO", "2"), helloReply(2, c.Id)},
+		{c, req("HGETALL", "h"), "*2\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+	})
+	if c.Name != "conn" {
+		t.Fatalf("Expected the client name to be set, got %q", c.Name)
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().RequirePass("secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c := newClient("c")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("HELLO", "3"), "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n"},
+		{c, req("HELLO", "3", "AUTH", "default", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{c, req("PING"), "-NOAUTH Authentication required.\r\n"},
+		{c, req("HELLO", "3", "AUTH", "default", "secret"), helloReply(3, c.Id)},
+		{c, req("PING"), "+PONG\r\n"},
+	})
+}
+
+func TestResp3AutoHandler(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Handler(&Resp3Handler{}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c2, c3 := newClient("c2"), newClient("c3")
+	runHandlerTests(t, srv, []handlerTest{
+		{c3, req("HELLO", "3"), helloReply(3, c3.Id)},
+
+		{c2, req("SCORE", "k"), "$3\r\n1.5\r\n"},
+		{c2, req("EXISTS", "yes"), ":1\r\n"},
+		{c2, req("EXISTS", "no"), ":0\r\n"},
+		{c2, req("INFO"), "*2\r\n$6\r\nuptime\r\n:42\r\n"},
+		{c2, req("MEMBERS"), "*1\r\n$1\r\na\r\n"},
+
+		{c3, req("SCORE", "k"), ",1.5\r\n"},
+		{c3, req("EXISTS", "yes"), "#t\r\n"},
+		{c3, req("EXISTS", "no"), "#f\r\n"},
+		{c3, req("INFO"), "%1\r\n$6\r\nuptime\r\n:42\r\n"},
+		{c3, req("MEMBERS"), "~1\r\n$1\r\na\r\n"},
+	})
+}
@@ -0,0 +1,341 @@
+package redis
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSubscriberBuffer is the number of messages buffered for each
+// subscriber unless DefaultHandler.SubscriberBuffer says otherwise.
+const DefaultSubscriberBuffer = 1024
+
+// SlowConsumerPolicy tells what happens to a message published to a
+// subscriber whose buffer is full, because it does not read its messages
+// as fast as they are published.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDropOldest drops the oldest buffered message to make
+	// room for the new one.
+	SlowConsumerDropOldest SlowConsumerPolicy = iota
+	// SlowConsumerDisconnect closes the connection of the subscriber, like
+	// the redis client-output-buffer-limit for pubsub clients.
+	SlowConsumerDisconnect
+	// SlowConsumerBlock makes PUBLISH wait until the subscriber has room
+	// for the message.
+	SlowConsumerBlock
+)
+
+// PubSubStats counts the messages lost by slow subscribers. It is safe for
+// concurrent use.
+type PubSubStats struct {
+	dropped      int64
+	disconnected int64
+}
+
+// Dropped returns the number of messages that were published but never
+// delivered to a subscriber.
+func (s *PubSubStats) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Disconnected returns the number of subscribers disconnected by the
+// SlowConsumerDisconnect policy.
+func (s *PubSubStats) Disconnected() int64 {
+	return atomic.LoadInt64(&s.disconnected)
+}
+
+// subscriber holds the subscriptions of a client, and the channel its
+// messages are sent on.
+type subscriber struct {
+	client   *Client
+	messages chan []interface{}
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// quit is closed once the client has no subscription left.
+	quit chan struct{}
+
+	// mu guards the sends on messages. Once closed, no more messages
+	// are sent, and once disconnected, the messages are dropped.
+	mu           sync.Mutex
+	closed       bool
+	disconnected bool
+}
+
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// names returns the channels, or patterns, s subscribed to.
+func (s *subscriber) names(pattern bool) []string {
+	subs := s.channels
+	if pattern {
+		subs = s.patterns
+	}
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deliver queues message for s, applying policy if its buffer is full, and
+// reports whether it was queued.
+func (s *subscriber) deliver(message []interface{}, policy SlowConsumerPolicy, stats *PubSubStats) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.disconnected {
+		return false
+	}
+	for {
+		select {
+		case s.messages <- message:
+			return true
+		default:
+		}
+		switch policy {
+		case SlowConsumerBlock:
+			select {
+			case s.messages <- message:
+				return true
+			case <-s.quit:
+				return false
+			}
+		case SlowConsumerDisconnect:
+			s.disconnected = true
+			atomic.AddInt64(&stats.dropped, 1)
+			atomic.AddInt64(&stats.disconnected, 1)
+			s.client.disconnect()
+			return false
+		default:
+			select {
+			case <-s.messages:
+				atomic.AddInt64(&stats.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+// pubsub is the registry of the channels and patterns clients subscribed
+// to. It is safe for concurrent use.
+type pubsub struct {
+	mu          sync.RWMutex
+	channels    map[string]map[*subscriber]struct{}
+	patterns    map[string]map[*subscriber]struct{}
+	subscribers map[*Client]*subscriber
+}
+
+// oneShot returns a ChannelWriter only writing reply.
+func oneShot(reply []interface{}) *ChannelWriter {
+	c := make(chan []interface{})
+	close(c)
+	return &ChannelWriter{FirstReply: reply, Channel: c}
+}
+
+// registry returns the subscribers by channel, or by pattern.
+func (ps *pubsub) registry(pattern bool) map[string]map[*subscriber]struct{} {
+	if pattern {
+		if ps.patterns == nil {
+			ps.patterns = make(map[string]map[*subscriber]struct{})
+		}
+		return ps.patterns
+	}
+	if ps.channels == nil {
+		ps.channels = make(map[string]map[*subscriber]struct{})
+	}
+	return ps.channels
+}
+
+// subscribe subscribes client to channels, or patterns, replying with a
+// confirmation for each of them. The first subscription of a client also
+// streams its messages, buffering up to buffer of them, until it has no
+// subscription left.
+func (ps *pubsub) subscribe(client *Client, pattern bool, names []string, buffer int) *MultiChannelWriter {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+	if ps.subscribers == nil {
+		ps.subscribers = make(map[*Client]*subscriber)
+	}
+	s, subscribed := ps.subscribers[client]
+	if !subscribed {
+		s = &subscriber{
+			client:   client,
+			messages: make(chan []interface{}, buffer),
+			channels: make(map[string]struct{}),
+			patterns: make(map[string]struct{}),
+			quit:     make(chan struct{}),
+		}
+		ps.subscribers[client] = s
+		go ps.release(s)
+	}
+
+	registry := ps.registry(pattern)
+	ret := &MultiChannelWriter{Chans: make([]*ChannelWriter, 0, len(names))}
+	for _, name := range names {
+		subs := s.channels
+		if pattern {
+			subs = s.patterns
+		}
+		if _, exists := subs[name]; !exists {
+			subs[name] = struct{}{}
+			if registry[name] == nil {
+				registry[name] = make(map[*subscriber]struct{})
+			}
+			registry[name][s] = struct{}{}
+		}
+		ret.Chans = append(ret.Chans, oneShot([]interface{}{kind, []byte(name), s.count()}))
+	}
+	if !subscribed {
+		ret.Chans[len(ret.Chans)-1].Channel = s.messages
+	}
+	return ret
+}
+
+// unsubscribe unsubscribes client from channels, or patterns, or from all
+// of them if names is empty, replying with a confirmation for each of them.
+func (ps *pubsub) unsubscribe(client *Client, pattern bool, names []string) *MultiChannelWriter {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+	s := ps.subscribers[client]
+	count := 0
+	if s != nil {
+		count = s.count()
+		if len(names) == 0 {
+			names = s.names(pattern)
+		}
+	}
+	if len(names) == 0 {
+		return &MultiChannelWriter{Chans: []*ChannelWriter{oneShot([]interface{}{kind, nil, count})}}
+	}
+
+	ret := &MultiChannelWriter{Chans: make([]*ChannelWriter, 0, len(names))}
+	for _, name := range names {
+		if s != nil {
+			ps.drop(s, pattern, name)
+			count = s.count()
+		}
+		ret.Chans = append(ret.Chans, oneShot([]interface{}{kind, []byte(name), count}))
+	}
+	if s != nil && count == 0 {
+		ps.removeLocked(s)
+	}
+	return ret
+}
+
+func (ps *pubsub) drop(s *subscriber, pattern bool, name string) {
+	subs, registry := s.channels, ps.channels
+	if pattern {
+		subs, registry = s.patterns, ps.patterns
+	}
+	delete(subs, name)
+	delete(registry[name], s)
+	if len(registry[name]) == 0 {
+		delete(registry, name)
+	}
+}
+
+// removeLocked unsubscribes s from everything and ends its messages.
+func (ps *pubsub) removeLocked(s *subscriber) {
+	if ps.subscribers[s.client] != s {
+		return
+	}
+	for name := range s.channels {
+		ps.drop(s, false, name)
+	}
+	for name := range s.patterns {
+		ps.drop(s, true, name)
+	}
+	delete(ps.subscribers, s.client)
+	// Unblock the publishers waiting for room first.
+	close(s.quit)
+	s.mu.Lock()
+	s.closed = true
+	close(s.messages)
+	s.mu.Unlock()
+}
+
+// release removes s once its client is gone.
+func (ps *pubsub) release(s *subscriber) {
+	select {
+	case <-s.client.closed:
+		ps.mu.Lock()
+		ps.removeLocked(s)
+		ps.mu.Unlock()
+	case <-s.quit:
+	}
+}
+
+// publish sends message to the subscribers of channel and of the patterns
+// matching it, and returns how many received it. Messages are delivered
+// once the registry is unlocked, so that subscribers blocking PUBLISH do
+// not block the other clients.
+func (ps *pubsub) publish(channel string, message []byte, policy SlowConsumerPolicy, stats *PubSubStats) int {
+	type delivery struct {
+		s       *subscriber
+		message []interface{}
+	}
+	var deliveries []delivery
+	ps.mu.RLock()
+	for s := range ps.channels[channel] {
+		deliveries = append(deliveries, delivery{s, []interface{}{"message", []byte(channel), message}})
+	}
+	for pattern, subs := range ps.patterns {
+		if !matchPattern(pattern, channel) {
+			continue
+		}
+		for s := range subs {
+			deliveries = append(deliveries, delivery{s, []interface{}{"pmessage", []byte(pattern), []byte(channel), message}})
+		}
+	}
+	ps.mu.RUnlock()
+
+	n := 0
+	for _, d := range deliveries {
+		if d.s.deliver(d.message, policy, stats) {
+			n++
+		}
+	}
+	return n
+}
+
+// activeChannels returns the channels with subscribers matching pattern,
+// all of them if pattern is empty.
+func (ps *pubsub) activeChannels(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	names := []string{}
+	for name := range ps.channels {
+		if pattern == "" || matchPattern(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ps *pubsub) numsub(channel string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.channels[channel])
+}
+
+func (ps *pubsub) numpat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.patterns)
+}
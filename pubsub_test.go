@@ -0,0 +1,232 @@
+package redis
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPubSub(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	r := req("SUBSCRIBE", "news", "sports")
+	r.Client = c
+	reply, err := srv.Apply(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var stream bytes.Buffer
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		reply.WriteTo(&stream)
+	}()
+
+	other := newClient("other")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SUBSCRIBE", "news"), "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:2\r\n"},
+		{c, req("PSUBSCRIBE", "n*", "s[xy]*"),
+			"*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n" +
+				"*3\r\n$10\r\npsubscribe\r\n$6\r\ns[xy]*\r\n:4\r\n"},
+		{other, req("PUBSUB", "CHANNELS"), "*2\r\n$4\r\nnews\r\n$6\r\nsports\r\n"},
+		{other, req("PUBSUB", "CHANNELS", "n*"), "*1\r\n$4\r\nnews\r\n"},
+		{other, req("PUBSUB", "NUMSUB", "news", "none"), "*4\r\n$4\r\nnews\r\n:1\r\n$4\r\nnone\r\n:0\r\n"},
+		{other, req("PUBSUB", "NUMPAT"), ":2\r\n"},
+		{other, req("PUBSUB", "NOPE"), "-ERROR Unknown subcommand or wrong number of arguments for 'NOPE'\r\n"},
+		{c, req("UNSUBSCRIBE", "news", "none"),
+			"*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:3\r\n" +
+				"*3\r\n$11\r\nunsubscribe\r\n$4\r\nnone\r\n:3\r\n"},
+		{other, req("PUBLISH", "other", "lost"), ":0\r\n"},
+		{other, req("PUBLISH", "sports", "goal"), ":1\r\n"},
+		{other, req("PUBLISH", "nope", "pattern"), ":1\r\n"},
+		{c, req("PUNSUBSCRIBE"),
+			"*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:2\r\n" +
+				"*3\r\n$12\r\npunsubscribe\r\n$6\r\ns[xy]*\r\n:1\r\n"},
+		{other, req("PUBSUB", "NUMPAT"), ":0\r\n"},
+		{c, req("UNSUBSCRIBE"), "*3\r\n$11\r\nunsubscribe\r\n$6\r\nsports\r\n:0\r\n"},
+		{c, req("UNSUBSCRIBE"), "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n"},
+		{other, req("PUBSUB", "CHANNELS"), "*0\r\n"},
+	})
+
+	// The stream ends with the last subscription.
+	select {
+	case <-streamed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to end")
+	}
+	expected := "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n" +
+		"*3\r\n$9\r\nsubscribe\r\n$6\r\nsports\r\n:2\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$6\r\nsports\r\n$4\r\ngoal\r\n" +
+		"*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnope\r\n$7\r\npattern\r\n"
+	if stream.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, stream.String())
+	}
+}
+
+func TestPubSubDisconnect(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	r := req("PSUBSCRIBE", "*")
+	r.Client = c
+	if _, err := srv.Apply(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("SUBSCRIBE", "a"), "*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:2\r\n"},
+		{nil, req("PUBSUB", "NUMPAT"), ":1\r\n"},
+	})
+
+	c.close()
+	for deadline := time.Now().Add(time.Second); ; {
+		reply, err := srv.ApplyString(req("PUBSUB", "NUMPAT"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if reply == ":0\r\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the subscriptions to be removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{nil, req("PUBSUB", "CHANNELS"), "*0\r\n"},
+	})
+}
+
+// newPubSubServer returns a server whose subscribers buffer a single
+// message, handled by policy once full.
+func newPubSubServer(t *testing.T, policy SlowConsumerPolicy) (*Server, *DefaultHandler) {
+	h := NewDefaultHandler()
+	h.SubscriberBuffer = 1
+	h.SlowConsumers = policy
+	srv, err := NewServer(DefaultConfig().Handler(h))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return srv, h
+}
+
+// subscribe subscribes c to channel and returns the stream of its messages.
+func subscribe(t *testing.T, srv *Server, c *Client, channel string) ReplyWriter {
+	r := req("SUBSCRIBE", channel)
+	r.Client = c
+	reply, err := srv.Apply(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return reply
+}
+
+func TestPubSubDropOldest(t *testing.T) {
+	srv, h := newPubSubServer(t, SlowConsumerDropOldest)
+	c := newClient("c")
+	stream := subscribe(t, srv, c, "a")
+	runHandlerTests(t, srv, []handlerTest{
+		{nil, req("PUBLISH", "a", "1"), ":1\r\n"},
+		{nil, req("PUBLISH", "a", "2"), ":1\r\n"},
+		{nil, req("PUBLISH", "a", "3"), ":1\r\n"},
+		{c, req("UNSUBSCRIBE"), "*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:0\r\n"},
+	})
+	if h.PubSubStats.Dropped() != 2 || h.PubSubStats.Disconnected() != 0 {
+		t.Fatalf("Expected 2 dropped messages, got %d (%d disconnected)", h.PubSubStats.Dropped(), h.PubSubStats.Disconnected())
+	}
+	reply, err := ReplyToString(stream)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$1\r\n3\r\n"
+	if reply != expected {
+		t.Fatalf("Expected %q, got %q", expected, reply)
+	}
+}
+
+func TestPubSubDisconnectSlowConsumer(t *testing.T) {
+	srv, h := newPubSubServer(t, SlowConsumerDisconnect)
+	c := newClient("c")
+	subscribe(t, srv, c, "a")
+	runHandlerTests(t, srv, []handlerTest{
+		{nil, req("PUBLISH", "a", "1"), ":1\r\n"},
+		{nil, req("PUBLISH", "a", "2"), ":0\r\n"},
+		{nil, req("PUBLISH", "a", "3"), ":0\r\n"},
+	})
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the client to be disconnected")
+	}
+	if h.PubSubStats.Dropped() != 1 || h.PubSubStats.Disconnected() != 1 {
+		t.Fatalf("Expected 1 dropped message and 1 disconnection, got %d and %d", h.PubSubStats.Dropped(), h.PubSubStats.Disconnected())
+	}
+}
+
+func TestPubSubBlock(t *testing.T) {
+	srv, h := newPubSubServer(t, SlowConsumerBlock)
+	c := newClient("c")
+	stream := subscribe(t, srv, c, "a")
+	runHandlerTests(t, srv, []handlerTest{
+		{nil, req("PUBLISH", "a", "1"), ":1\r\n"},
+	})
+
+	published := make(chan string)
+	go func() {
+		reply, err := srv.ApplyString(req("PUBLISH", "a", "2"))
+		if err != nil {
+			reply = err.Error()
+		}
+		published <- reply
+	}()
+	select {
+	case reply := <-published:
+		t.Fatalf("Expected PUBLISH to wait, got %q", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The waiting publisher does not hold up transactions.
+	other := newClient("other")
+	runHandlerTests(t, srv, []handlerTest{
+		{other, req("MULTI"), "+OK\r\n"},
+		{other, req("SET", "k", "v"), "+QUEUED\r\n"},
+		{other, req("EXEC"), "*1\r\n+OK\r\n"},
+	})
+
+	// Reading the messages makes room.
+	var b bytes.Buffer
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		stream.WriteTo(&b)
+	}()
+	if reply := <-published; reply != ":1\r\n" {
+		t.Fatalf("Expected %q, got %q", ":1\r\n", reply)
+	}
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("UNSUBSCRIBE"), "*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:0\r\n"},
+	})
+	<-streamed
+	expected := "*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$1\r\n2\r\n"
+	if b.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, b.String())
+	}
+	if h.PubSubStats.Dropped() != 0 {
+		t.Fatalf("Expected no dropped message, got %d", h.PubSubStats.Dropped())
+	}
+	// Unsubscribing releases the waiting publishers.
+	subscribe(t, srv, c, "a")
+	runHandlerTests(t, srv, []handlerTest{
+		{nil, req("PUBLISH", "a", "1"), ":1\r\n"},
+	})
+	go func() {
+		reply, _ := srv.ApplyString(req("PUBLISH", "a", "2"))
+		published <- reply
+	}()
+	time.Sleep(10 * time.Millisecond)
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("UNSUBSCRIBE"), "*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:0\r\n"},
+	})
+	if reply := <-published; reply != ":0\r\n" {
+		t.Fatalf("Expected %q, got %q", ":0\r\n", reply)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"math"
+	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 )
 
@@ -75,6 +78,12 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 			return int64(wrote), err
 		}
 		return int64(wrote), err
+	case []interface{}:
+		// Nested multi bulk
+		return writeMultiBytes(v, w)
+	case ReplyWriter:
+		// Nested reply of another type (map, double, ...)
+		return v.WriteTo(w)
 	}
 
 	Debugf("Invalid type sent to writeBytes: %v", reflect.TypeOf(value).Name())
@@ -86,13 +95,27 @@ func (r *BulkReply) WriteTo(w io.Writer) (int64, error) {
 }
 
 type MonitorReply struct {
-	c <-chan string
+	c          <-chan string
+	clientChan <-chan struct{}
+	done       <-chan struct{}
 }
 
 func (r *MonitorReply) WriteTo(w io.Writer) (int64, error) {
 	statusReply := &StatusReply{}
 	totalBytes := int64(0)
-	for line := range r.c {
+	for {
+		var line string
+		select {
+		case <-r.clientChan:
+			return totalBytes, nil
+		case <-r.done:
+			return totalBytes, ErrServerClosed
+		case l, ok := <-r.c:
+			if !ok {
+				return totalBytes, nil
+			}
+			line = l
+		}
 		statusReply.code = line
 		if n, err := statusReply.WriteTo(w); err != nil {
 			totalBytes += n
@@ -101,7 +124,6 @@ func (r *MonitorReply) WriteTo(w io.Writer) (int64, error) {
 			totalBytes += n
 		}
 	}
-	return totalBytes, nil
 }
 
 //for nil reply in multi bulk just set []byte as nil
@@ -110,21 +132,35 @@ type MultiBulkReply struct {
 }
 
 func MultiBulkFromMap(m map[string]interface{}) *MultiBulkReply {
-	values := make([]interface{}, len(m)*2)
-	i := 0
-	for key, val := range m {
-		values[i] = []byte(key)
-		values[i+1] = val
-		i += 2
+	return &MultiBulkReply{values: flattenMap(m)}
+}
+
+// flattenMap returns the keys and values of m as alternating elements,
+// sorted by key so that replies are stable.
+func flattenMap(m map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]interface{}, 0, len(m)*2)
+	for _, key := range keys {
+		values = append(values, []byte(key), m[key])
 	}
-	return &MultiBulkReply{values: values}
+	return values
 }
 
 func writeMultiBytes(values []interface{}, w io.Writer) (int64, error) {
+	return writeAggregate('*', len(values), values, w)
+}
+
+// writeAggregate writes values as an aggregate of n elements (or pairs, for
+// maps) introduced by prefix.
+func writeAggregate(prefix byte, n int, values []interface{}, w io.Writer) (int64, error) {
 	if values == nil {
 		return 0, errors.New("Nil in multi bulk replies are not ok")
 	}
-	wrote, err := w.Write([]byte("*" + strconv.Itoa(len(values)) + "\r\n"))
+	wrote, err := w.Write([]byte(string(prefix) + strconv.Itoa(n) + "\r\n"))
 	if err != nil {
 		return int64(wrote), err
 	}
@@ -157,22 +193,34 @@ type MultiChannelWriter struct {
 	Chans []*ChannelWriter
 }
 
+// WriteTo writes the first reply of every ChannelWriter, in order, then
+// their messages as they come.
 func (c *MultiChannelWriter) WriteTo(w io.Writer) (n int64, err error) {
-	chans := make(chan struct{}, len(c.Chans))
 	for _, elem := range c.Chans {
-		go func(elem io.WriterTo) {
-			defer func() { chans <- struct{}{} }()
-			if n2, err2 := elem.WriteTo(w); err2 != nil {
-				n += n2
-				err = err2
-				return
-			} else {
-				n += n2
-			}
+		wrote, err := elem.writeMessage(elem.FirstReply, w)
+		n += wrote
+		if err != nil {
+			return n, err
+		}
+	}
+
+	type result struct {
+		n   int64
+		err error
+	}
+	results := make(chan result, len(c.Chans))
+	for _, elem := range c.Chans {
+		go func(elem *ChannelWriter) {
+			n, err := elem.stream(w)
+			results <- result{n, err}
 		}(elem)
 	}
-	for i := 0; i < len(c.Chans); i++ {
-		<-chans
+	for range c.Chans {
+		r := <-results
+		n += r.n
+		if r.err != nil {
+			err = r.err
+		}
 	}
 	return n, err
 }
@@ -181,31 +229,197 @@ type ChannelWriter struct {
 	FirstReply []interface{}
 	Channel    chan []interface{}
 	clientChan chan struct{}
+	done       <-chan struct{}
+	push       bool // RESP3 connection: messages are push replies
+}
+
+func (c *ChannelWriter) writeMessage(values []interface{}, w io.Writer) (int64, error) {
+	if c.push {
+		return writeAggregate('>', len(values), values, w)
+	}
+	return writeMultiBytes(values, w)
 }
 
 func (c *ChannelWriter) WriteTo(w io.Writer) (int64, error) {
-	totalBytes, err := writeMultiBytes(c.FirstReply, w)
+	totalBytes, err := c.writeMessage(c.FirstReply, w)
 	if err != nil {
 		return totalBytes, err
 	}
+	n, err := c.stream(w)
+	return totalBytes + n, err
+}
 
+// stream writes the messages received on Channel until it is closed, the
+// connection is done with or the server shuts down.
+func (c *ChannelWriter) stream(w io.Writer) (int64, error) {
+	var totalBytes int64
 	for {
 		select {
 		case <-c.clientChan:
-			return totalBytes, err
+			return totalBytes, nil
+		case <-c.done:
+			return totalBytes, ErrServerClosed
 		case reply := <-c.Channel:
 			if reply == nil {
 				return totalBytes, nil
-			} else {
-				wroteBytes, err := writeMultiBytes(reply, w)
-				// FIXME: obvious overflow here,
-				// Just ignore? Who cares?
-				totalBytes += wroteBytes
-				if err != nil {
-					return totalBytes, err
-				}
+			}
+			// Messages are written at once, for writers shared with
+			// other streams.
+			var b bytes.Buffer
+			if _, err := c.writeMessage(reply, &b); err != nil {
+				return totalBytes, err
+			}
+			wroteBytes, err := w.Write(b.Bytes())
+			totalBytes += int64(wroteBytes)
+			if err != nil {
+				return totalBytes, err
 			}
 		}
 	}
 	return totalBytes, nil
 }
+
+// RESP3 replies. They are sent as is to connections that switched to
+// protocol 3 with HELLO, and converted to their closest RESP2 equivalent
+// for the others (see resp2Reply).
+
+// MapReply holds alternating keys and values.
+type MapReply struct {
+	values []interface{}
+}
+
+// NewMapReply returns a map reply holding m, sorted by key.
+func NewMapReply(m map[string]interface{}) *MapReply {
+	return &MapReply{values: flattenMap(m)}
+}
+
+func (r *MapReply) WriteTo(w io.Writer) (int64, error) {
+	return writeAggregate('%', len(r.values)/2, r.values, w)
+}
+
+type SetReply struct {
+	values []interface{}
+}
+
+func NewSetReply(values []interface{}) *SetReply {
+	return &SetReply{values: values}
+}
+
+func (r *SetReply) WriteTo(w io.Writer) (int64, error) {
+	return writeAggregate('~', len(r.values), r.values, w)
+}
+
+// PushReply is an out of band message, such as a pub/sub message.
+type PushReply struct {
+	values []interface{}
+}
+
+func NewPushReply(values []interface{}) *PushReply {
+	return &PushReply{values: values}
+}
+
+func (r *PushReply) WriteTo(w io.Writer) (int64, error) {
+	return writeAggregate('>', len(r.values), r.values, w)
+}
+
+type DoubleReply struct {
+	value float64
+}
+
+func NewDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{value: value}
+}
+
+func (r *DoubleReply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("," + formatDouble(r.value) + "\r\n"))
+	return int64(n), err
+}
+
+// formatDouble formats f the way redis does, with inf, -inf and nan for
+// the special values.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+type BooleanReply struct {
+	value bool
+}
+
+func NewBooleanReply(value bool) *BooleanReply {
+	return &BooleanReply{value: value}
+}
+
+func (r *BooleanReply) WriteTo(w io.Writer) (int64, error) {
+	reply := "#f\r\n"
+	if r.value {
+		reply = "#t\r\n"
+	}
+	n, err := w.Write([]byte(reply))
+	return int64(n), err
+}
+
+type NullReply struct {
+	// array tells that the missing value is an array, which RESP2
+	// clients get as a null array rather than a null bulk string.
+	array bool
+}
+
+// NewNullArrayReply returns the reply for a missing array, like the
+// result of a blocking pop that timed out.
+func NewNullArrayReply() *NullReply {
+	return &NullReply{array: true}
+}
+
+func (r *NullReply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("_\r\n"))
+	return int64(n), err
+}
+
+// nullArrayReply is the RESP2 form of a null array.
+type nullArrayReply struct{}
+
+func (r *nullArrayReply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("*-1\r\n"))
+	return int64(n), err
+}
+
+type BigNumberReply struct {
+	value *big.Int
+}
+
+func NewBigNumberReply(value *big.Int) *BigNumberReply {
+	return &BigNumberReply{value: value}
+}
+
+func (r *BigNumberReply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("(" + r.value.String() + "\r\n"))
+	return int64(n), err
+}
+
+// VerbatimReply is a string along with its format, "txt" for plain text
+// or "mkd" for markdown.
+type VerbatimReply struct {
+	format string
+	value  []byte
+}
+
+func NewVerbatimReply(format string, value []byte) *VerbatimReply {
+	return &VerbatimReply{format: format, value: value}
+}
+
+func (r *VerbatimReply) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	b.WriteString("=" + strconv.Itoa(len(r.format)+1+len(r.value)) + "\r\n")
+	b.WriteString(r.format + ":")
+	b.Write(r.value)
+	b.WriteString("\r\n")
+	return b.WriteTo(w)
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"math"
+	"math/big"
 	"testing"
 )
 
@@ -38,6 +40,74 @@ func TestWriteStatus(t *testing.T) {
 	}
 }
 
+func TestWriteResp3(t *testing.T) {
+	n, _ := new(big.Int).SetString("3492890328409238509324850943850943825024385", 10)
+	replies := []struct {
+		reply    ReplyWriter
+		expected string
+	}{
+		{NewMapReply(map[string]interface{}{"b": 2, "a": []byte("x")}), "%2\r\n$1\r\na\r\n$1\r\nx\r\n$1\r\nb\r\n:2\r\n"},
+		{NewMapReply(map[string]interface{}{}), "%0\r\n"},
+		{NewSetReply([]interface{}{[]byte("a"), 1}), "~2\r\n$1\r\na\r\n:1\r\n"},
+		{NewPushReply([]interface{}{[]byte("message"), []byte("c"), []byte("hi")}), ">3\r\n$7\r\nmessage\r\n$1\r\nc\r\n$2\r\nhi\r\n"},
+		{NewDoubleReply(1.5), ",1.5\r\n"},
+		{NewDoubleReply(3), ",3\r\n"},
+		{NewDoubleReply(math.Inf(-1)), ",-inf\r\n"},
+		{NewBooleanReply(true), "#t\r\n"},
+		{NewBooleanReply(false), "#f\r\n"},
+		{&NullReply{}, "_\r\n"},
+		{NewNullArrayReply(), "_\r\n"},
+		{NewBigNumberReply(n), "(3492890328409238509324850943850943825024385\r\n"},
+		{NewVerbatimReply("txt", []byte("Some string")), "=15\r\ntxt:Some string\r\n"},
+		// Nested replies
+		{&MultiBulkReply{[]interface{}{NewBooleanReply(true), &NullReply{}}}, "*2\r\n#t\r\n_\r\n"},
+	}
+	for _, p := range replies {
+		var b bytes.Buffer
+		n, err := p.reply.WriteTo(&b)
+		if err != nil {
+			t.Fatalf("Oops, unexpected %s", err)
+		}
+		if val := b.String(); val != p.expected {
+			t.Fatalf("Oops, expected %q, got %q instead", p.expected, val)
+		}
+		if n != int64(len(p.expected)) {
+			t.Fatalf("Expected to write %d bytes, wrote %d instead", len(p.expected), n)
+		}
+	}
+}
+
+func TestResp2Reply(t *testing.T) {
+	replies := []struct {
+		reply    ReplyWriter
+		expected string
+	}{
+		{NewMapReply(map[string]interface{}{"a": 1}), "*2\r\n$1\r\na\r\n:1\r\n"},
+		{NewMapReply(map[string]interface{}{"a": NewMapReply(map[string]interface{}{"b": NewDoubleReply(0.5)})}), "*2\r\n$1\r\na\r\n*2\r\n$1\r\nb\r\n$3\r\n0.5\r\n"},
+		{NewSetReply([]interface{}{[]byte("a")}), "*1\r\n$1\r\na\r\n"},
+		{NewPushReply([]interface{}{[]byte("a")}), "*1\r\n$1\r\na\r\n"},
+		{NewDoubleReply(1.5), "$3\r\n1.5\r\n"},
+		{NewBooleanReply(true), ":1\r\n"},
+		{NewBooleanReply(false), ":0\r\n"},
+		{&NullReply{}, "$-1\r\n"},
+		{NewNullArrayReply(), "*-1\r\n"},
+		{&MultiBulkReply{[]interface{}{NewNullArrayReply()}}, "*1\r\n*-1\r\n"},
+		{NewBigNumberReply(big.NewInt(42)), "$2\r\n42\r\n"},
+		{NewVerbatimReply("txt", []byte("hi")), "$2\r\nhi\r\n"},
+		{&MultiBulkReply{[]interface{}{[]interface{}{NewBooleanReply(true)}, []byte("a")}}, "*2\r\n*1\r\n:1\r\n$1\r\na\r\n"},
+		{&StatusReply{code: "OK"}, "+OK\r\n"},
+	}
+	for _, p := range replies {
+		val, err := ReplyToString(resp2Reply(p.reply))
+		if err != nil {
+			t.Fatalf("Oops, unexpected %s", err)
+		}
+		if val != p.expected {
+			t.Fatalf("Oops, expected %q, got %q instead", p.expected, val)
+		}
+	}
+}
+
 func TestWriteBytes(t *testing.T) {
 	// Note: we test only failure here. Success is already tested.
 	if _, err := writeBytes([]byte("Hello World!"), NewFailWriter(1)); err == nil {
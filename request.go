@@ -1,6 +1,8 @@
 package redis
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"strconv"
 )
@@ -9,8 +11,32 @@ type Request struct {
 	Name       string
 	Args       [][]byte
 	Host       string
-	ClientChan chan struct{}
+	Client     *Client
+	ClientChan chan struct{} // closed once the client disconnected
 	Body       io.ReadCloser
+	TLS        *tls.ConnectionState // nil unless the connection uses TLS
+
+	ctx context.Context
+}
+
+// Context returns the context of the request. For requests read by
+// ServeClient, it is cancelled once the client disconnects; it is the
+// background context for the others.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
 }
 
 func (r *Request) HasArgument(index int) bool {
@@ -5,21 +5,217 @@
 package redis
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+// Shutdown or Close. Blocked commands and streaming replies (MONITOR,
+// SUBSCRIBE) are interrupted with it as well.
+var ErrServerClosed = errors.New("Server closed")
+
+const tlsHandshakeTimeout = 10 * time.Second
+
 type Server struct {
 	Proto        string
-	Addr         string // TCP address to listen on, ":6389" if empty
+	Addr         string      // TCP address to listen on, ":6389" if empty
+	TLSConfig    *tls.Config // optional, enables TLS in ListenAndServe
 	MonitorChans []chan string
 	methods      map[string]HandlerFn
+	monitorMu    sync.Mutex
+
+	mu         sync.Mutex
+	inShutdown int32 // accessed atomically
+	listeners  map[net.Listener]struct{}
+	conns      map[*conn]struct{}
+	doneChan   chan struct{}
+	acl        *acl
+	specs      map[string]CommandSpec
+
+	// ctx is cancelled when the server shuts down, with doneChan. The
+	// contexts of the requests derive from it.
+	ctx            context.Context
+	cancelCtx      context.CancelFunc
+	commandTimeout time.Duration
+
+	// txMu is held by EXEC while it runs a transaction, and by every
+	// other command while it runs, except while blocking commands wait,
+	// so that transactions are atomic.
+	txMu     sync.RWMutex
+	watchMu  sync.Mutex
+	watchers map[watchKey]map[*Client]struct{}
+}
+
+// connWriter serializes the writes of the command loop of a connection and
+// of the streams of messages it subscribed to, so that frames never
+// interleave.
+type connWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func (cw *connWriter) write(reply ReplyWriter) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	_, err := reply.WriteTo(cw.w)
+	return err
+}
+
+func (cw *connWriter) flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.w.Flush()
+}
+
+// Write writes a whole message of a stream and flushes it.
+func (cw *connWriter) Write(p []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	n, err := cw.w.Write(p)
+	if err == nil {
+		err = cw.w.Flush()
+	}
+	return n, err
+}
+
+// startStreams writes the first reply of each ChannelWriter, then has their
+// messages written as they come while the connection keeps reading commands.
+func (cw *connWriter) startStreams(chans ...*ChannelWriter) error {
+	cw.mu.Lock()
+	for _, c := range chans {
+		if _, err := c.writeMessage(c.FirstReply, cw.w); err != nil {
+			cw.mu.Unlock()
+			return err
+		}
+	}
+	cw.mu.Unlock()
+	for _, c := range chans {
+		go func(c *ChannelWriter) {
+			if _, err := c.stream(cw); err != nil {
+				Debugf("Stream error: %s", err)
+			}
+		}(c)
+	}
+	return nil
+}
+
+// streamingReply is a reply that keeps writing to the connection after its
+// command returns, like MONITOR or the messages of subscriptions.
+// ServeClient has it serve the connection instead of writing it once.
+type streamingReply interface {
+	ReplyWriter
+	serve(cw *connWriter, conn net.Conn) error
+}
+
+// serve sends what is pending, then writes the monitored commands to the
+// connection directly.
+func (r *MonitorReply) serve(cw *connWriter, conn net.Conn) error {
+	if err := cw.flush(); err != nil {
+		return err
+	}
+	_, err := r.WriteTo(conn)
+	return err
+}
+
+func (c *ChannelWriter) serve(cw *connWriter, conn net.Conn) error {
+	return cw.startStreams(c)
+}
+
+func (c *MultiChannelWriter) serve(cw *connWriter, conn net.Conn) error {
+	return cw.startStreams(c.Chans...)
+}
+
+// removeMonitor stops sending the commands to the monitor reading c.
+func (srv *Server) removeMonitor(c chan string) {
+	srv.monitorMu.Lock()
+	defer srv.monitorMu.Unlock()
+	for i, other := range srv.MonitorChans {
+		if other == c {
+			srv.MonitorChans = append(srv.MonitorChans[:i:i], srv.MonitorChans[i+1:]...)
+			return
+		}
+	}
+}
+
+// readConn copies what the client sends to w until the connection fails,
+// then calls gone. Being the only reader of the connection, it notices a
+// client going away while its command runs, without taking the bytes of
+// the next requests from the parser.
+func readConn(conn net.Conn, w *io.PipeWriter, gone func()) {
+	_, err := io.Copy(w, conn)
+	if err == nil {
+		err = io.EOF
+	}
+	w.CloseWithError(err)
+	gone()
+}
+
+// connBody is the Body of requests: the rest of what the client sends,
+// read from the parser buffer.
+type connBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Connection states, used by Shutdown to tell idle connections, which can
+// be closed right away, from the ones executing a command.
+const (
+	connIdle int32 = iota
+	connActive
+	connClosed
+)
+
+type conn struct {
+	net.Conn
+	state int32 // accessed atomically
+}
+
+func (c *conn) setState(from, to int32) bool {
+	return atomic.CompareAndSwapInt32(&c.state, from, to)
 }
 
 func (srv *Server) ListenAndServe() error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	l, e := srv.listen()
+	if e != nil {
+		return e
+	}
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(l, "", "")
+	}
+	return srv.Serve(l)
+}
+
+// ListenAndServeTLS acts like ListenAndServe but expects TLS connections.
+// The certificate and key are loaded from certFile and keyFile unless they
+// are empty and srv.TLSConfig already provides a certificate.
+//
+// To verify client certificates (mutual TLS), set ClientAuth and ClientCAs
+// in srv.TLSConfig. The verified certificate is then available to handlers
+// through Client.TLS and Request.TLS.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	l, e := srv.listen()
+	if e != nil {
+		return e
+	}
+	return srv.ServeTLS(l, certFile, keyFile)
+}
+
+func (srv *Server) listen() (net.Listener, error) {
 	addr := srv.Addr
 	if srv.Proto == "" {
 		srv.Proto = "tcp"
@@ -29,57 +225,247 @@ func (srv *Server) ListenAndServe() error {
 	} else if addr == "" {
 		addr = ":6389"
 	}
-	l, e := net.Listen(srv.Proto, addr)
-	if e != nil {
-		return e
+	return net.Listen(srv.Proto, addr)
+}
+
+// ServeTLS accepts TLS connections on the Listener l. See ListenAndServeTLS
+// for the meaning of certFile and keyFile.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		l.Close()
+		return err
 	}
-	return srv.Serve(l)
+	return srv.Serve(tls.NewListener(l, config))
+}
+
+func (srv *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" || len(config.Certificates) == 0 && config.GetCertificate == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append([]tls.Certificate{cert}, config.Certificates...)
+	}
+	return config, nil
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
 // new service goroutine for each.  The service goroutines read requests and
 // then call srv.Handler to reply to them.
+//
+// Serve always returns a non-nil error. After Shutdown or Close, the
+// returned error is ErrServerClosed.
 func (srv *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+
+	srv.monitorMu.Lock()
 	srv.MonitorChans = []chan string{}
+	srv.monitorMu.Unlock()
 	for {
 		rw, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		go srv.ServeClient(rw)
 	}
 }
 
+// Shutdown gracefully shuts down the server: it stops accepting
+// connections, interrupts blocked commands and streaming replies with
+// ErrServerClosed, lets the commands being executed finish, and closes
+// every connection once idle.
+//
+// If ctx expires first, Shutdown returns its error and the remaining
+// connections are left open; call Close to terminate them.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	err := srv.closeListenersLocked()
+	srv.closeDoneChanLocked()
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and connections, whatever they
+// are doing. For a graceful shutdown, use Shutdown.
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	err := srv.closeListenersLocked()
+	srv.closeDoneChanLocked()
+	for c := range srv.conns {
+		atomic.StoreInt32(&c.state, connClosed)
+		c.Close()
+	}
+	return err
+}
+
+// ActiveConns returns the number of connections currently served.
+func (srv *Server) ActiveConns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns)
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// getDoneChan returns a channel closed when the server shuts down.
+func (srv *Server) getDoneChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.doneChan == nil {
+		srv.doneChan = make(chan struct{})
+	}
+	return srv.doneChan
+}
+
+func (srv *Server) closeDoneChanLocked() {
+	if srv.doneChan == nil {
+		srv.doneChan = make(chan struct{})
+	}
+	select {
+	case <-srv.doneChan:
+	default:
+		close(srv.doneChan)
+	}
+	srv.baseContextLocked()
+	srv.cancelCtx()
+}
+
+// baseContext returns the context cancelled when the server shuts down.
+func (srv *Server) baseContext() context.Context {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.baseContextLocked()
+}
+
+func (srv *Server) baseContextLocked() context.Context {
+	if srv.ctx == nil {
+		srv.ctx, srv.cancelCtx = context.WithCancel(context.Background())
+	}
+	return srv.ctx
+}
+
+func (srv *Server) closeListenersLocked() error {
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeIdleConns closes the connections waiting for a command and reports
+// whether no connection is left.
+func (srv *Server) closeIdleConns() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		if c.setState(connIdle, connClosed) {
+			c.Close()
+		}
+	}
+	return len(srv.conns) == 0
+}
+
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]struct{})
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+func (srv *Server) trackConn(c *conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		if srv.conns == nil {
+			srv.conns = make(map[*conn]struct{})
+		}
+		srv.conns[c] = struct{}{}
+	} else {
+		delete(srv.conns, c)
+	}
+	return true
+}
+
 // Serve starts a new redis session, using `conn` as a transport.
 // It reads commands using the redis protocol, passes them to `handler`,
 // and returns the result.
-func (srv *Server) ServeClient(conn net.Conn) (err error) {
+//
+// The connection keeps a single buffered reader and writer: clients may
+// pipeline several commands in one write, and replies are only flushed once
+// every command already received has been answered.
+func (srv *Server) ServeClient(netConn net.Conn) (err error) {
+	conn := &conn{Conn: netConn, state: connActive}
+	if !srv.trackConn(conn, true) {
+		netConn.Close()
+		return ErrServerClosed
+	}
+	defer srv.trackConn(conn, false)
+
+	w := &connWriter{w: bufio.NewWriter(conn)}
 	defer func() {
-		if err != nil {
-			fmt.Fprintf(conn, "-%s\n", err)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if atomic.LoadInt32(&conn.state) == connClosed {
+			// Closed by the server while idle, not an error.
+			err = nil
+		} else if err != nil {
+			fmt.Fprintf(w.w, "-%s\n", err)
 		}
+		w.w.Flush()
 		conn.Close()
 	}()
 
-	clientChan := make(chan struct{})
-
-	// Read on `conn` in order to detect client disconnect
-	go func() {
-		// Close chan in order to trigger eventual selects
-		defer close(clientChan)
-		defer Debugf("Client disconnected")
-		// FIXME: move conn within the request.
-		if false {
-			io.Copy(ioutil.Discard, conn)
-		}
-	}()
-
 	var clientAddr string
 
-	switch co := conn.(type) {
+	switch co := netConn.(type) {
 	case *net.UnixConn:
-		f, err := conn.(*net.UnixConn).File()
+		f, err := co.File()
 		if err != nil {
 			return err
 		}
@@ -87,30 +473,93 @@ func (srv *Server) ServeClient(conn net.Conn) (err error) {
 	default:
 		clientAddr = co.RemoteAddr().String()
 	}
+	client := newClient(clientAddr)
+	client.done = srv.getDoneChan()
+	client.conn = conn
+	defer srv.unwatch(client)
+
+	// The client is closed, and the context of its requests cancelled,
+	// once the connection is gone or the server shuts down: this ends its streams and interrupts
+	// its blocked commands.
+	ctx, cancel := context.WithCancel(srv.baseContext())
+	gone := func() {
+		cancel()
+		client.close()
+	}
+	defer gone()
+
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		// Handshake now, so that the client certificate is known
+		// before the first command.
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			Debugf("TLS handshake error from %s: %s", clientAddr, err)
+			atomic.StoreInt32(&conn.state, connClosed)
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		client.TLS = &state
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go readConn(conn, pw, gone)
+	r := bufio.NewReader(pr)
 
 	for {
-		request, err := parseRequest(conn)
+		// Wait for the next command as idle, so that Shutdown can close
+		// the connection meanwhile.
+		if !conn.setState(connActive, connIdle) {
+			return nil
+		}
+		if _, err := r.Peek(1); err != nil {
+			return err
+		}
+		if !conn.setState(connIdle, connActive) {
+			return nil
+		}
+		request, err := parseRequest(r)
 		if err != nil {
 			return err
 		}
 		request.Host = clientAddr
-		request.ClientChan = clientChan
+		request.Client = client
+		request.TLS = client.TLS
+		request.ClientChan = client.closed
+		request.Body = connBody{r, conn}
+		request.ctx = ctx
 		reply, err := srv.Apply(request)
 		if err != nil {
 			return err
 		}
-		if _, err = reply.WriteTo(conn); err != nil {
+		if s, ok := reply.(streamingReply); ok {
+			err = s.serve(w, conn)
+		} else {
+			err = w.write(reply)
+		}
+		if err != nil {
 			return err
 		}
+		if r.Buffered() == 0 || srv.shuttingDown() {
+			if err = w.flush(); err != nil {
+				return err
+			}
+		}
+		if srv.shuttingDown() {
+			return nil
+		}
 	}
 	return nil
 }
 
 func NewServer(c *Config) (*Server, error) {
 	srv := &Server{
-		Proto:        c.proto,
-		MonitorChans: []chan string{},
-		methods:      make(map[string]HandlerFn),
+		Proto:          c.proto,
+		TLSConfig:      c.tlsConfig,
+		MonitorChans:   []chan string{},
+		methods:        make(map[string]HandlerFn),
+		commandTimeout: c.timeout,
 	}
 
 	if srv.Proto == "unix" {
@@ -119,6 +568,21 @@ func NewServer(c *Config) (*Server, error) {
 		srv.Addr = fmt.Sprintf("%s:%d", c.host, c.port)
 	}
 
+	srv.acl = newACL()
+	for _, u := range c.users {
+		if err := srv.acl.setUser(u.name, u.rules...); err != nil {
+			return nil, fmt.Errorf("ACL user %s: %s", u.name, err)
+		}
+	}
+	srv.Register("auth", srv.authCommand)
+	srv.Register("acl", srv.aclCommand)
+	srv.Register("hello", srv.helloCommand)
+	srv.Register("multi", srv.multiCommand)
+	srv.Register("exec", srv.execCommand)
+	srv.Register("discard", srv.discardCommand)
+	srv.Register("watch", srv.watchCommand)
+	srv.Register("unwatch", srv.unwatchCommand)
+
 	if c.handler == nil {
 		c.handler = NewDefaultHandler()
 	}
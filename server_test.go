@@ -1,9 +1,454 @@
 package redis
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestServer(t *testing.T) {
 	t.Skip("Not implemented")
 }
+
+// startServer serves srv on a random local port and returns its address.
+func startServer(t *testing.T, srv *Server) (string, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	return l.Addr().String(), l
+}
+
+// readReply reads a single non-aggregate reply and returns it verbatim.
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return line, err
+	}
+	if line[0] != '$' || line == "$-1\r\n" {
+		return line, nil
+	}
+	var size int
+	if _, err := fmt.Sscanf(line, "$%d\r", &size); err != nil {
+		return line, err
+	}
+	data := make([]byte, size+2)
+	if _, err := r.Read(data[:1]); err != nil {
+		return line, err
+	}
+	for n := 1; n < len(data); {
+		m, err := r.Read(data[n:])
+		if err != nil {
+			return line, err
+		}
+		n += m
+	}
+	return line + string(data), nil
+}
+
+func TestServerPipelining(t *testing.T) {
+	srv := newDefaultServer(t)
+	addr, l := startServer(t, srv)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const count = 10000
+	var buf bytes.Buffer
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&buf, "*3\r\n$5\r\nRPUSH\r\n$4\r\nlist\r\n$%d\r\n%d\r\n", len(fmt.Sprint(i)), i)
+	}
+	// Everything is sent at once, replies must come back in order.
+	go conn.Write(buf.Bytes())
+
+	r := bufio.NewReader(conn)
+	for i := 1; i <= count; i++ {
+		reply, err := readReply(r)
+		if err != nil {
+			t.Fatalf("Unexpected error after %d replies: %s", i-1, err)
+		}
+		if expected := fmt.Sprintf(":%d\r\n", i); reply != expected {
+			t.Fatalf("Expected %q, got %q", expected, reply)
+		}
+	}
+}
+
+func TestServerPipeliningChunked(t *testing.T) {
+	srv := newDefaultServer(t)
+	addr, l := startServer(t, srv)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Mix of the commands sent by redis-benchmark, both inline and
+	// multi bulk, split at random boundaries.
+	const count = 10000
+	var buf bytes.Buffer
+	expected := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("key:%012d", i%100)
+		value := strings.Repeat("x", i%7+1)
+		switch i % 4 {
+		case 0:
+			buf.WriteString("PING\r\n")
+			expected = append(expected, "+PONG\r\n")
+		case 1:
+			buf.WriteString("*1\r\n$4\r\nPING\r\n")
+			expected = append(expected, "+PONG\r\n")
+		case 2:
+			fmt.Fprintf(&buf, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(value), value)
+			expected = append(expected, "+OK\r\n")
+		case 3:
+			// Read back the value set by the previous command.
+			key = fmt.Sprintf("key:%012d", (i-1)%100)
+			value = strings.Repeat("x", (i-1)%7+1)
+			fmt.Fprintf(&buf, "*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+			expected = append(expected, fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+		}
+	}
+	go func() {
+		data := buf.Bytes()
+		rnd := rand.New(rand.NewSource(42))
+		for len(data) > 0 {
+			n := rnd.Intn(4096) + 1
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := conn.Write(data[:n]); err != nil {
+				return
+			}
+			data = data[n:]
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for i, e := range expected {
+		reply, err := readReply(r)
+		if err != nil {
+			t.Fatalf("Unexpected error after %d replies: %s", i, err)
+		}
+		if reply != e {
+			t.Fatalf("Reply %d: expected %q, got %q", i, e, reply)
+		}
+	}
+}
+
+func dial(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+// waitConns waits until srv serves exactly n connections.
+func waitConns(t *testing.T, srv *Server, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.ActiveConns() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d connections, got %d", n, srv.ActiveConns())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitBusy waits until n connections of srv are executing a command.
+func waitBusy(t *testing.T, srv *Server, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		busy := 0
+		srv.mu.Lock()
+		for c := range srv.conns {
+			if atomic.LoadInt32(&c.state) == connActive {
+				busy++
+			}
+		}
+		srv.mu.Unlock()
+		if busy == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d busy connections, got %d", n, busy)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv := newDefaultServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- srv.Serve(l) }()
+
+	idle, idleReader := dial(t, l.Addr().String())
+	defer idle.Close()
+	fmt.Fprint(idle, "PING\r\n")
+	if reply, _ := readReply(idleReader); reply != "+PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", reply)
+	}
+	blocked, blockedReader := dial(t, l.Addr().String())
+	defer blocked.Close()
+	fmt.Fprint(blocked, "BLPOP list 0\r\n")
+	monitor, monitorReader := dial(t, l.Addr().String())
+	defer monitor.Close()
+	fmt.Fprint(monitor, "MONITOR\r\n")
+	waitConns(t, srv, 3)
+	waitBusy(t, srv, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Expected ErrServerClosed, got %v", err)
+	}
+	if n := srv.ActiveConns(); n != 0 {
+		t.Fatalf("Expected no connection left, got %d", n)
+	}
+
+	if reply, _ := readReply(blockedReader); !strings.HasPrefix(reply, "-") {
+		t.Fatalf("Expected an error for the blocked command, got %q", reply)
+	}
+	// The monitor may have started soon enough to see the BLPOP.
+	reply, _ := readReply(monitorReader)
+	if strings.Contains(reply, `"blpop"`) {
+		reply, _ = readReply(monitorReader)
+	}
+	if !strings.HasPrefix(reply, "-") {
+		t.Fatalf("Expected an error for the monitor, got %q", reply)
+	}
+	if _, err := idleReader.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the idle connection to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("Expected the listener to be closed")
+	}
+	if err := srv.Serve(l); err != ErrServerClosed {
+		t.Fatalf("Expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServerShutdownInFlight(t *testing.T) {
+	srv := newDefaultServer(t)
+	started := make(chan struct{})
+	srv.Register("slow", func(r *Request) (ReplyWriter, error) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		return &StatusReply{code: "DONE"}, nil
+	})
+	addr, l := startServer(t, srv)
+	defer l.Close()
+
+	conn, r := dial(t, addr)
+	defer conn.Close()
+	fmt.Fprint(conn, "SLOW\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if reply, err := readReply(r); reply != "+DONE\r\n" {
+		t.Fatalf("Expected the in-flight command to finish, got %q (%v)", reply, err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	srv := newDefaultServer(t)
+	release := make(chan struct{})
+	srv.Register("stuck", func(r *Request) (ReplyWriter, error) {
+		<-release
+		return &StatusReply{code: "OK"}, nil
+	})
+	addr, l := startServer(t, srv)
+	defer l.Close()
+
+	conn, _ := dial(t, addr)
+	defer conn.Close()
+	fmt.Fprint(conn, "STUCK\r\n")
+	waitBusy(t, srv, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	close(release)
+	waitConns(t, srv, 0)
+}
+
+func TestServerClose(t *testing.T) {
+	srv := newDefaultServer(t)
+	addr, l := startServer(t, srv)
+	defer l.Close()
+
+	conn, r := dial(t, addr)
+	defer conn.Close()
+	fmt.Fprint(conn, "BLPOP list 0\r\n")
+	waitBusy(t, srv, 1)
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	waitConns(t, srv, 0)
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+}
+
+// readLines reads n lines and returns them verbatim.
+func readLines(t *testing.T, r *bufio.Reader, n int) string {
+	var lines string
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unexpected error after %q: %s", lines, err)
+		}
+		lines += line
+	}
+	return lines
+}
+
+func TestServerSubscribedMode(t *testing.T) {
+	srv := newDefaultServer(t)
+	addr, l := startServer(t, srv)
+	defer l.Close()
+
+	sub, r := dial(t, addr)
+	defer sub.Close()
+	pub, pr := dial(t, addr)
+	defer pub.Close()
+
+	fmt.Fprint(sub, "SUBSCRIBE a\r\n")
+	if reply, expected := readLines(t, r, 6), "*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n"; reply != expected {
+		t.Fatalf("Expected %q, got %q", expected, reply)
+	}
+	fmt.Fprint(pub, "PUBLISH a hi\r\n")
+	if reply, err := readReply(pr); err != nil || reply != ":1\r\n" {
+		t.Fatalf("Expected the message to be received, got %q, %v", reply, err)
+	}
+	if reply, expected := readLines(t, r, 7), "*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$2\r\nhi\r\n"; reply != expected {
+		t.Fatalf("Expected %q, got %q", expected, reply)
+	}
+
+	// Commands are still read, but only some are allowed.
+	fmt.Fprint(sub, "SUBSCRIBE b\r\nPING\r\nGET x\r\nUNSUBSCRIBE\r\nGET x\r\n")
+	expected := "*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n" +
+		"*2\r\n$4\r\npong\r\n$-1\r\n" +
+		"-ERROR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n" +
+		"*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:1\r\n" +
+		"*3\r\n$11\r\nunsubscribe\r\n$1\r\nb\r\n:0\r\n" +
+		"$-1\r\n"
+	if reply := readLines(t, r, 24); reply != expected {
+		t.Fatalf("Expected %q, got %q", expected, reply)
+	}
+}
+
+func TestServerStreamsDoNotInterleave(t *testing.T) {
+	srv := newDefaultServer(t)
+	const count = 1000
+	srv.Register("flood", func(r *Request) (ReplyWriter, error) {
+		reply := &MultiChannelWriter{}
+		for _, name := range []string{"a", "b"} {
+			c := make(chan []interface{})
+			reply.Chans = append(reply.Chans, &ChannelWriter{
+				FirstReply: []interface{}{"flood", name},
+				Channel:    c,
+			})
+			go func(name string) {
+				for i := 0; i < count; i++ {
+					c <- []interface{}{name, strings.Repeat(name, i%50+1)}
+				}
+				close(c)
+			}(name)
+		}
+		return reply, nil
+	})
+	addr, l := startServer(t, srv)
+	defer l.Close()
+
+	conn, r := dial(t, addr)
+	defer conn.Close()
+	fmt.Fprint(conn, "FLOOD\r\n")
+	readLines(t, r, 10)
+	seen := map[string]int{}
+	for i := 0; i < 2*count; i++ {
+		frame := readLines(t, r, 5)
+		lines := strings.Split(frame, "\r\n")
+		name, value := lines[2], lines[4]
+		if lines[0] != "*2" || value != strings.Repeat(name, seen[name]%50+1) {
+			t.Fatalf("Unexpected frame %q", frame)
+		}
+		seen[name]++
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	srv := newDefaultServer(t)
+	cancelled := make(chan bool, 1)
+	srv.Register("wait", func(r *Request) (ReplyWriter, error) {
+		<-r.Context().Done()
+		select {
+		case <-r.ClientChan:
+			cancelled <- true
+		default:
+			cancelled <- false
+		}
+		return &StatusReply{code: "OK"}, nil
+	})
+	srv.SetCommandSpec("wait", CommandSpec{Flags: CmdBlocking})
+	addr, l := startServer(t, srv)
+	defer l.Close()
+
+	waiting, _ := dial(t, addr)
+	fmt.Fprint(waiting, "WAIT\r\n")
+	blocked, _ := dial(t, addr)
+	fmt.Fprint(blocked, "BLPOP list 0\r\n")
+	conn, r := dial(t, addr)
+	defer conn.Close()
+	waitConns(t, srv, 3)
+	waitBusy(t, srv, 2)
+
+	waiting.Close()
+	select {
+	case ok := <-cancelled:
+		if !ok {
+			t.Fatal("Expected ClientChan to be closed with the context")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the context to be cancelled")
+	}
+
+	// The disconnected client does not take the element.
+	blocked.Close()
+	waitConns(t, srv, 1)
+	fmt.Fprint(conn, "RPUSH list x\r\nLLEN list\r\n")
+	if reply := readLines(t, r, 2); reply != ":1\r\n:1\r\n" {
+		t.Fatalf("Expected %q, got %q", ":1\r\n:1\r\n", reply)
+	}
+}
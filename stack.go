@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"bytes"
 	"sync"
 )
 
@@ -8,7 +9,6 @@ type Stack struct {
 	sync.Mutex
 	Key   string
 	stack [][]byte
-	Chan  chan *Stack
 }
 
 func (s *Stack) PopBack() []byte {
@@ -36,11 +36,6 @@ func (s *Stack) PushBack(val []byte) {
 		s.stack = [][]byte{}
 	}
 
-	go func() {
-		if s.Chan != nil {
-			s.Chan <- s
-		}
-	}()
 	s.stack = append(s.stack, val)
 }
 
@@ -70,11 +65,6 @@ func (s *Stack) PushFront(val []byte) {
 	}
 
 	s.stack = append([][]byte{val}, s.stack...)
-	go func() {
-		if s.Chan != nil {
-			s.Chan <- s
-		}
-	}()
 }
 
 // GetIndex return the element at the requested index.
@@ -104,7 +94,166 @@ func (s *Stack) Len() int {
 func NewStack(key string) *Stack {
 	return &Stack{
 		stack: [][]byte{},
-		Chan:  make(chan *Stack),
 		Key:   key,
 	}
 }
+
+// normalizeRange converts the start and stop indexes of a range, both
+// included and negative ones counting from the end, to positions in a list
+// of n elements. It returns false if the range is empty.
+func normalizeRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// Range returns a copy of the elements between start and stop, both
+// included. Negative indexes count from the end, -1 being the last element.
+func (s *Stack) Range(start, stop int) [][]byte {
+	s.Lock()
+	defer s.Unlock()
+
+	start, stop, ok := normalizeRange(start, stop, len(s.stack))
+	if !ok {
+		return nil
+	}
+	ret := make([][]byte, stop-start+1)
+	copy(ret, s.stack[start:stop+1])
+	return ret
+}
+
+// SetIndex replaces the element at index, negative indexes counting from
+// the end. It returns false if the index is out of range.
+func (s *Stack) SetIndex(index int, val []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if index < 0 {
+		index += len(s.stack)
+	}
+	if index < 0 || index >= len(s.stack) {
+		return false
+	}
+	s.stack[index] = val
+	return true
+}
+
+// Trim keeps only the elements between start and stop, both included.
+func (s *Stack) Trim(start, stop int) {
+	s.Lock()
+	defer s.Unlock()
+
+	start, stop, ok := normalizeRange(start, stop, len(s.stack))
+	if !ok {
+		s.stack = [][]byte{}
+		return
+	}
+	s.stack = append([][]byte{}, s.stack[start:stop+1]...)
+}
+
+// Remove removes the first count elements equal to val, the last -count
+// ones if count is negative, or all of them if count is 0. It returns the
+// number of elements removed.
+func (s *Stack) Remove(count int, val []byte) int {
+	s.Lock()
+	defer s.Unlock()
+
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	remove := make([]bool, len(s.stack))
+	removed := 0
+	for i := range s.stack {
+		if limit != 0 && removed == limit {
+			break
+		}
+		index := i
+		if count < 0 {
+			index = len(s.stack) - 1 - i
+		}
+		if bytes.Equal(s.stack[index], val) {
+			remove[index] = true
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+	stack := make([][]byte, 0, len(s.stack)-removed)
+	for i, v := range s.stack {
+		if !remove[i] {
+			stack = append(stack, v)
+		}
+	}
+	s.stack = stack
+	return removed
+}
+
+// Insert inserts val before or after the first element equal to pivot. It
+// returns the new length, or -1 if pivot was not found.
+func (s *Stack) Insert(pivot, val []byte, before bool) int {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, v := range s.stack {
+		if !bytes.Equal(v, pivot) {
+			continue
+		}
+		if !before {
+			i++
+		}
+		stack := make([][]byte, 0, len(s.stack)+1)
+		stack = append(stack, s.stack[:i]...)
+		stack = append(stack, val)
+		s.stack = append(stack, s.stack[i:]...)
+		return len(s.stack)
+	}
+	return -1
+}
+
+// Positions returns the indexes of the elements equal to val, like LPOS.
+// The search starts at the rank-th match, from the end if rank is negative,
+// stops after count matches (0 for all of them) and compares at most maxlen
+// elements (0 for all of them).
+func (s *Stack) Positions(val []byte, rank, count, maxlen int) []int {
+	s.Lock()
+	defer s.Unlock()
+
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+	positions := []int{}
+	for i := 0; i < len(s.stack) && (maxlen == 0 || i < maxlen); i++ {
+		index := i
+		if rank < 0 {
+			index = len(s.stack) - 1 - i
+		}
+		if !bytes.Equal(s.stack[index], val) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		positions = append(positions, index)
+		if count != 0 && len(positions) == count {
+			break
+		}
+	}
+	return positions
+}
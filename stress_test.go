@@ -0,0 +1,128 @@
+package redis
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// Run with `go test -race` to detect unsynchronized access to the
+// DefaultHandler storage.
+
+const (
+	stressWorkers    = 16
+	stressIterations = 500
+)
+
+// stressRequests returns groups of requests covering every DefaultHandler
+// command. Each group is sent in order by a single client.
+func stressRequests(worker int, rnd *rand.Rand) [][]*Request {
+	key := fmt.Sprintf("key%d", rnd.Intn(8))
+	other := fmt.Sprintf("key%d", rnd.Intn(8))
+	own := fmt.Sprintf("list-of-%d", worker)
+	value := fmt.Sprintf("value%d", rnd.Int())
+	db := fmt.Sprintf("%d", rnd.Intn(3))
+
+	return [][]*Request{
+		{req("SET", key, value)},
+		{req("GET", key)},
+		{req("DEL", key, other)},
+		{req("HSET", "h"+key, value, value)},
+		{req("HGET", "h"+key, value)},
+		{req("HGETALL", "h"+key)},
+		{req("RPUSH", "l"+key, value, value)},
+		{req("LPUSH", "l"+key, value)},
+		{req("LRANGE", "l"+key, "0", "-1")},
+		{req("LINDEX", "l"+key, "-1")},
+		{req("RPUSH", own, value), req("BLPOP", own, "1")},
+		{req("LPUSH", own, value), req("BRPOP", own, "1")},
+		{req("SUBSCRIBE", key), req("UNSUBSCRIBE")},
+		{req("PUBLISH", key, value)},
+		{req("SELECT", db)},
+		{req("SWAPDB", db, "0")},
+		{req("MOVE", key, "3")},
+		{req("DBSIZE")},
+		{req("PING")},
+		{req("MONITOR")},
+	}
+}
+
+func TestStressDefaultHandler(t *testing.T) {
+	srv := newDefaultServer(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, stressWorkers)
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			client := newClient(fmt.Sprintf("worker%d", worker))
+			rnd := rand.New(rand.NewSource(int64(worker)))
+			for i := 0; i < stressIterations; i++ {
+				groups := stressRequests(worker, rnd)
+				group := groups[rnd.Intn(len(groups))]
+				if i%100 == 99 {
+					group = []*Request{req("FLUSHDB")}
+					if worker == 0 {
+						group = []*Request{req("FLUSHALL")}
+					}
+				}
+				for _, request := range group {
+					request.Client = client
+					// Use Apply: SUBSCRIBE and MONITOR replies stream
+					// forever once written.
+					reply, err := srv.Apply(request)
+					if err != nil {
+						errs <- fmt.Errorf("%s %q: %s", request.Name, request.Args, err)
+						return
+					}
+					if reply, ok := reply.(*ErrorReply); ok {
+						errs <- fmt.Errorf("%s %q: unexpected reply %q", request.Name, request.Args, reply)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStressDefaultHandlerCounts(t *testing.T) {
+	srv := newDefaultServer(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			client := newClient(fmt.Sprintf("worker%d", worker))
+			for i := 0; i < stressIterations; i++ {
+				for _, r := range []*Request{
+					req("RPUSH", "list", "x"),
+					req("HSET", "hash", fmt.Sprintf("%d-%d", worker, i), "x"),
+					req("SET", fmt.Sprintf("%d-%d", worker, i), "x"),
+				} {
+					r.Client = client
+					if _, err := srv.Apply(r); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	client := newClient("check")
+	total := stressWorkers * stressIterations
+	runHandlerTests(t, srv, []handlerTest{
+		{client, req("LINDEX", "list", fmt.Sprintf("%d", total-1)), "$1\r\nx\r\n"},
+		{client, req("LINDEX", "list", fmt.Sprintf("%d", total)), "$-1\r\n"},
+		{client, req("DBSIZE"), fmt.Sprintf(":%d\r\n", total+2)},
+	})
+}
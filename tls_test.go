@@ -0,0 +1,236 @@
+package redis
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for cn signed by the CA, along with its PEM
+// encoded certificate and key.
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+type TLSHandler struct{}
+
+func (h *TLSHandler) WHOAMI(client *Client) (string, error) {
+	if client.TLS == nil {
+		return "", fmt.Errorf("not a TLS connection")
+	}
+	return client.CertificateCN(), nil
+}
+
+func (h *TLSHandler) SECRET(client *Client) (string, error) {
+	if client.CertificateCN() != "admin" {
+		return "", fmt.Errorf("permission denied")
+	}
+	return "42", nil
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, _, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	adminCert, _, _ := ca.issue(t, "admin", x509.ExtKeyUsageClientAuth)
+	userCert, _, _ := ca.issue(t, "user", x509.ExtKeyUsageClientAuth)
+
+	srv, err := NewServer(DefaultConfig().Handler(&TLSHandler{}).TLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	dialTLS := func(certs ...tls.Certificate) (*tls.Conn, error) {
+		return tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			RootCAs:      ca.pool,
+			Certificates: certs,
+		})
+	}
+
+	expected := []struct {
+		cert     tls.Certificate
+		command  string
+		expected string
+	}{
+		{adminCert, "WHOAMI", "$5\r\nadmin\r\n"},
+		{adminCert, "SECRET", "$2\r\n42\r\n"},
+		{userCert, "WHOAMI", "$4\r\nuser\r\n"},
+		{userCert, "SECRET", "-ERROR permission denied\r\n"},
+	}
+	for _, v := range expected {
+		conn, err := dialTLS(v.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "%s\r\n", v.command)
+		reply, err := readReply(bufio.NewReader(conn))
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if reply != v.expected {
+			t.Fatalf("Expected %q, got %q for %s", v.expected, reply, v.command)
+		}
+	}
+
+	// Without a client certificate the handshake must fail.
+	conn, err := dialTLS()
+	if err == nil {
+		fmt.Fprint(conn, "WHOAMI\r\n")
+		if reply, err := readReply(bufio.NewReader(conn)); err == nil {
+			t.Fatalf("Expected the connection to be refused, got %q", reply)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerListenAndServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	_, certPEM, keyPEM := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	dir, err := ioutil.TempDir("", "redis-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reserve a free port for ListenAndServeTLS.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	srv, err := NewServer(DefaultConfig().Handler(&TLSHandler{}).Port(addr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServeTLS(certFile, keyFile) }()
+	defer srv.Close()
+
+	var conn *tls.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = tls.Dial("tcp", addr.String(), &tls.Config{RootCAs: ca.pool}); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "WHOAMI\r\n")
+	// No client certificate: the connection is encrypted but anonymous.
+	if reply, err := readReply(bufio.NewReader(conn)); reply != "$-1\r\n" {
+		t.Fatalf("Expected an empty name, got %q (%v)", reply, err)
+	}
+
+	srv.Close()
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServerTLSMissingCertificate(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Handler(&TLSHandler{}).TLS(&tls.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ServeTLS(l, "", ""); err == nil {
+		t.Fatal("Expected an error without certificate")
+	}
+}
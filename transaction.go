@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// transaction holds the commands queued by a client since MULTI.
+type transaction struct {
+	queue []*Request
+
+	// aborted is set when a command could not be queued, because it does
+	// not exist or is not allowed: EXEC then discards the transaction.
+	aborted bool
+}
+
+// watchKey is a key watched with WATCH, in the database it was watched in.
+type watchKey struct {
+	db  int
+	key string
+}
+
+func (srv *Server) multiCommand(r *Request) (ReplyWriter, error) {
+	if r.Client == nil {
+		r.Client = newClient(r.Host)
+	}
+	if r.Client.multi != nil {
+		return ErrNestedMulti, nil
+	}
+	r.Client.multi = &transaction{}
+	return &StatusReply{code: "OK"}, nil
+}
+
+func (srv *Server) discardCommand(r *Request) (ReplyWriter, error) {
+	if r.Client == nil || r.Client.multi == nil {
+		return ErrDiscardNoMulti, nil
+	}
+	r.Client.multi = nil
+	srv.unwatch(r.Client)
+	return &StatusReply{code: "OK"}, nil
+}
+
+// execCommand runs the queued commands with every other command on hold,
+// and replies with their replies. The transaction is discarded, with a null
+// reply, if a watched key was modified since WATCH.
+func (srv *Server) execCommand(r *Request) (ReplyWriter, error) {
+	c := r.Client
+	if c == nil || c.multi == nil {
+		return ErrExecNoMulti, nil
+	}
+	tx := c.multi
+	c.multi = nil
+	defer srv.unwatch(c)
+	if tx.aborted {
+		return ErrExecAbort, nil
+	}
+
+	srv.txMu.Lock()
+	defer srv.txMu.Unlock()
+	srv.watchMu.Lock()
+	dirty := c.dirty
+	srv.watchMu.Unlock()
+	if dirty {
+		return NewNullArrayReply(), nil
+	}
+
+	c.inExec = true
+	defer func() { c.inExec = false }()
+	replies := make([]interface{}, 0, len(tx.queue))
+	for _, q := range tx.queue {
+		name := q.Name
+		reply, err := srv.call(q, srv.methods[strings.ToLower(name)], srv.commandSpec(name))
+		if err != nil {
+			reply = NewError(err.Error())
+		}
+		replies = append(replies, reply)
+	}
+	// The transaction is over, but still holds up the other commands:
+	// nothing gets between it and the clients it unblocked.
+	for _, fn := range c.afterExec {
+		fn()
+	}
+	c.afterExec = nil
+	return &MultiBulkReply{values: replies}, nil
+}
+
+// releaseTx releases the server txMu held by the blocking command of c
+// while it waits for other clients, so that it does not hold up
+// transactions. It returns the function taking it back.
+func (c *Client) releaseTx() func() {
+	tx := c.tx
+	if tx == nil {
+		return func() {}
+	}
+	tx.RUnlock()
+	return tx.RLock
+}
+
+func (srv *Server) watchCommand(r *Request) (ReplyWriter, error) {
+	if len(r.Args) == 0 {
+		return ErrWrongArgsNumber, nil
+	}
+	if r.Client == nil {
+		r.Client = newClient(r.Host)
+	}
+	c := r.Client
+	if c.multi != nil {
+		return ErrWatchInMulti, nil
+	}
+
+	srv.watchMu.Lock()
+	defer srv.watchMu.Unlock()
+	if srv.watchers == nil {
+		srv.watchers = make(map[watchKey]map[*Client]struct{})
+	}
+	if c.watched == nil {
+		c.watched = make(map[watchKey]struct{})
+	}
+	for _, arg := range r.Args {
+		k := watchKey{c.Db, string(arg)}
+		if srv.watchers[k] == nil {
+			srv.watchers[k] = make(map[*Client]struct{})
+		}
+		srv.watchers[k][c] = struct{}{}
+		c.watched[k] = struct{}{}
+	}
+	return &StatusReply{code: "OK"}, nil
+}
+
+func (srv *Server) unwatchCommand(r *Request) (ReplyWriter, error) {
+	if r.Client != nil {
+		srv.unwatch(r.Client)
+	}
+	return &StatusReply{code: "OK"}, nil
+}
+
+// unwatch forgets the keys watched by c.
+func (srv *Server) unwatch(c *Client) {
+	srv.watchMu.Lock()
+	defer srv.watchMu.Unlock()
+	for k := range c.watched {
+		delete(srv.watchers[k], c)
+		if len(srv.watchers[k]) == 0 {
+			delete(srv.watchers, k)
+		}
+	}
+	c.watched = nil
+	c.dirty = false
+}
+
+// touch marks the clients watching the keys the command of r may have
+// modified. Commands without keys, such as FLUSHDB, are assumed to modify
+// every key.
+func (srv *Server) touch(r *Request, spec CommandSpec) {
+	db := 0
+	if r.Client != nil {
+		db = r.Client.Db
+	}
+	srv.watchMu.Lock()
+	defer srv.watchMu.Unlock()
+	if len(srv.watchers) == 0 {
+		return
+	}
+	if spec.FirstKey <= 0 && spec.Keys == nil {
+		for _, clients := range srv.watchers {
+			for c := range clients {
+				c.dirty = true
+			}
+		}
+		return
+	}
+	for _, key := range spec.keys(r.Args) {
+		for c := range srv.watchers[watchKey{db, key}] {
+			c.dirty = true
+		}
+	}
+	if k, ok := otherDbKey(r); ok {
+		for c := range srv.watchers[k] {
+			c.dirty = true
+		}
+	}
+}
+
+// otherDbKey returns the key MOVE and COPY ... DB write to in another
+// database than the selected one.
+func otherDbKey(r *Request) (watchKey, bool) {
+	var key, index []byte
+	switch strings.ToLower(r.Name) {
+	case "move":
+		if len(r.Args) == 2 {
+			key, index = r.Args[0], r.Args[1]
+		}
+	case "copy":
+		for i := 2; i+1 < len(r.Args); i++ {
+			if strings.EqualFold(string(r.Args[i]), "db") {
+				key, index = r.Args[1], r.Args[i+1]
+			}
+		}
+	}
+	db, err := strconv.Atoi(string(index))
+	if key == nil || err != nil {
+		return watchKey{}, false
+	}
+	return watchKey{db, string(key)}, true
+}
@@ -0,0 +1,261 @@
+package redis
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultiExec(t *testing.T) {
+	srv := newDefaultServer(t)
+	c, other := newClient("c"), newClient("other")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("EXEC"), "-ERROR EXEC without MULTI\r\n"},
+		{c, req("DISCARD"), "-ERROR DISCARD without MULTI\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("MULTI"), "-ERROR MULTI calls can not be nested\r\n"},
+		{c, req("SET", "a", "1"), "+QUEUED\r\n"},
+		{c, req("INCR", "a"), "+QUEUED\r\n"},
+		{c, req("LPUSH", "a", "x"), "+QUEUED\r\n"},
+		{c, req("GET", "a"), "+QUEUED\r\n"},
+		{other, req("GET", "a"), "$-1\r\n"},
+		{c, req("EXEC"), "*4\r\n+OK\r\n:2\r\n" +
+			"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n$1\r\n2\r\n"},
+		{other, req("GET", "a"), "$1\r\n2\r\n"},
+
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("SET", "a", "3"), "+QUEUED\r\n"},
+		{c, req("DISCARD"), "+OK\r\n"},
+		{c, req("GET", "a"), "$1\r\n2\r\n"},
+
+		// Unknown commands abort the transaction.
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("SET", "a", "4"), "+QUEUED\r\n"},
+		{c, req("BOGUS"), "-ERROR Method is not supported\r\n"},
+		{c, req("EXEC"), "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{c, req("GET", "a"), "$1\r\n2\r\n"},
+
+		// Blocking commands do not wait within a transaction.
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("BLPOP", "list", "0"), "+QUEUED\r\n"},
+		{c, req("BZPOPMIN", "zset", "0"), "+QUEUED\r\n"},
+		{c, req("RPUSH", "list", "x"), "+QUEUED\r\n"},
+		{c, req("BRPOP", "list", "0"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*4\r\n*-1\r\n*-1\r\n:1\r\n*2\r\n$4\r\nlist\r\n$1\r\nx\r\n"},
+	})
+}
+
+func TestMultiExecResp3(t *testing.T) {
+	srv := newDefaultServer(t)
+	c := newClient("c")
+	c.Protocol = 3
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("ZADD", "z", "1.5", "m"), "+QUEUED\r\n"},
+		{c, req("ZSCORE", "z", "m"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*2\r\n:1\r\n,1.5\r\n"},
+	})
+}
+
+func TestWatch(t *testing.T) {
+	srv := newDefaultServer(t)
+	c, other := newClient("c"), newClient("other")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("WATCH"), "-ERROR Wrong number of arguments\r\n"},
+		{c, req("WATCH", "a", "b"), "+OK\r\n"},
+		{other, req("SET", "b", "1"), "+OK\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("WATCH", "c"), "-ERROR WATCH inside MULTI is not allowed\r\n"},
+		{c, req("SET", "a", "1"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*-1\r\n"},
+		{c, req("GET", "a"), "$-1\r\n"},
+
+		// EXEC forgets the watched keys.
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("SET", "a", "1"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*1\r\n+OK\r\n"},
+
+		// Reads and writes to other keys or databases do not count.
+		{c, req("WATCH", "a"), "+OK\r\n"},
+		{other, req("GET", "a"), "$1\r\n1\r\n"},
+		{other, req("SET", "b", "2"), "+OK\r\n"},
+		{other, req("SELECT", "1"), "+OK\r\n"},
+		{other, req("SET", "a", "2"), "+OK\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("INCR", "a"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*1\r\n:2\r\n"},
+
+		{c, req("WATCH", "a"), "+OK\r\n"},
+		{c, req("UNWATCH"), "+OK\r\n"},
+		{other, req("SELECT", "0"), "+OK\r\n"},
+		{other, req("DEL", "a"), ":1\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("SET", "a", "3"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*1\r\n+OK\r\n"},
+
+		// MOVE and COPY modify the key in the other database.
+		{other, req("SET", "m", "0"), "+OK\r\n"},
+		{c, req("SELECT", "1"), "+OK\r\n"},
+		{c, req("WATCH", "m"), "+OK\r\n"},
+		{other, req("MOVE", "m", "1"), ":1\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("GET", "m"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*-1\r\n"},
+		{c, req("WATCH", "n"), "+OK\r\n"},
+		{other, req("SET", "m", "1"), "+OK\r\n"},
+		{other, req("COPY", "m", "n", "DB", "1"), ":1\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("GET", "n"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*-1\r\n"},
+		{c, req("SELECT", "0"), "+OK\r\n"},
+
+		// Commands without keys modify them all.
+		{c, req("WATCH", "a"), "+OK\r\n"},
+		{other, req("FLUSHALL"), "+OK\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("SET", "a", "4"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*-1\r\n"},
+	})
+	c.Protocol = 3
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("WATCH", "a"), "+OK\r\n"},
+		{c, req("DEL", "a"), ":0\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("EXEC"), "_\r\n"},
+	})
+	if len(srv.watchers) != 0 {
+		t.Fatalf("Expected no watched keys left, got %v", srv.watchers)
+	}
+}
+
+func TestTransactionCustomHandler(t *testing.T) {
+	srv, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	counters := map[string]int{}
+	srv.Register("bump", func(r *Request) (ReplyWriter, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		counters[string(r.Args[0])]++
+		return &IntegerReply{number: counters[string(r.Args[0])]}, nil
+	})
+	srv.Register("peek", func(r *Request) (ReplyWriter, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return &IntegerReply{number: counters[string(r.Args[0])]}, nil
+	})
+	srv.SetCommandSpec("peek", CommandSpec{Flags: CmdReadOnly, FirstKey: 1, LastKey: 1, Step: 1})
+
+	c, other := newClient("c"), newClient("other")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("WATCH", "x"), "+OK\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("BUMP", "x"), "+QUEUED\r\n"},
+		{c, req("PEEK", "x"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*2\r\n:1\r\n:1\r\n"},
+
+		{c, req("WATCH", "x"), "+OK\r\n"},
+		{other, req("PEEK", "x"), ":1\r\n"},
+		{other, req("BUMP", "x"), ":2\r\n"},
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("BUMP", "x"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*-1\r\n"},
+		{c, req("PEEK", "x"), ":2\r\n"},
+	})
+}
+
+func TestExecIsAtomic(t *testing.T) {
+	srv := newDefaultServer(t)
+	const n = 10
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c := newClient("c")
+		for i := 0; i < 50; i++ {
+			requests := []*Request{req("MULTI")}
+			for j := 0; j < n; j++ {
+				requests = append(requests, req("INCR", "counter"))
+			}
+			for _, r := range append(requests, req("EXEC")) {
+				r.Client = c
+				if _, err := srv.Apply(r); err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+			}
+		}
+	}()
+
+	other := newClient("other")
+	for i := 0; i < 200; i++ {
+		r := req("GET", "counter")
+		r.Client = other
+		reply, err := srv.Apply(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if bulk, ok := reply.(*BulkReply); ok && bulk.value != nil {
+			v, _ := strconv.Atoi(string(bulk.value))
+			if v%n != 0 {
+				t.Fatalf("Expected a multiple of %d, got %d", n, v)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestExecBlockingCommands(t *testing.T) {
+	srv := newDefaultServer(t)
+	c, other := newClient("c"), newClient("other")
+
+	// Blocked clients are served once the transaction is over.
+	blocked := blockingApply(srv, other, req("BLPOP", "l", "0"))
+	time.Sleep(10 * time.Millisecond)
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("MULTI"), "+OK\r\n"},
+		{c, req("RPUSH", "l", "a"), "+QUEUED\r\n"},
+		{c, req("LLEN", "l"), "+QUEUED\r\n"},
+		{c, req("EXEC"), "*2\r\n:1\r\n:1\r\n"},
+	})
+	expectReply(t, blocked, "*2\r\n$1\r\nl\r\n$1\r\na\r\n")
+	runHandlerTests(t, srv, []handlerTest{
+		{c, req("LLEN", "l"), ":0\r\n"},
+	})
+
+	// Nor do blocking commands pop in the middle of a transaction.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			for _, r := range []*Request{req("MULTI"), req("RPUSH", "l", "x"), req("LPOP", "l"), req("EXEC")} {
+				r.Client = c
+				reply, err := srv.ApplyString(r)
+				if err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+				if r.Name == "EXEC" && reply != "*2\r\n:1\r\n$1\r\nx\r\n" {
+					t.Errorf("Expected the transaction to pop its element, got %q", reply)
+					return
+				}
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		r := req("BLPOP", "l", "0.001")
+		r.Client = other
+		if _, err := srv.Apply(r); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package redis
+
+import (
+	"math/rand"
+)
+
+const (
+	zskiplistMaxLevel = 32
+	zskiplistP        = 0.25
+)
+
+// ScoredMember is a member of a sorted set along with its score.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int // number of nodes skipped by forward, used to compute ranks
+}
+
+type zskiplistNode struct {
+	member   string
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+// zskiplist is the skiplist of redis sorted sets: nodes are ordered by
+// score then member, and each link knows how many nodes it spans so that
+// ranks are computed in O(log n).
+type zskiplist struct {
+	header *zskiplistNode
+	tail   *zskiplistNode
+	length int
+	level  int
+}
+
+func newZskiplist() *zskiplist {
+	return &zskiplist{
+		header: &zskiplistNode{level: make([]zskiplistLevel, zskiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < zskiplistMaxLevel && rand.Float64() < zskiplistP {
+		level++
+	}
+	return level
+}
+
+// zless reports whether the element (score1, member1) sorts before
+// (score2, member2).
+func zless(score1 float64, member1 string, score2 float64, member2 string) bool {
+	return score1 < score2 || (score1 == score2 && member1 < member2)
+}
+
+func (zsl *zskiplist) insert(score float64, member string) {
+	var update [zskiplistMaxLevel]*zskiplistNode
+	var rank [zskiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for next := x.level[i].forward; next != nil && zless(next.score, next.member, score, member); next = x.level[i].forward {
+			rank[i] += x.level[i].span
+			x = next
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &zskiplistNode{member: member, score: score, level: make([]zskiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+}
+
+func (zsl *zskiplist) deleteNode(x *zskiplistNode, update []*zskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+func (zsl *zskiplist) delete(score float64, member string) bool {
+	update := make([]*zskiplistNode, zskiplistMaxLevel)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for next := x.level[i].forward; next != nil && zless(next.score, next.member, score, member); next = x.level[i].forward {
+			x = next
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	zsl.deleteNode(x, update)
+	return true
+}
+
+// rank returns the 1-based rank of the element, 0 if it is not in the list.
+func (zsl *zskiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for next := x.level[i].forward; next != nil && !zless(score, member, next.score, next.member); next = x.level[i].forward {
+			rank += x.level[i].span
+			x = next
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the 1-based rank, nil if out of range.
+func (zsl *zskiplist) byRank(rank int) *zskiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank && x != zsl.header {
+			return x
+		}
+	}
+	return nil
+}
+
+// zrange is a range of elements of a sorted set, by score or by member.
+type zrange interface {
+	gteMin(x *zskiplistNode) bool
+	lteMax(x *zskiplistNode) bool
+}
+
+// first returns the first node in r along with its 1-based rank.
+func (zsl *zskiplist) first(r zrange) (*zskiplistNode, int) {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for next := x.level[i].forward; next != nil && !r.gteMin(next); next = x.level[i].forward {
+			rank += x.level[i].span
+			x = next
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x) {
+		return nil, 0
+	}
+	return x, rank + 1
+}
+
+// last returns the last node in r along with its 1-based rank.
+func (zsl *zskiplist) last(r zrange) (*zskiplistNode, int) {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for next := x.level[i].forward; next != nil && r.lteMax(next); next = x.level[i].forward {
+			rank += x.level[i].span
+			x = next
+		}
+	}
+	if x == zsl.header || !r.gteMin(x) {
+		return nil, 0
+	}
+	return x, rank
+}
+
+// scoreRange is a range of scores, as in ZRANGEBYSCORE.
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool // exclusive bounds
+}
+
+func (r *scoreRange) gteMin(x *zskiplistNode) bool {
+	if r.minex {
+		return x.score > r.min
+	}
+	return x.score >= r.min
+}
+
+func (r *scoreRange) lteMax(x *zskiplistNode) bool {
+	if r.maxex {
+		return x.score < r.max
+	}
+	return x.score <= r.max
+}
+
+// lexBound is a bound of a lexicographical range: "-" and "+" are the
+// infinite bounds, other ones start with "[" (inclusive) or "(".
+type lexBound struct {
+	value     string
+	inclusive bool
+	inf       int // -1 for "-", 1 for "+"
+}
+
+type lexRange struct {
+	min, max lexBound
+}
+
+func (r *lexRange) gteMin(x *zskiplistNode) bool {
+	switch {
+	case r.min.inf != 0:
+		return r.min.inf < 0
+	case r.min.inclusive:
+		return x.member >= r.min.value
+	}
+	return x.member > r.min.value
+}
+
+func (r *lexRange) lteMax(x *zskiplistNode) bool {
+	switch {
+	case r.max.inf != 0:
+		return r.max.inf > 0
+	case r.max.inclusive:
+		return x.member <= r.max.value
+	}
+	return x.member < r.max.value
+}
+
+// SortedSet is a set of members ordered by score. Rank and range queries
+// take O(log n). It is not safe for concurrent use: the Database shard
+// owning it must be locked.
+type SortedSet struct {
+	scores map[string]float64
+	zsl    *zskiplist
+}
+
+func NewSortedSet() *SortedSet {
+	return &SortedSet{
+		scores: make(map[string]float64),
+		zsl:    newZskiplist(),
+	}
+}
+
+func (z *SortedSet) Len() int {
+	return len(z.scores)
+}
+
+func (z *SortedSet) Score(member string) (float64, bool) {
+	score, exists := z.scores[member]
+	return score, exists
+}
+
+// Add sets the score of member, adding it if needed. It returns true if the
+// member was added.
+func (z *SortedSet) Add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.zsl.delete(old, member)
+	}
+	z.scores[member] = score
+	z.zsl.insert(score, member)
+	return !exists
+}
+
+func (z *SortedSet) Remove(member string) bool {
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+	delete(z.scores, member)
+	z.zsl.delete(score, member)
+	return true
+}
+
+// Rank returns the 0-based rank of member by ascending score, or by
+// descending score if reverse is set. It returns -1 if member does not
+// exist.
+func (z *SortedSet) Rank(member string, reverse bool) int {
+	score, exists := z.scores[member]
+	if !exists {
+		return -1
+	}
+	rank := z.zsl.rank(score, member)
+	if reverse {
+		return z.zsl.length - rank
+	}
+	return rank - 1
+}
+
+// RangeByRank returns the members between ranks start and stop, both
+// included, negative ranks counting from the end.
+func (z *SortedSet) RangeByRank(start, stop int, reverse bool) []ScoredMember {
+	start, stop, ok := normalizeRange(start, stop, z.zsl.length)
+	if !ok {
+		return nil
+	}
+	ret := make([]ScoredMember, 0, stop-start+1)
+	if reverse {
+		for x := z.zsl.byRank(z.zsl.length - start); len(ret) < cap(ret); x = x.backward {
+			ret = append(ret, ScoredMember{x.member, x.score})
+		}
+		return ret
+	}
+	for x := z.zsl.byRank(start + 1); len(ret) < cap(ret); x = x.level[0].forward {
+		ret = append(ret, ScoredMember{x.member, x.score})
+	}
+	return ret
+}
+
+// rangeBy returns the members in r, skipping offset of them and returning
+// at most count of them if count is not negative.
+func (z *SortedSet) rangeBy(r zrange, reverse bool, offset, count int) []ScoredMember {
+	var ret []ScoredMember
+	if reverse {
+		x, _ := z.zsl.last(r)
+		for ; x != nil && r.gteMin(x) && count != 0; x = x.backward {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			ret = append(ret, ScoredMember{x.member, x.score})
+			count--
+		}
+		return ret
+	}
+	x, _ := z.zsl.first(r)
+	for ; x != nil && r.lteMax(x) && count != 0; x = x.level[0].forward {
+		if offset > 0 {
+			offset--
+			continue
+		}
+		ret = append(ret, ScoredMember{x.member, x.score})
+		count--
+	}
+	return ret
+}
+
+// count returns the number of members in r.
+func (z *SortedSet) count(r zrange) int {
+	_, first := z.zsl.first(r)
+	if first == 0 {
+		return 0
+	}
+	_, last := z.zsl.last(r)
+	return last - first + 1
+}
+
+// removeRange removes the members in r and returns how many were removed.
+func (z *SortedSet) removeRange(r zrange) int {
+	members := z.rangeBy(r, false, 0, -1)
+	for _, m := range members {
+		z.Remove(m.Member)
+	}
+	return len(members)
+}
+
+// removeRangeByRank removes the members between ranks start and stop.
+func (z *SortedSet) removeRangeByRank(start, stop int) int {
+	members := z.RangeByRank(start, stop, false)
+	for _, m := range members {
+		z.Remove(m.Member)
+	}
+	return len(members)
+}
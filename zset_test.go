@@ -0,0 +1,65 @@
+package redis
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSortedSetRank(t *testing.T) {
+	z := NewSortedSet()
+	scores := map[string]float64{}
+	for i := 0; i < 2000; i++ {
+		member := strconv.Itoa(rand.Intn(500))
+		if rand.Intn(4) == 0 {
+			z.Remove(member)
+			delete(scores, member)
+			continue
+		}
+		score := float64(rand.Intn(100))
+		z.Add(member, score)
+		scores[member] = score
+	}
+
+	members := make([]string, 0, len(scores))
+	for m := range scores {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return zless(scores[members[i]], members[i], scores[members[j]], members[j])
+	})
+	if z.Len() != len(members) {
+		t.Fatalf("Expected %d members, got %d", len(members), z.Len())
+	}
+	for i, m := range members {
+		if rank := z.Rank(m, false); rank != i {
+			t.Fatalf("Expected %s to have rank %d, got %d", m, i, rank)
+		}
+		if rank := z.Rank(m, true); rank != len(members)-1-i {
+			t.Fatalf("Expected %s to have reverse rank %d, got %d", m, len(members)-1-i, rank)
+		}
+	}
+	for i, m := range z.RangeByRank(0, -1, false) {
+		if m.Member != members[i] || m.Score != scores[members[i]] {
+			t.Fatalf("Expected %s at rank %d, got %s", members[i], i, m.Member)
+		}
+	}
+	if z.Rank("missing", false) != -1 {
+		t.Fatal("Expected no rank for a missing member")
+	}
+
+	r := &scoreRange{min: 20, max: 40, maxex: true}
+	count := 0
+	for _, m := range members {
+		if scores[m] >= 20 && scores[m] < 40 {
+			count++
+		}
+	}
+	if n := z.count(r); n != count {
+		t.Fatalf("Expected %d members in [20, 40), got %d", count, n)
+	}
+	if n := len(z.rangeBy(r, true, 0, -1)); n != count {
+		t.Fatalf("Expected %d members in reverse [20, 40), got %d", count, n)
+	}
+}